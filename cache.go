@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+   An in-process cache of the catalog: products, deals and offerings. Listing
+   them and simulating prices read from it instead of the database, and every
+   catalog write through ProductService invalidates all of it so the next
+   reads load it again. Writes made straight to the database, or by another
+   server, aren't seen until this server writes too or restarts.
+*/
+type catalogCache struct {
+	mutex   sync.Mutex
+	entries map[string]interface{}
+	// bumped on every invalidation, so a load that raced a write isn't kept
+	generation uint64
+}
+
+func newCatalogCache() *catalogCache {
+	return &catalogCache{entries: make(map[string]interface{})}
+}
+
+// get returns what's cached under key, calling load when there isn't anything
+func (cache *catalogCache) get(ctx context.Context, key string, load func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	cache.mutex.Lock()
+	cached, ok := cache.entries[key]
+	generation := cache.generation
+	cache.mutex.Unlock()
+	if ok {
+		catalogCacheRequests.WithLabelValues(key, "hit").Inc()
+		return cached, nil
+	}
+
+	catalogCacheRequests.WithLabelValues(key, "miss").Inc()
+	loaded, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	if cache.generation == generation {
+		cache.entries[key] = loaded
+	}
+	cache.mutex.Unlock()
+	return loaded, nil
+}
+
+func (cache *catalogCache) invalidate() {
+	cache.mutex.Lock()
+	cache.entries = make(map[string]interface{})
+	cache.generation++
+	cache.mutex.Unlock()
+}
+
+// invalidate empties the cache after a catalog write, err is the write's and is passed through
+func (service *ProductService) invalidate(err error) error {
+	service.cache.invalidate()
+	return err
+}
+
+/* The cached lists are shared by every reader, so they're never modified */
+
+func (service *ProductService) cachedProducts(ctx context.Context) ([]*Product, error) {
+	products, err := service.cache.get(ctx, "products", func(ctx context.Context) (interface{}, error) {
+		return service.repository.listProducts(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products.([]*Product), nil
+}
+
+func (service *ProductService) cachedDeals(ctx context.Context) ([]*Deal, error) {
+	deals, err := service.cache.get(ctx, "deals", func(ctx context.Context) (interface{}, error) {
+		return service.repository.listDeals(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deals.([]*Deal), nil
+}
+
+func (service *ProductService) cachedOfferings(ctx context.Context) ([]*Offering, error) {
+	offerings, err := service.cache.get(ctx, "offerings", func(ctx context.Context) (interface{}, error) {
+		return service.repository.listOfferings(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offerings.([]*Offering), nil
+}
+
+/*
+   The deals and offerings carts are priced with, kept as a snapshot so it's
+   only built once per load. Pricing a cart then only reads the cart's lines,
+   see catalogSnapshot.withItems.
+*/
+func (service *ProductService) cachedPricing(ctx context.Context) (*catalogSnapshot, error) {
+	snapshot, err := service.cache.get(ctx, "pricing", func(ctx context.Context) (interface{}, error) {
+		deals, err := service.cachedDeals(ctx)
+		if err != nil {
+			return nil, err
+		}
+		offerings, err := service.cachedOfferings(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newCatalogSnapshot(nil, deals, offerings), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.(*catalogSnapshot), nil
+}
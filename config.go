@@ -1,15 +1,422 @@
 package main
 
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+   The server's settings. LoadConfig builds them up in layers, each one
+   overriding the one before it:
+
+   1. the defaults from NewConfig
+   2. a YAML or JSON file, given with -config or STORE_CONFIG
+   3. STORE_* environment variables
+   4. command line flags
+
+   The session key is a secret, so it only comes from STORE_SESSION_KEY.
+*/
+
+var ErrInvalidConfig = errors.New("invalid config")
+
 type Config struct {
-	Enabled      bool
-	DatabasePath string
-	Port         string
+	Flags        []FeatureFlag `json:"flags" yaml:"flags"`
+	DatabasePath string        `json:"database_path" yaml:"database_path"`
+	Port         string        `json:"port" yaml:"port"`
+	SessionKey   []byte        `json:"-" yaml:"-"`
+	LogLevel     string        `json:"log_level" yaml:"log_level"`
+	TLSCertFile  string        `json:"tls_cert_file" yaml:"tls_cert_file"`
+	TLSKeyFile   string        `json:"tls_key_file" yaml:"tls_key_file"`
+	ReadTimeout  Duration      `json:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout Duration      `json:"write_timeout" yaml:"write_timeout"`
+	IdleTimeout  Duration      `json:"idle_timeout" yaml:"idle_timeout"`
+	// how long in-flight requests get to finish once the server is told to stop
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	// the deadline every request's queries run under
+	RequestTimeout Duration `json:"request_timeout" yaml:"request_timeout"`
+	// the deadline an export runs and is written under instead, a feed of the whole catalog takes longer than a request
+	ExportTimeout Duration       `json:"export_timeout" yaml:"export_timeout"`
+	MaxBodyBytes  int64          `json:"max_body_bytes" yaml:"max_body_bytes"`
+	Database      DatabaseConfig `json:"database" yaml:"database"`
+	Tracing       TracingConfig  `json:"tracing" yaml:"tracing"`
+}
+
+/* Tuning for the database/sql connection pool, zero leaves the driver's default */
+type DatabaseConfig struct {
+	// sqlite, which opens the database path, or postgres, which connects to the DSN
+	Driver          string   `json:"driver" yaml:"driver"`
+	DSN             string   `json:"dsn" yaml:"dsn"`
+	MaxOpenConns    int      `json:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+}
+
+/* Where spans are sent, see tracing.go */
+type TracingConfig struct {
+	// none, stdout or otlp
+	Exporter string `json:"exporter" yaml:"exporter"`
+	// host:port of an OTLP/HTTP collector
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		Enabled:      true,
-		DatabasePath: "./store.db",
-		Port:         "8000",
+		Flags:           defaultFlags(),
+		DatabasePath:    "./store.db",
+		Port:            "8000",
+		SessionKey:      sessionKey(),
+		LogLevel:        "info",
+		ReadTimeout:     Duration{10 * time.Second},
+		WriteTimeout:    Duration{10 * time.Second},
+		IdleTimeout:     Duration{60 * time.Second},
+		ShutdownTimeout: Duration{15 * time.Second},
+		RequestTimeout:  Duration{5 * time.Second},
+		ExportTimeout:   Duration{5 * time.Minute},
+		MaxBodyBytes:    1 << 20,
+		Database: DatabaseConfig{
+			Driver:       DriverSQLite,
+			MaxIdleConns: 2,
+		},
+		Tracing: TracingConfig{
+			Exporter: TraceExporterNone,
+			Endpoint: "localhost:4318",
+		},
+	}
+}
+
+// LoadConfig reads the config for the command line arguments, see Config for the order things are applied in
+func LoadConfig(args []string) (*Config, error) {
+	return loadConfig(flag.NewFlagSet("store", flag.ContinueOnError), args)
+}
+
+// loadConfig is LoadConfig for a subcommand, commandLine already has the subcommand's own flags
+func loadConfig(commandLine *flag.FlagSet, args []string) (*Config, error) {
+	config := NewConfig()
+
+	path := commandLine.String("config", os.Getenv("STORE_CONFIG"), "path to a YAML or JSON config file")
+	port := commandLine.String("port", "", "port to listen on")
+	databasePath := commandLine.String("database", "", "path to the SQLite database")
+	logLevel := commandLine.String("log-level", "", "debug, info, warn or error")
+	tlsCert := commandLine.String("tls-cert", "", "TLS certificate file, serves HTTPS along with -tls-key")
+	tlsKey := commandLine.String("tls-key", "", "TLS private key file")
+	readTimeout := commandLine.Duration("read-timeout", 0, "how long reading a request may take")
+	writeTimeout := commandLine.Duration("write-timeout", 0, "how long writing a response may take")
+	idleTimeout := commandLine.Duration("idle-timeout", 0, "how long an idle keep-alive connection is kept open")
+	shutdownTimeout := commandLine.Duration("shutdown-timeout", 0, "how long in-flight requests get to finish when stopping")
+	requestTimeout := commandLine.Duration("request-timeout", 0, "how long a request's queries may take")
+	exportTimeout := commandLine.Duration("export-timeout", 0, "how long a catalog export may take")
+	maxBodyBytes := commandLine.Int64("max-body-bytes", 0, "largest request body accepted")
+	databaseDriver := commandLine.String("db-driver", "", "sqlite or postgres")
+	databaseDSN := commandLine.String("db-dsn", "", "PostgreSQL connection string, like postgres://store@localhost/store")
+	maxOpenConns := commandLine.Int("db-max-open-conns", 0, "most open database connections, 0 is unlimited")
+	maxIdleConns := commandLine.Int("db-max-idle-conns", 0, "most idle database connections")
+	connMaxLifetime := commandLine.Duration("db-conn-max-lifetime", 0, "how long a database connection is reused, 0 is forever")
+	traceExporter := commandLine.String("trace-exporter", "", "where spans go: none, stdout or otlp")
+	traceEndpoint := commandLine.String("trace-endpoint", "", "host:port of the OTLP collector")
+	flags := commandLine.String("flags", "", "feature flags like checkout=off,deals.bundles=25")
+	if err := commandLine.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := config.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// only the flags given on the command line override what's been loaded so far
+	var err error
+	commandLine.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Port = *port
+		case "database":
+			config.DatabasePath = *databasePath
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "tls-cert":
+			config.TLSCertFile = *tlsCert
+		case "tls-key":
+			config.TLSKeyFile = *tlsKey
+		case "read-timeout":
+			config.ReadTimeout = Duration{*readTimeout}
+		case "write-timeout":
+			config.WriteTimeout = Duration{*writeTimeout}
+		case "idle-timeout":
+			config.IdleTimeout = Duration{*idleTimeout}
+		case "shutdown-timeout":
+			config.ShutdownTimeout = Duration{*shutdownTimeout}
+		case "request-timeout":
+			config.RequestTimeout = Duration{*requestTimeout}
+		case "export-timeout":
+			config.ExportTimeout = Duration{*exportTimeout}
+		case "max-body-bytes":
+			config.MaxBodyBytes = *maxBodyBytes
+		case "db-driver":
+			config.Database.Driver = *databaseDriver
+		case "db-dsn":
+			config.Database.DSN = *databaseDSN
+		case "db-max-open-conns":
+			config.Database.MaxOpenConns = *maxOpenConns
+		case "db-max-idle-conns":
+			config.Database.MaxIdleConns = *maxIdleConns
+		case "db-conn-max-lifetime":
+			config.Database.ConnMaxLifetime = Duration{*connMaxLifetime}
+		case "trace-exporter":
+			config.Tracing.Exporter = *traceExporter
+		case "trace-endpoint":
+			config.Tracing.Endpoint = *traceEndpoint
+		case "flags":
+			config.Flags, err = parseFlagSettings(config.Flags, *flags)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, config.Validate()
+}
+
+// loadFile reads YAML or JSON depending on the file's extension
+func (config *Config) loadFile(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	defaults := config.Flags
+	config.Flags = nil
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(contents, config)
+	case ".json":
+		decoder := json.NewDecoder(strings.NewReader(string(contents)))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	default:
+		return fmt.Errorf("%w: %s should be a .yaml, .yml or .json file", ErrInvalidConfig, path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+
+	// the file only has to list the flags it changes
+	config.Flags, err = mergeFlags(defaults, config.Flags)
+	return err
+}
+
+func (config *Config) loadEnv() error {
+	var err error
+	setString := func(name string, value *string) {
+		if env := os.Getenv(name); env != "" {
+			*value = env
+		}
+	}
+	setInt := func(name string, value *int) {
+		if env := os.Getenv(name); env != "" && err == nil {
+			*value, err = strconv.Atoi(env)
+			if err != nil {
+				err = fmt.Errorf("%w: %s %q is not a number", ErrInvalidConfig, name, env)
+			}
+		}
+	}
+	setInt64 := func(name string, value *int64) {
+		if env := os.Getenv(name); env != "" && err == nil {
+			*value, err = strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				err = fmt.Errorf("%w: %s %q is not a number", ErrInvalidConfig, name, env)
+			}
+		}
+	}
+	setDuration := func(name string, value *Duration) {
+		if env := os.Getenv(name); env != "" && err == nil {
+			value.Duration, err = time.ParseDuration(env)
+			if err != nil {
+				err = fmt.Errorf("%w: %s %q is not a duration", ErrInvalidConfig, name, env)
+			}
+		}
+	}
+
+	setString("STORE_PORT", &config.Port)
+	setString("STORE_DATABASE_PATH", &config.DatabasePath)
+	setString("STORE_LOG_LEVEL", &config.LogLevel)
+	setString("STORE_TLS_CERT", &config.TLSCertFile)
+	setString("STORE_TLS_KEY", &config.TLSKeyFile)
+	setDuration("STORE_READ_TIMEOUT", &config.ReadTimeout)
+	setDuration("STORE_WRITE_TIMEOUT", &config.WriteTimeout)
+	setDuration("STORE_IDLE_TIMEOUT", &config.IdleTimeout)
+	setDuration("STORE_SHUTDOWN_TIMEOUT", &config.ShutdownTimeout)
+	setDuration("STORE_REQUEST_TIMEOUT", &config.RequestTimeout)
+	setDuration("STORE_EXPORT_TIMEOUT", &config.ExportTimeout)
+	setInt64("STORE_MAX_BODY_BYTES", &config.MaxBodyBytes)
+	setString("STORE_DB_DRIVER", &config.Database.Driver)
+	setString("STORE_DB_DSN", &config.Database.DSN)
+	setInt("STORE_DB_MAX_OPEN_CONNS", &config.Database.MaxOpenConns)
+	setInt("STORE_DB_MAX_IDLE_CONNS", &config.Database.MaxIdleConns)
+	setDuration("STORE_DB_CONN_MAX_LIFETIME", &config.Database.ConnMaxLifetime)
+	setString("STORE_TRACE_EXPORTER", &config.Tracing.Exporter)
+	setString("STORE_TRACE_ENDPOINT", &config.Tracing.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	config.Flags, err = parseFlagSettings(config.Flags, os.Getenv("STORE_FLAGS"))
+	return err
+}
+
+// Validate is run on startup so a bad setting stops the server before it listens
+func (config *Config) Validate() error {
+	port, err := strconv.Atoi(config.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%w: port %q must be a number between 1 and 65535", ErrInvalidConfig, config.Port)
+	}
+	switch config.Database.Driver {
+	case DriverSQLite:
+		if config.DatabasePath == "" {
+			return fmt.Errorf("%w: a database path is required", ErrInvalidConfig)
+		}
+	case DriverPostgres:
+		if config.Database.DSN == "" {
+			return fmt.Errorf("%w: the postgres driver needs a DSN", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: database driver %q must be sqlite or postgres", ErrInvalidConfig, config.Database.Driver)
+	}
+	if len(config.SessionKey) < 32 {
+		return fmt.Errorf("%w: the session key must be at least 32 bytes", ErrInvalidConfig)
+	}
+
+	switch config.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("%w: log level %q must be debug, info, warn or error", ErrInvalidConfig, config.LogLevel)
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("%w: the TLS certificate and key have to be set together", ErrInvalidConfig)
+	}
+	for _, path := range []string{config.TLSCertFile, config.TLSKeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	for name, timeout := range map[string]Duration{
+		"read timeout":               config.ReadTimeout,
+		"write timeout":              config.WriteTimeout,
+		"idle timeout":               config.IdleTimeout,
+		"shutdown timeout":           config.ShutdownTimeout,
+		"request timeout":            config.RequestTimeout,
+		"export timeout":             config.ExportTimeout,
+		"database conn max lifetime": config.Database.ConnMaxLifetime,
+	} {
+		if timeout.Duration < 0 {
+			return fmt.Errorf("%w: the %s can't be negative", ErrInvalidConfig, name)
+		}
+	}
+
+	if config.RequestTimeout.Duration == 0 {
+		return fmt.Errorf("%w: the request timeout has to be more than 0", ErrInvalidConfig)
+	}
+	if config.ExportTimeout.Duration == 0 {
+		return fmt.Errorf("%w: the export timeout has to be more than 0", ErrInvalidConfig)
+	}
+
+	if config.MaxBodyBytes < 1 {
+		return fmt.Errorf("%w: the max body size has to be at least 1 byte", ErrInvalidConfig)
+	}
+
+	if config.Database.MaxOpenConns < 0 || config.Database.MaxIdleConns < 0 {
+		return fmt.Errorf("%w: database connection limits can't be negative", ErrInvalidConfig)
+	}
+	if config.Database.MaxOpenConns > 0 && config.Database.MaxIdleConns > config.Database.MaxOpenConns {
+		return fmt.Errorf("%w: max idle connections can't be more than max open connections", ErrInvalidConfig)
+	}
+
+	switch config.Tracing.Exporter {
+	case TraceExporterNone, TraceExporterStdout:
+	case TraceExporterOTLP:
+		if config.Tracing.Endpoint == "" {
+			return fmt.Errorf("%w: the otlp exporter needs an endpoint", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: trace exporter %q must be none, stdout or otlp", ErrInvalidConfig, config.Tracing.Exporter)
+	}
+
+	for _, flag := range config.Flags {
+		if err := flag.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TLS is true when the server should serve HTTPS
+func (config *Config) TLS() bool {
+	return config.TLSCertFile != ""
+}
+
+/* A time.Duration that reads as "5s" or "1m30s" from YAML and JSON */
+type Duration struct {
+	time.Duration
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(duration.String())
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return duration.parse(value)
+}
+
+func (duration *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return duration.parse(value)
+}
+
+func (duration *Duration) parse(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", value)
+	}
+	duration.Duration = parsed
+	return nil
+}
+
+// sessionKey signs the session cookies. Without STORE_SESSION_KEY a random key
+// is used, so everyone is logged out when the server restarts.
+func sessionKey() []byte {
+	if key := os.Getenv("STORE_SESSION_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
 	}
+	return key
 }
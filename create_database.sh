@@ -3,7 +3,8 @@ sqlite3 store.db 'CREATE TABLE products (
 id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 name VARCHAR(32) NOT NULL,
 description TEXT,
-price VARCHAR(8) NOT NULL
+price VARCHAR(8) NOT NULL,
+category VARCHAR(32) NOT NULL DEFAULT ""
 );'
 
 sqlite3 store.db 'CREATE TABLE deals (
@@ -14,9 +15,20 @@ coupon VARCHAR(8) NOT NULL DEFAULT "0.0",
 percent VARCHAR(8) NOT NULL DEFAULT "0.0",
 x INTEGER NOT NULL DEFAULT 0,
 y INTEGER NOT NULL DEFAULT 0,
-exclusive BOOLEAN NOT NULL DEFAULT 1
+exclusive BOOLEAN NOT NULL DEFAULT 1,
+threshold VARCHAR(8) NOT NULL DEFAULT "0.00",
+min_quantity INTEGER NOT NULL DEFAULT 0,
+category VARCHAR(32) NOT NULL DEFAULT ""
 );'
 
+sqlite3 store.db 'CREATE TABLE deal_tiers (
+id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+deal_id INTEGER NOT NULL,
+min_quantity INTEGER NOT NULL DEFAULT 1,
+max_quantity INTEGER NOT NULL DEFAULT 0,
+price VARCHAR(8) NOT NULL DEFAULT "NAN",
+FOREIGN KEY (deal_id) REFERENCES deals (id) ON UPDATE RESTRICT);'
+
 sqlite3 store.db 'CREATE TABLE offerings (
 id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 product_id INTEGER NOT NULL,
@@ -26,13 +38,44 @@ modified_price VARCHAR(8) NOT NULL DEFAULT "NAN",
 FOREIGN KEY (product_id) REFERENCES products (id) ON UPDATE RESTRICT,
 FOREIGN KEY (deal_id) REFERENCES deals (id) ON UPDATE RESTRICT);'
 
+sqlite3 store.db 'CREATE TABLE users (
+id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+email VARCHAR(254) NOT NULL UNIQUE,
+password_hash VARCHAR(60) NOT NULL,
+role VARCHAR(16) NOT NULL DEFAULT "customer"
+);'
+
+sqlite3 store.db 'CREATE TABLE api_keys (
+id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+name VARCHAR(64) NOT NULL,
+prefix VARCHAR(16) NOT NULL,
+key_hash CHAR(64) NOT NULL UNIQUE,
+scopes TEXT NOT NULL,
+created_by INTEGER,
+created_at DATETIME NOT NULL,
+last_used_at DATETIME,
+revoked_at DATETIME,
+FOREIGN KEY (created_by) REFERENCES users (id)
+);'
+
+sqlite3 store.db 'CREATE TABLE carts (
+id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER UNIQUE,
+FOREIGN KEY (user_id) REFERENCES users (id)
+);'
+
 sqlite3 store.db 'CREATE TABLE cart (
 id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+cart_id INTEGER NOT NULL DEFAULT 0,
 product_id INTEGER NOT NULL,
 quantity INTEGER NOT NULL DEFAULT 1,
+FOREIGN KEY (cart_id) REFERENCES carts (id),
 FOREIGN KEY (product_id) REFERENCES products (id)
 );'
 
+# the schema above is migration 1, see migrations.go
+sqlite3 store.db 'PRAGMA user_version = 1;'
+
 #seed
 sqlite3 store.db 'INSERT INTO products (name, description, price) VALUES ("laptop", "very fast", "1000.00");'
 sqlite3 store.db 'INSERT INTO products (name, description, price) VALUES ("mouse", "much clicky", "10.00");'
@@ -42,10 +85,10 @@ sqlite3 store.db 'INSERT INTO products (name, description, price) VALUES ("keybo
 
 sqlite3 store.db 'INSERT INTO deals (name, type) VALUES ("Regular Price", "Retail");'
 sqlite3 store.db 'INSERT INTO deals (name, type) VALUES ("Get a mouse with every laptop", "Bundle");'
-sqlite3 store.db 'INSERT INTO deals (name, type, coupon) VALUES ("$10 off a monitor", "Bundle", "10.00");'
+sqlite3 store.db 'INSERT INTO deals (name, type, coupon) VALUES ("$10 off a monitor", "Flat", "10.00");'
 sqlite3 store.db 'INSERT INTO deals (name, type, x, y) VALUES ("Buy 2 usb get 1 free", "BuyXGetY", 2, 1);'
-sqlite3 store.db 'INSERT INTO deals (name, type, percent) VALUES ("50% off keyboards", "percent", "50");'
-sqlite3 store.db 'INSERT INTO deals (name, type) VALUES ("10% off any full price item", "percent");'
+sqlite3 store.db 'INSERT INTO deals (name, type, percent) VALUES ("50% off keyboards", "Percent", "0.5");'
+sqlite3 store.db 'INSERT INTO deals (name, type, percent) VALUES ("10% off any full price item", "Percent", "0.9");'
 # bundle mouse / laptop
 sqlite3 store.db 'INSERT INTO offerings (product_id, deal_id, active, modified_price) VALUES (1, 2, 1, "1000.00");'
 sqlite3 store.db 'INSERT INTO offerings (product_id, deal_id, active, modified_price) VALUES (2, 2, 1, "1000.00");'
@@ -63,7 +106,8 @@ sqlite3 store.db 'INSERT INTO offerings (product_id, deal_id, active) VALUES (1,
 
 
 
-sqlite3 store.db 'INSERT INTO cart (product_id, quantity) VALUES (1, 1);'
+sqlite3 store.db 'INSERT INTO carts (user_id) VALUES (NULL);'
+sqlite3 store.db 'INSERT INTO cart (cart_id, product_id, quantity) VALUES (1, 1, 1);'
 #sqlite3 store.db 'INSERT INTO cart (product_id, quantity) VALUES (2, 1);'
 #sqlite3 store.db 'INSERT INTO cart (product_id, quantity) VALUES (3, 1);'
 #sqlite3 store.db 'INSERT INTO cart (product_id, quantity) VALUES (4, 3);'
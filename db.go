@@ -1,78 +1,31 @@
 package main
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-/* Get all the relevant deals and offerings that are also in the cart*/
-func (repository *ProductRepository) getProductOfferings() []*ProductOffering {
-	rows, _ := repository.database.Query(`
-	    SELECT PID, DID, PNAME, DNAME, price, quantity, type, coupon, percent, x, y, modified_price
-	    FROM (
-		SELECT products.id AS PID, products.name AS PNAME,
-		products.price, deals.id AS DID, deals.name AS DNAME,
-		deals.type, deals.x, deals.y, deals.coupon, deals.percent,
-		offerings.modified_price
-		   FROM offerings
-		   INNER JOIN products on products.id = offerings.product_id
-		   INNER JOIN deals on deals.id = offerings.deal_id
-		   WHERE active = 1
-	       ) INNER JOIN cart on cart.product_id = pid WHERE cart.quantity > 0;`)
-	defer rows.Close()
-
-	var productOfferings []*ProductOffering
-	for rows.Next() {
-		var (
-			pid           int
-			did           int
-			pname         string
-			dname         string
-			price         string
-			quantity      int
-			dtype         DealType
-			coupon        string
-			percent       string
-			x             int
-			y             int
-			modifiedPrice string
-		)
-		err := rows.Scan(&pid, &did, &pname, &dname, &price, &quantity, &dtype, &coupon, &percent, &x, &y, &modifiedPrice)
-		if err != nil {
-			log.Fatalf("DB Scan error %v", err.Error())
-		}
-
-		productOfferings = append(productOfferings, &ProductOffering{
-			ProductID:     pid,
-			DealID:        did,
-			ProductName:   pname,
-			DealName:      dname,
-			Type:          dtype,
-			Price:         price,
-			Quantity:      quantity,
-			X:             x,
-			Y:             y,
-			Coupon:        coupon,
-			Percent:       percent,
-			ModifiedPrice: modifiedPrice,
-		})
-
-	}
-	return productOfferings
-
-}
-
-func (repository *ProductRepository) listCart() []Item {
-	rows, _ := repository.database.Query(`SELECT
+func (repository *ProductRepository) listCart(ctx context.Context, cartID int) ([]Item, error) {
+	defer observeQuery(ctx, "listCart", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT
 		products.id,
 		products.name,
 		products.description,
 		products.price,
+		products.category,
 		cart.quantity
 		FROM cart INNER JOIN
-		products ON products.id = cart.product_id;`)
-
+		products ON products.id = cart.product_id
+		WHERE cart.cart_id = ?
+		ORDER BY cart.id;`, cartID)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var items []Item
@@ -83,12 +36,13 @@ func (repository *ProductRepository) listCart() []Item {
 			name        string
 			price       string
 			description string
+			category    string
 			quantity    int
 		)
 
-		err := rows.Scan(&id, &name, &description, &price, &quantity)
+		err := rows.Scan(&id, &name, &description, &price, &category, &quantity)
 		if err != nil {
-			log.Fatalf("DB Scan error %v", err.Error())
+			return nil, err
 		}
 
 		items = append(items, Item{
@@ -97,232 +51,682 @@ func (repository *ProductRepository) listCart() []Item {
 				Name:        name,
 				Description: description,
 				Price:       price,
+				Category:    category,
 			},
 			quantity,
 		})
 	}
 
-	return items
+	return items, rows.Err()
 }
 
-func (repository *ProductRepository) addToCart(product Product) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`INSERT INTO cart (product_id) VALUES (?);`)
-	defer stmt.Close()
-	_, err := stmt.Exec(product.ID)
-	if err != nil {
-		err = tx.Rollback()
+/*
+   Adds one of the product to the cart, on top of any already in it.
+   sql.ErrNoRows when the product doesn't exist or has been deleted.
+*/
+func (repository *ProductRepository) addToCart(ctx context.Context, cartID int, product Product) error {
+	defer observeQuery(ctx, "addToCart", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		// the increment happens in the database, so concurrent adds can't lose each other's
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`INSERT INTO cart (cart_id, product_id, quantity)
+			SELECT ?, id, 1 FROM products WHERE id = ? AND deleted_at IS NULL
+			ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = cart.quantity + 1;`), cartID, product.ID)
+		if err != nil {
+			return err
+		}
+		added, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if added == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+func (repository *ProductRepository) updateCart(ctx context.Context, cartID int, item Item) error {
+	defer observeQuery(ctx, "updateCart", time.Now())
+	return repository.exec(ctx, `UPDATE cart SET quantity = ? WHERE cart_id = ? AND product_id = ?;`, item.Quantity, cartID, item.Product.ID)
+}
+
+func (repository *ProductRepository) removeFromCart(ctx context.Context, cartID int, product Product) error {
+	defer observeQuery(ctx, "removeFromCart", time.Now())
+	return repository.exec(ctx, `DELETE FROM cart WHERE cart_id = ? AND product_id = ?`, cartID, product.ID)
+}
+
+/* Starts an empty cart, anonymous when userID is 0 */
+func (repository *ProductRepository) newCart(ctx context.Context, userID int) (int, error) {
+	defer observeQuery(ctx, "newCart", time.Now())
+	owner := sql.NullInt64{Int64: int64(userID), Valid: userID != 0}
+	var cartID int
+	err := repository.queryRowContext(ctx, `INSERT INTO carts (user_id) VALUES (?) RETURNING id;`, owner).Scan(&cartID)
+	return cartID, err
+}
 
-		log.Fatalf("Statement error %v", err.Error())
+/* The cart that belongs to a customer, 0 if they don't have one yet */
+func (repository *ProductRepository) getUserCart(ctx context.Context, userID int) (int, error) {
+	defer observeQuery(ctx, "getUserCart", time.Now())
+	var cartID int
+	err := repository.queryRowContext(ctx, `SELECT id FROM carts WHERE user_id = ?;`, userID).Scan(&cartID)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
+	return cartID, err
+}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+/*
+   Moves every line of one cart into another. Products already in the
+   destination have their quantities added together, the source cart is removed.
+*/
+func (repository *ProductRepository) mergeCarts(ctx context.Context, fromCartID int, toCartID int) error {
+	defer observeQuery(ctx, "mergeCarts", time.Now())
+	statements := []string{
+		`UPDATE cart SET quantity = quantity + (
+		    SELECT SUM(source.quantity) FROM cart AS source
+		    WHERE source.cart_id = ? AND source.product_id = cart.product_id)
+		 WHERE cart_id = ? AND product_id IN (SELECT product_id FROM cart WHERE cart_id = ?);`,
+		`DELETE FROM cart WHERE cart_id = ? AND product_id IN (SELECT product_id FROM cart WHERE cart_id = ?);`,
+		`UPDATE cart SET cart_id = ? WHERE cart_id = ?;`,
+		`DELETE FROM carts WHERE id = ?;`,
+	}
+	arguments := [][]interface{}{
+		{fromCartID, toCartID, fromCartID},
+		{fromCartID, toCartID},
+		{toCartID, fromCartID},
+		{fromCartID},
 	}
 
-	return err
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		for i, statement := range statements {
+			if _, err := tx.ExecContext(ctx, repository.dialect.rebind(statement), arguments[i]...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (repository *ProductRepository) updateCart(item Item) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`UPDATE cart SET quantity = ? WHERE product_id = ?;`)
-	defer stmt.Close()
-	_, err := stmt.Exec(item.Quantity, item.Product.ID)
-	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+/* Users */
+func (repository *ProductRepository) insertUser(ctx context.Context, user User) (int, error) {
+	defer observeQuery(ctx, "insertUser", time.Now())
+	if user.Role == "" {
+		user.Role = RoleCustomer
 	}
+	var userID int
+	err := repository.queryRowContext(ctx, `INSERT INTO users (email, password_hash, role) VALUES (?, ?, ?) RETURNING id;`, user.Email, user.PasswordHash, user.Role).Scan(&userID)
+	return userID, err
+}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+/* Looks a customer up by email, the returned user is empty when there's no such account */
+func (repository *ProductRepository) getUserByEmail(ctx context.Context, email string) (User, error) {
+	defer observeQuery(ctx, "getUserByEmail", time.Now())
+	var user User
+	err := repository.queryRowContext(ctx, `SELECT id, email, role, password_hash FROM users WHERE email = ?;`, email).Scan(&user.ID, &user.Email, &user.Role, &user.PasswordHash)
+	if err == sql.ErrNoRows {
+		return User{}, nil
 	}
-
-	return err
+	return user, err
 }
 
-func (repository *ProductRepository) removeFromCart(product Product) error {
-	tx, _ := repository.database.Begin()
+/* Looks a customer up by id, the returned user is empty when there's no such account */
+func (repository *ProductRepository) getUser(ctx context.Context, userID int) (User, error) {
+	defer observeQuery(ctx, "getUser", time.Now())
+	var user User
+	err := repository.queryRowContext(ctx, `SELECT id, email, role, password_hash FROM users WHERE id = ?;`, userID).Scan(&user.ID, &user.Email, &user.Role, &user.PasswordHash)
+	if err == sql.ErrNoRows {
+		return User{}, nil
+	}
+	return user, err
+}
 
-	stmt, _ := tx.Prepare(`DELETE FROM cart WHERE product_id = ?`)
-	defer stmt.Close()
-	_, err := stmt.Exec(product.ID)
+func (repository *ProductRepository) updateUserRole(ctx context.Context, user User) error {
+	defer observeQuery(ctx, "updateUserRole", time.Now())
+	result, err := repository.execContext(ctx, `UPDATE users SET role = ? WHERE id = ?;`, user.Role, user.ID)
 	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return sql.ErrNoRows
 	}
+	return nil
+}
 
-	err = tx.Commit()
+/* API Keys */
+func (repository *ProductRepository) insertAPIKey(ctx context.Context, key APIKey) (int, error) {
+	defer observeQuery(ctx, "insertAPIKey", time.Now())
+	createdBy := sql.NullInt64{Int64: int64(key.CreatedBy), Valid: key.CreatedBy != 0}
+	var keyID int
+	err := repository.queryRowContext(ctx, `INSERT INTO api_keys (name, prefix, key_hash, scopes, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id;`,
+		key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), createdBy, key.CreatedAt).Scan(&keyID)
+	return keyID, err
+}
+
+func (repository *ProductRepository) listAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	defer observeQuery(ctx, "listAPIKeys", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT id, name, prefix, key_hash, scopes, created_by, created_at, last_used_at, revoked_at FROM api_keys ORDER BY id;`)
 	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
 	}
+	return keys, rows.Err()
+}
 
+/* Looks a key up by its hash, revoked keys are treated as if they don't exist */
+func (repository *ProductRepository) getAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error) {
+	defer observeQuery(ctx, "getAPIKeyByHash", time.Now())
+	row := repository.queryRowContext(ctx, `SELECT id, name, prefix, key_hash, scopes, created_by, created_at, last_used_at, revoked_at FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL;`, keyHash)
+	key, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return APIKey{}, nil
+	}
+	return key, err
+}
+
+func (repository *ProductRepository) touchAPIKey(ctx context.Context, keyID int, usedAt time.Time) error {
+	defer observeQuery(ctx, "touchAPIKey", time.Now())
+	_, err := repository.execContext(ctx, `UPDATE api_keys SET last_used_at = ? WHERE id = ?;`, usedAt, keyID)
 	return err
 }
 
-/* Offerings */
-func (repository *ProductRepository) insertOffering(offering Offering) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`INSERT INTO offerings (product_id, deal_id, modified_price, active) VALUES (?, ?, ?, ?);`)
-	defer stmt.Close()
-	_, err := stmt.Exec(offering.ProductID, offering.DealID, offering.ModifiedPrice, offering.Active)
+func (repository *ProductRepository) revokeAPIKey(ctx context.Context, keyID int, revokedAt time.Time) error {
+	defer observeQuery(ctx, "revokeAPIKey", time.Now())
+	result, err := repository.execContext(ctx, `UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL;`, revokedAt, keyID)
 	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return sql.ErrNoRows
 	}
+	return nil
+}
 
-	err = tx.Commit()
+// scanAPIKey reads a key from either a *sql.Row or *sql.Rows
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var createdBy sql.NullInt64
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &createdBy, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
 	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+		return APIKey{}, err
+	}
+	key.CreatedBy = int(createdBy.Int64)
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
 	}
+	return key, nil
+}
 
-	return err
+/* Offerings */
+func (repository *ProductRepository) insertOffering(ctx context.Context, offering Offering) (int, error) {
+	defer observeQuery(ctx, "insertOffering", time.Now())
+	var offeringID int
+	err := repository.queryRowContext(ctx, `INSERT INTO offerings (product_id, deal_id, modified_price, active) VALUES (?, ?, ?, ?) RETURNING id;`,
+		offering.ProductID, offering.DealID, offering.ModifiedPrice, offering.Active).Scan(&offeringID)
+	return offeringID, err
 }
 
-/* Lists all the product ID's in a given bundle */
-func (repository *ProductRepository) getBundleComponents(dID int) []*Offering {
+// insertOfferingWithID adds an offering with the id it already has, see insertProductWithID
+func (repository *ProductRepository) insertOfferingWithID(ctx context.Context, offering Offering) error {
+	defer observeQuery(ctx, "insertOfferingWithID", time.Now())
+	_, err := repository.execContext(ctx, `INSERT INTO offerings (id, product_id, deal_id, modified_price, active) VALUES (?, ?, ?, ?, ?);`,
+		offering.ID, offering.ProductID, offering.DealID, offering.ModifiedPrice, offering.Active)
+	if err != nil {
+		return err
+	}
+	return repository.dialect.advanceSequence(ctx, repository.querier(ctx), "offerings")
+}
 
-	rows, _ := repository.database.Query(`SELECT product_id, deal_id FROM offerings WHERE deal_id = ? ;`, dID)
+func (repository *ProductRepository) listOfferings(ctx context.Context) ([]*Offering, error) {
+	defer observeQuery(ctx, "listOfferings", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT id, product_id, deal_id, modified_price, active FROM offerings ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	offerings := []*Offering{}
 
 	for rows.Next() {
 		var (
-			productID int
-			dealID    int
+			id            int
+			productID     int
+			dealID        int
+			modifiedPrice string
+			active        bool
 		)
 
-		err := rows.Scan(&productID, &dealID)
+		err := rows.Scan(&id, &productID, &dealID, &modifiedPrice, &active)
 		if err != nil {
-
-			log.Fatalf("Error during scanning rows %v", err.Error())
+			return nil, err
 		}
 
 		offerings = append(offerings, &Offering{
-			ProductID: productID,
-			DealID:    dealID,
+			ID:            id,
+			ProductID:     productID,
+			DealID:        dealID,
+			ModifiedPrice: modifiedPrice,
+			Active:        active,
 		})
 	}
 
-	return offerings
+	return offerings, rows.Err()
 }
 
-/* Deals */
-func (repository *ProductRepository) insertDeal(deal Deal) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`INSERT INTO deals (name, type, coupon, percent, x, y, exclusive) VALUES (?, ?, ?, ?, ?, ?, ?);`)
-	defer stmt.Close()
-	_, err := stmt.Exec(deal.Name, deal.Type, deal.Coupon, deal.Percent, deal.X, deal.Y, deal.Exclusive)
+// getOffering returns the offering and its version, an empty offering and 0 when it doesn't exist
+func (repository *ProductRepository) getOffering(ctx context.Context, offeringID int) (Offering, int, error) {
+	defer observeQuery(ctx, "getOffering", time.Now())
+	var (
+		offering Offering
+		version  int
+	)
+	err := repository.queryRowContext(ctx, `SELECT id, product_id, deal_id, modified_price, active, version FROM offerings WHERE id = ?;`, offeringID).
+		Scan(&offering.ID, &offering.ProductID, &offering.DealID, &offering.ModifiedPrice, &offering.Active, &version)
+	if err == sql.ErrNoRows {
+		return Offering{}, 0, nil
+	}
 	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+		return Offering{}, 0, err
 	}
+	return offering, version, nil
+}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+// updateOffering only updates the offering while it's at version, like updateProduct
+func (repository *ProductRepository) updateOffering(ctx context.Context, offering Offering, version int) error {
+	defer observeQuery(ctx, "updateOffering", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`UPDATE offerings SET product_id = ?, deal_id = ?, modified_price = ?, active = ?, version = version + 1 WHERE id = ? AND (version = ? OR ? = 0);`),
+			offering.ProductID, offering.DealID, offering.ModifiedPrice, offering.Active, offering.ID, version, version)
+		if err != nil {
+			return err
+		}
+		return repository.versionChecked(ctx, tx, result, "offerings", offering.ID)
+	})
+}
+
+func (repository *ProductRepository) deleteOffering(ctx context.Context, offeringID int, version int) error {
+	defer observeQuery(ctx, "deleteOffering", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`DELETE FROM offerings WHERE id = ? AND (version = ? OR ? = 0);`), offeringID, version, version)
+		if err != nil {
+			return err
+		}
+		return repository.versionChecked(ctx, tx, result, "offerings", offeringID)
+	})
+}
+
+/* Deals */
+func (repository *ProductRepository) insertDeal(ctx context.Context, deal Deal) (int, error) {
+	defer observeQuery(ctx, "insertDeal", time.Now())
+	var dealID int
+	err := repository.transaction(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, repository.dialect.rebind(`INSERT INTO deals (name, type, coupon, percent, x, y, exclusive, threshold, min_quantity, category, active) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id;`),
+			deal.Name, deal.Type, deal.Coupon, deal.Percent, deal.X, deal.Y, deal.Exclusive, deal.Threshold, deal.MinQuantity, deal.Category, deal.isActive()).Scan(&dealID)
+		if err != nil {
+			return err
+		}
+		return repository.insertDealTiers(ctx, tx, dealID, deal.Tiers)
+	})
+	return dealID, err
+}
+
+// insertDealWithID adds a deal with the id it already has, see insertProductWithID
+func (repository *ProductRepository) insertDealWithID(ctx context.Context, deal Deal) error {
+	defer observeQuery(ctx, "insertDealWithID", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, repository.dialect.rebind(`INSERT INTO deals (id, name, type, coupon, percent, x, y, exclusive, threshold, min_quantity, category, active) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`),
+			deal.ID, deal.Name, deal.Type, deal.Coupon, deal.Percent, deal.X, deal.Y, deal.Exclusive, deal.Threshold, deal.MinQuantity, deal.Category, deal.isActive())
+		if err != nil {
+			return err
+		}
+		if err := repository.dialect.advanceSequence(ctx, tx, "deals"); err != nil {
+			return err
+		}
+		return repository.insertDealTiers(ctx, tx, deal.ID, deal.Tiers)
+	})
+}
+
+func (repository *ProductRepository) insertDealTiers(ctx context.Context, tx *sql.Tx, dealID int, tiers []Tier) error {
+	for _, tier := range tiers {
+		_, err := tx.ExecContext(ctx, repository.dialect.rebind(`INSERT INTO deal_tiers (deal_id, min_quantity, max_quantity, price) VALUES (?, ?, ?, ?);`), dealID, tier.MinQuantity, tier.MaxQuantity, tier.Price)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return err
+// updateDeal replaces the deal and its tiers while it's at version, like updateProduct
+func (repository *ProductRepository) updateDeal(ctx context.Context, deal Deal, version int) error {
+	defer observeQuery(ctx, "updateDeal", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`UPDATE deals SET name = ?, type = ?, coupon = ?, percent = ?, x = ?, y = ?, exclusive = ?, threshold = ?, min_quantity = ?, category = ?, active = ?, version = version + 1 WHERE id = ? AND (version = ? OR ? = 0);`),
+			deal.Name, deal.Type, deal.Coupon, deal.Percent, deal.X, deal.Y, deal.Exclusive, deal.Threshold, deal.MinQuantity, deal.Category, deal.isActive(), deal.ID, version, version)
+		if err != nil {
+			return err
+		}
+		if err := repository.versionChecked(ctx, tx, result, "deals", deal.ID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, repository.dialect.rebind(`DELETE FROM deal_tiers WHERE deal_id = ?;`), deal.ID); err != nil {
+			return err
+		}
+		return repository.insertDealTiers(ctx, tx, deal.ID, deal.Tiers)
+	})
+}
+
+/*
+   Deletes the deal at version along with its tiers. A deal that's still
+   offered is ErrDealInUse, its offerings have to be deleted first.
+*/
+func (repository *ProductRepository) deleteDeal(ctx context.Context, dealID int, version int) error {
+	defer observeQuery(ctx, "deleteDeal", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		var offerings int
+		err := tx.QueryRowContext(ctx, repository.dialect.rebind(`SELECT count(*) FROM offerings WHERE deal_id = ?;`), dealID).Scan(&offerings)
+		if err != nil {
+			return err
+		}
+		if offerings > 0 {
+			return ErrDealInUse
+		}
+		// the deal's version is checked after, a mismatch rolls the tiers back
+		if _, err := tx.ExecContext(ctx, repository.dialect.rebind(`DELETE FROM deal_tiers WHERE deal_id = ?;`), dealID); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`DELETE FROM deals WHERE id = ? AND (version = ? OR ? = 0);`), dealID, version, version)
+		if err != nil {
+			return err
+		}
+		return repository.versionChecked(ctx, tx, result, "deals", dealID)
+	})
 }
 
-func (repository *ProductRepository) listDeals() []*Deal {
-	rows, _ := repository.database.Query(`SELECT * FROM deals;`)
+func (repository *ProductRepository) listDeals(ctx context.Context) ([]*Deal, error) {
+	defer observeQuery(ctx, "listDeals", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT id, name, type, coupon, percent, x, y, exclusive, threshold, min_quantity, category, active FROM deals ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	deals := []*Deal{}
 
 	for rows.Next() {
 		var (
-			id        int
-			name      string
-			btype     DealType
-			coupon    string
-			percent   string
-			x         int
-			y         int
-			exclusive bool
+			id          int
+			name        string
+			btype       DealType
+			coupon      string
+			percent     string
+			x           int
+			y           int
+			exclusive   bool
+			threshold   string
+			minQuantity int
+			category    string
+			active      bool
 		)
 
-		err := rows.Scan(&id, &name, &btype, &coupon, &percent, &x, &y, &exclusive)
+		err := rows.Scan(&id, &name, &btype, &coupon, &percent, &x, &y, &exclusive, &threshold, &minQuantity, &category, &active)
 		if err != nil {
-
-			log.Fatalf("Error during scanning rows %v", err.Error())
+			return nil, err
 		}
 
 		deals = append(deals, &Deal{
-			ID:        id,
-			Name:      name,
-			Type:      btype,
-			Coupon:    coupon,
-			Percent:   percent,
-			X:         x,
-			Y:         y,
-			Exclusive: exclusive,
+			ID:          id,
+			Name:        name,
+			Type:        btype,
+			Coupon:      coupon,
+			Percent:     percent,
+			X:           x,
+			Y:           y,
+			Exclusive:   exclusive,
+			Threshold:   threshold,
+			MinQuantity: minQuantity,
+			Category:    category,
+			Active:      dealActive(active),
 		})
 	}
 
-	return deals
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tiers, err := repository.listDealTiers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, deal := range deals {
+		deal.Tiers = tiers[deal.ID]
+	}
+
+	return deals, nil
 }
 
-func (repository *ProductRepository) insertProduct(product Product) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`INSERT INTO products (name, description, price) VALUES (?, ?, ?);`)
-	defer stmt.Close()
-	_, err := stmt.Exec(product.Name, product.Description, product.Price)
+// getDeal returns the deal with its tiers and its version, an empty deal and 0 when it doesn't exist
+func (repository *ProductRepository) getDeal(ctx context.Context, dealID int) (Deal, int, error) {
+	defer observeQuery(ctx, "getDeal", time.Now())
+	var (
+		deal    Deal
+		active  bool
+		version int
+	)
+	err := repository.queryRowContext(ctx, `SELECT id, name, type, coupon, percent, x, y, exclusive, threshold, min_quantity, category, active, version FROM deals WHERE id = ?;`, dealID).
+		Scan(&deal.ID, &deal.Name, &deal.Type, &deal.Coupon, &deal.Percent, &deal.X, &deal.Y, &deal.Exclusive, &deal.Threshold, &deal.MinQuantity, &deal.Category, &active, &version)
+	if err == sql.ErrNoRows {
+		return Deal{}, 0, nil
+	}
+	if err != nil {
+		return Deal{}, 0, err
+	}
 
+	tiers, err := repository.getDealTiers(ctx, []int{dealID})
 	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+		return Deal{}, 0, err
 	}
+	deal.Tiers = tiers[dealID]
+	deal.Active = dealActive(active)
+	return deal, version, nil
+}
 
-	err = tx.Commit()
+/* Tiers of every tiered deal, keyed by deal id and ordered by quantity */
+func (repository *ProductRepository) listDealTiers(ctx context.Context) (map[int][]Tier, error) {
+	defer observeQuery(ctx, "listDealTiers", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT deal_id, min_quantity, max_quantity, price FROM deal_tiers ORDER BY deal_id, min_quantity;`)
 	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+		return nil, err
 	}
+	defer rows.Close()
 
-	return err
+	tiers := make(map[int][]Tier)
+
+	for rows.Next() {
+		var (
+			dealID      int
+			minQuantity int
+			maxQuantity int
+			price       string
+		)
+
+		err := rows.Scan(&dealID, &minQuantity, &maxQuantity, &price)
+		if err != nil {
+			return nil, err
+		}
+
+		tiers[dealID] = append(tiers[dealID], Tier{
+			MinQuantity: minQuantity,
+			MaxQuantity: maxQuantity,
+			Price:       price,
+		})
+	}
+
+	return tiers, rows.Err()
 }
 
-func (repository *ProductRepository) updateProduct(product Product) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`UPDATE products SET name = ?, description = ?, price = ? WHERE id = ?;`)
-	defer stmt.Close()
-	_, err := stmt.Exec(product.Name, product.Description, product.Price, product.ID) //.Scan(&id, &name, &description, &price)
-	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+/* Tiers of the given deals, keyed by deal id and ordered by quantity */
+func (repository *ProductRepository) getDealTiers(ctx context.Context, dealIDs []int) (map[int][]Tier, error) {
+	defer observeQuery(ctx, "getDealTiers", time.Now())
+	tiers := make(map[int][]Tier)
+	if len(dealIDs) == 0 {
+		return tiers, nil
 	}
 
-	err = tx.Commit()
+	rows, err := repository.queryContext(ctx, `SELECT deal_id, min_quantity, max_quantity, price FROM deal_tiers WHERE deal_id IN (`+placeholders(len(dealIDs))+`) ORDER BY deal_id, min_quantity;`, intArgs(dealIDs)...)
 	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+		return nil, err
 	}
-	return err
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			dealID      int
+			minQuantity int
+			maxQuantity int
+			price       string
+		)
+
+		err := rows.Scan(&dealID, &minQuantity, &maxQuantity, &price)
+		if err != nil {
+			return nil, err
+		}
+
+		tiers[dealID] = append(tiers[dealID], Tier{
+			MinQuantity: minQuantity,
+			MaxQuantity: maxQuantity,
+			Price:       price,
+		})
+	}
+
+	return tiers, rows.Err()
 }
 
-func (repository *ProductRepository) deleteProduct(product Product) error {
-	tx, _ := repository.database.Begin()
-	stmt, _ := tx.Prepare(`DELETE FROM products WHERE id = ?`)
-	defer stmt.Close()
+func (repository *ProductRepository) insertProduct(ctx context.Context, product Product) (int, error) {
+	defer observeQuery(ctx, "insertProduct", time.Now())
+	var productID int
+	err := repository.queryRowContext(ctx, `INSERT INTO products (name, description, price, category) VALUES (?, ?, ?, ?) RETURNING id;`,
+		product.Name, product.Description, product.Price, product.Category).Scan(&productID)
+	return productID, err
+}
 
-	_, err := stmt.Exec(product.ID)
+/*
+   Adds a product with the id it already has, like one from an import, and
+   moves the ids products are given on past it. False when there's a product
+   with the id already, deleted ones included.
+*/
+func (repository *ProductRepository) insertProductWithID(ctx context.Context, product Product) (bool, error) {
+	defer observeQuery(ctx, "insertProductWithID", time.Now())
+	result, err := repository.execContext(ctx, `INSERT INTO products (id, name, description, price, category) VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING;`,
+		product.ID, product.Name, product.Description, product.Price, product.Category)
 	if err != nil {
-		err = tx.Rollback()
-		log.Fatalf("Statement error %v", err.Error())
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted == 0 {
+		return false, err
 	}
+	return true, repository.dialect.advanceSequence(ctx, repository.querier(ctx), "products")
+}
+
+/*
+   Updates the product when it's still at version, or whatever version it's
+   at when version is anyVersion, and bumps its version. A product that's
+   moved on is ErrVersionMismatch and one that doesn't exist, or has been
+   deleted, sql.ErrNoRows.
+*/
+func (repository *ProductRepository) updateProduct(ctx context.Context, product Product, version int) error {
+	defer observeQuery(ctx, "updateProduct", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`UPDATE products SET name = ?, description = ?, price = ?, category = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (version = ? OR ? = 0);`),
+			product.Name, product.Description, product.Price, product.Category, product.ID, version, version)
+		if err != nil {
+			return err
+		}
+		return repository.versionChecked(ctx, tx, result, "products", product.ID)
+	})
+}
 
-	err = tx.Commit()
+/*
+   Deletes the product at version, like updateProduct. The row stays for the
+   carts and offerings that still point at it, marked deleted so the catalog
+   leaves it out.
+*/
+func (repository *ProductRepository) deleteProduct(ctx context.Context, product Product, version int, deletedAt time.Time) error {
+	defer observeQuery(ctx, "deleteProduct", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`UPDATE products SET deleted_at = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (version = ? OR ? = 0);`),
+			deletedAt, product.ID, version, version)
+		if err != nil {
+			return err
+		}
+		return repository.versionChecked(ctx, tx, result, "products", product.ID)
+	})
+}
+
+/* Brings a deleted product back, it's sql.ErrNoRows when there's no such product and ErrNotDeleted when it isn't deleted */
+func (repository *ProductRepository) restoreProduct(ctx context.Context, productID int) error {
+	defer observeQuery(ctx, "restoreProduct", time.Now())
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, repository.dialect.rebind(`UPDATE products SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL;`), productID)
+		if err != nil {
+			return err
+		}
+		changed, err := result.RowsAffected()
+		if err != nil || changed > 0 {
+			return err
+		}
+		var rows int
+		err = tx.QueryRowContext(ctx, repository.dialect.rebind(`SELECT count(*) FROM products WHERE id = ?;`), productID).Scan(&rows)
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+		return ErrNotDeleted
+	})
+}
+
+/*
+   Tells why a versioned write to a row of a products, deals or offerings
+   table didn't change anything, if it didn't: sql.ErrNoRows when there's no
+   such row, deleted products included, ErrVersionMismatch otherwise.
+*/
+func (repository *ProductRepository) versionChecked(ctx context.Context, tx *sql.Tx, result sql.Result, table string, id int) error {
+	changed, err := result.RowsAffected()
+	if err != nil || changed > 0 {
+		return err
+	}
+	exists := `SELECT count(*) FROM ` + table + ` WHERE id = ?`
+	if table == "products" {
+		exists += ` AND deleted_at IS NULL`
+	}
+	var rows int
+	err = tx.QueryRowContext(ctx, repository.dialect.rebind(exists+`;`), id).Scan(&rows)
 	if err != nil {
-		log.Fatalf("DB Commit error %v", err.Error())
+		return err
 	}
-	return err
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return ErrVersionMismatch
 }
 
-func (repository *ProductRepository) listProducts() []*Product {
-	rows, _ := repository.database.Query(`SELECT id, name, description, price FROM products;`)
+func (repository *ProductRepository) listProducts(ctx context.Context) ([]*Product, error) {
+	defer observeQuery(ctx, "listProducts", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT id, name, description, price, category FROM products WHERE deleted_at IS NULL ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	products := []*Product{}
@@ -333,12 +737,12 @@ func (repository *ProductRepository) listProducts() []*Product {
 			name        string
 			description string
 			price       string
+			category    string
 		)
 
-		err := rows.Scan(&id, &name, &description, &price)
+		err := rows.Scan(&id, &name, &description, &price, &category)
 		if err != nil {
-
-			log.Fatalf("Error during scanning rows %v", err.Error())
+			return nil, err
 		}
 
 		products = append(products, &Product{
@@ -346,25 +750,60 @@ func (repository *ProductRepository) listProducts() []*Product {
 			Name:        name,
 			Description: description,
 			Price:       price,
+			Category:    category,
 		})
 	}
 
-	return products
+	return products, rows.Err()
 }
 
-func (repository *ProductRepository) getProduct(product Product) (Product, error) {
-	row := repository.database.QueryRow(`SELECT id, name, description, price FROM products WHERE id = ?;`, product.ID)
+/*
+   Calls fn with every product, in order, as they're read from the database,
+   so the catalog never has to fit in memory. fn stops it by returning an
+   error. The query, and what it observes, lasts until fn has seen them all.
+*/
+func (repository *ProductRepository) eachProduct(ctx context.Context, fn func(product Product) error) error {
+	defer observeQuery(ctx, "eachProduct", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT id, name, description, price, category FROM products WHERE deleted_at IS NULL ORDER BY id;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		// a cancelled export lets go of the cursor at the next row, rather than reading the rest of the catalog
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var product Product
+		if err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category); err != nil {
+			return err
+		}
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (repository *ProductRepository) getProduct(ctx context.Context, product Product) (Product, error) {
+	defer observeQuery(ctx, "getProduct", time.Now())
+	row := repository.queryRowContext(ctx, `SELECT id, name, description, price, category FROM products WHERE id = ? AND deleted_at IS NULL;`, product.ID)
 
 	var (
 		id          int
 		name        string
 		description string
 		price       string
+		category    string
 	)
 
-	err := row.Scan(&id, &name, &description, &price)
+	err := row.Scan(&id, &name, &description, &price, &category)
+	if err == sql.ErrNoRows {
+		return Product{}, nil
+	}
 	if err != nil {
-		log.Fatalf("Query error %v", err.Error())
+		return Product{}, err
 	}
 
 	product = Product{
@@ -372,7 +811,95 @@ func (repository *ProductRepository) getProduct(product Product) (Product, error
 		Name:        name,
 		Description: description,
 		Price:       price,
+		Category:    category,
 	}
 
-	return product, err
+	return product, nil
+}
+
+// getVersionedProduct returns the product and its version, an empty product and 0 when it doesn't exist or is deleted
+func (repository *ProductRepository) getVersionedProduct(ctx context.Context, productID int) (Product, int, error) {
+	defer observeQuery(ctx, "getVersionedProduct", time.Now())
+	var (
+		product Product
+		version int
+	)
+	err := repository.queryRowContext(ctx, `SELECT id, name, description, price, category, version FROM products WHERE id = ? AND deleted_at IS NULL;`, productID).
+		Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.Category, &version)
+	if err == sql.ErrNoRows {
+		return Product{}, 0, nil
+	}
+	if err != nil {
+		return Product{}, 0, err
+	}
+	return product, version, nil
+}
+
+/* Audit Log */
+func (repository *ProductRepository) insertAuditEntry(ctx context.Context, entry AuditEntry) error {
+	defer observeQuery(ctx, "insertAuditEntry", time.Now())
+	_, err := repository.execContext(ctx, `INSERT INTO audit_log (entity, entity_id, action, user_id, api_key_id, request_id, before_state, after_state, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		entry.Entity, entry.EntityID, entry.Action,
+		sql.NullInt64{Int64: int64(entry.UserID), Valid: entry.UserID != 0},
+		sql.NullInt64{Int64: int64(entry.APIKeyID), Valid: entry.APIKeyID != 0},
+		entry.RequestID,
+		sql.NullString{String: string(entry.Before), Valid: entry.Before != nil},
+		sql.NullString{String: string(entry.After), Valid: entry.After != nil},
+		entry.CreatedAt)
+	return err
+}
+
+/* The changes to one entity, oldest first. An entityID of 0 lists the changes to all of them. */
+func (repository *ProductRepository) listAuditEntries(ctx context.Context, entity string, entityID int) ([]*AuditEntry, error) {
+	defer observeQuery(ctx, "listAuditEntries", time.Now())
+	rows, err := repository.queryContext(ctx, `SELECT id, entity, entity_id, action, user_id, api_key_id, request_id, before_state, after_state, created_at
+		FROM audit_log WHERE entity = ? AND (entity_id = ? OR ? = 0) ORDER BY id;`, entity, entityID, entityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var (
+			entry         AuditEntry
+			userID        sql.NullInt64
+			apiKeyID      sql.NullInt64
+			before, after sql.NullString
+		)
+		err := rows.Scan(&entry.ID, &entry.Entity, &entry.EntityID, &entry.Action, &userID, &apiKeyID, &entry.RequestID, &before, &after, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.UserID, entry.APIKeyID = int(userID.Int64), int(apiKeyID.Int64)
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// exec runs a single statement in its own transaction
+func (repository *ProductRepository) exec(ctx context.Context, query string, args ...interface{}) error {
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, repository.dialect.rebind(query), args...)
+		return err
+	})
+}
+
+// placeholders is the ?, ?, ? for an IN list of n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func intArgs(values []int) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+/*
+   The repository runs on SQLite or PostgreSQL. Queries are written once with
+   ? placeholders and go through queryContext, queryRowContext, execContext or
+   transaction, which hand them to the dialect to rewrite for its driver.
+   What can't be shared, the tables, migrations and how the schema version is
+   kept, each dialect has its own of.
+*/
+type dialect interface {
+	// rebind rewrites the ? placeholders in query into the driver's own
+	rebind(query string) string
+	// table is the CREATE TABLE statement for one of the store's tables
+	table(name string) string
+	migrations() []migration
+	schemaVersion(ctx context.Context, database *sql.DB) (int, error)
+	setSchemaVersion(ctx context.Context, database *sql.DB, version int) error
+	hasColumn(ctx context.Context, database *sql.DB, table string, column string) (bool, error)
+	// retryable is true for errors a transaction can safely be run again after
+	retryable(err error) bool
+	// advanceSequence moves the table's ids on past the ones rows were inserted with
+	advanceSequence(ctx context.Context, database querier, table string) error
+}
+
+// dialects by the driver name the config uses
+var dialects = map[string]dialect{
+	DriverSQLite:   sqliteDialect{},
+	DriverPostgres: postgresDialect{},
+}
+
+// how many times a transaction is attempted when it keeps failing with retryable errors
+const transactionAttempts = 3
+
+/*
+   Where a query runs: the transaction atomically started for ctx when there
+   is one, the database otherwise.
+*/
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type transactionContextKey struct{}
+
+func (repository *ProductRepository) querier(ctx context.Context) querier {
+	if tx, ok := ctx.Value(transactionContextKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return repository.database
+}
+
+func (repository *ProductRepository) queryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return repository.querier(ctx).QueryContext(ctx, repository.dialect.rebind(query), args...)
+}
+
+func (repository *ProductRepository) queryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return repository.querier(ctx).QueryRowContext(ctx, repository.dialect.rebind(query), args...)
+}
+
+func (repository *ProductRepository) execContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return repository.querier(ctx).ExecContext(ctx, repository.dialect.rebind(query), args...)
+}
+
+/*
+   Runs fn in a transaction, committing when it returns nil and rolling back
+   otherwise. Statements fn runs on tx have to be rebound themselves. When
+   the database gives up on the transaction because of a conflict with
+   another one, it's run again from the start. Inside atomically it's part
+   of the transaction already started.
+*/
+func (repository *ProductRepository) transaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if tx, ok := ctx.Value(transactionContextKey{}).(*sql.Tx); ok {
+		return fn(tx)
+	}
+
+	var err error
+	for attempt := 0; attempt < transactionAttempts; attempt++ {
+		err = repository.attempt(ctx, fn)
+		if err == nil || !repository.dialect.retryable(err) {
+			return err
+		}
+		logger.Warn(ctx, "retrying transaction", "attempt", attempt+1, "error", err)
+	}
+	return err
+}
+
+func (repository *ProductRepository) attempt(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := repository.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+   Runs every repository call fn makes with ctx in one transaction, for
+   changes made up of more than one of them, like a write and its entry in
+   the audit log.
+*/
+func (repository *ProductRepository) atomically(ctx context.Context, fn func(ctx context.Context) error) error {
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		return fn(context.WithValue(ctx, transactionContextKey{}, tx))
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/shopspring/decimal"
+)
+
+/*
+   Exports of the catalog for product feeds, in CSV, JSON Lines or the RSS
+   flavour of XML that Google Merchant Center reads. Products are streamed
+   from the database to the response one at a time, only the deals and
+   offerings they're priced with are held in memory.
+*/
+
+// where the feed is served, it runs under the export timeout rather than the request timeout
+const exportPath = "/export/products"
+
+// prices in the XML feed carry a currency, the store only sells in dollars
+const feedCurrency = "USD"
+
+/*
+   Calls fn with every product in the catalog and what one unit of it costs
+   right now, priced by its active offerings the way a cart with only that
+   product in it would be. Cart-level promotions depend on the rest of the
+   cart, so they're left out.
+*/
+func (service *ProductService) exportProducts(ctx context.Context, fn func(product ExportedProduct) error) error {
+	ctx, span := startSpan(ctx, "exportProducts")
+	defer span.End()
+	if !service.enabled(ctx, FlagCatalogReads) {
+		return nil
+	}
+
+	pricing, err := service.cachedPricing(ctx)
+	if err != nil {
+		return err
+	}
+	bundles := service.enabled(ctx, FlagDealsBundles)
+
+	return service.repository.eachProduct(ctx, func(product Product) error {
+		exported, err := exportedProduct(ctx, pricing, product, bundles)
+		if err != nil {
+			return err
+		}
+		return fn(exported)
+	})
+}
+
+// exportedProduct prices one unit of the product, like a cart with only the product in it
+func exportedProduct(ctx context.Context, pricing *catalogSnapshot, product Product, bundles bool) (ExportedProduct, error) {
+	items := []Item{{product, 1}}
+	snapshot := pricing.withItems(items)
+	productOfferings := snapshot.productOfferings(items)
+	if !bundles {
+		productOfferings = withoutBundles(productOfferings)
+	}
+
+	exported := ExportedProduct{
+		ID:           product.ID,
+		Name:         product.Name,
+		Description:  product.Description,
+		Category:     product.Category,
+		ListPrice:    money(product.Price),
+		Price:        money(product.Price),
+		Availability: OutOfStock,
+	}
+	if len(productOfferings) == 0 {
+		return exported, nil
+	}
+	total, _, _, err := price(ctx, snapshot, productOfferings, nil)
+	if err != nil {
+		return ExportedProduct{}, err
+	}
+	exported.Price = money(total)
+	exported.Availability = InStock
+	return exported, nil
+}
+
+// money has the two decimal places feeds expect, a price that isn't a number is left as it is
+func money(value string) string {
+	amount, err := decimal.NewFromString(value)
+	if err != nil {
+		return value
+	}
+	return amount.StringFixed(2)
+}
+
+/* Writes a feed one product at a time */
+type feedWriter interface {
+	write(product ExportedProduct) error
+	// close finishes the feed off, after the last product
+	close() error
+}
+
+func newFeedWriter(format string, out io.Writer) (feedWriter, error) {
+	switch format {
+	case ExportCSV:
+		return newCSVFeed(out)
+	case ExportJSONL:
+		return &jsonlFeed{encoder: json.NewEncoder(out)}, nil
+	case ExportXML:
+		return newXMLFeed(out)
+	}
+	return nil, fmt.Errorf("format %q must be csv, jsonl or xml", format)
+}
+
+type csvFeed struct {
+	writer *csv.Writer
+}
+
+func newCSVFeed(out io.Writer) (*csvFeed, error) {
+	feed := &csvFeed{writer: csv.NewWriter(out)}
+	return feed, feed.writer.Write([]string{"id", "name", "description", "category", "list_price", "price", "availability"})
+}
+
+func (feed *csvFeed) write(product ExportedProduct) error {
+	return feed.writer.Write([]string{
+		strconv.Itoa(product.ID),
+		product.Name,
+		product.Description,
+		product.Category,
+		product.ListPrice,
+		product.Price,
+		product.Availability,
+	})
+}
+
+func (feed *csvFeed) close() error {
+	feed.writer.Flush()
+	return feed.writer.Error()
+}
+
+type jsonlFeed struct {
+	encoder *json.Encoder
+}
+
+func (feed *jsonlFeed) write(product ExportedProduct) error {
+	return feed.encoder.Encode(product)
+}
+
+func (feed *jsonlFeed) close() error {
+	return nil
+}
+
+/*
+   An item of the XML feed. g:price is what the product costs before its
+   offerings, g:sale_price what it costs after them, when that's different.
+*/
+type feedItem struct {
+	XMLName      xml.Name `xml:"item"`
+	ID           int      `xml:"g:id"`
+	Title        string   `xml:"g:title"`
+	Description  string   `xml:"g:description,omitempty"`
+	ProductType  string   `xml:"g:product_type,omitempty"`
+	Price        string   `xml:"g:price"`
+	SalePrice    string   `xml:"g:sale_price,omitempty"`
+	Availability string   `xml:"g:availability"`
+}
+
+type xmlFeed struct {
+	out     io.Writer
+	encoder *xml.Encoder
+}
+
+func newXMLFeed(out io.Writer) (*xmlFeed, error) {
+	// the items are encoded one at a time, so the document around them is written by hand
+	_, err := io.WriteString(out, xml.Header+`<rss version="2.0" xmlns:g="http://base.google.com/ns/1.0"><channel><title>Electronics Store</title><description>Every product in the catalog</description>`)
+	return &xmlFeed{out: out, encoder: xml.NewEncoder(out)}, err
+}
+
+func (feed *xmlFeed) write(product ExportedProduct) error {
+	item := feedItem{
+		ID:           product.ID,
+		Title:        product.Name,
+		Description:  product.Description,
+		ProductType:  product.Category,
+		Price:        product.ListPrice + " " + feedCurrency,
+		Availability: product.Availability,
+	}
+	if product.Price != product.ListPrice {
+		item.SalePrice = product.Price + " " + feedCurrency
+	}
+	return feed.encoder.Encode(item)
+}
+
+func (feed *xmlFeed) close() error {
+	if err := feed.encoder.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(feed.out, "</channel></rss>\n")
+	return err
+}
+
+// sentWriter notes once anything has been sent, after that an error can only cut the response short
+type sentWriter struct {
+	http.ResponseWriter
+	sent bool
+}
+
+func (writer *sentWriter) Write(bytes []byte) (int, error) {
+	writer.sent = true
+	return writer.ResponseWriter.Write(bytes)
+}
+
+func (writer *sentWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
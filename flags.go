@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+   Named feature flags, each service method checks the flag for the feature
+   it belongs to. A flag can be rolled out to a percentage of sessions, the
+   same session always lands in the same bucket so it doesn't flip between
+   requests. A rollout of 100 means everyone and 0 nobody, a flag that leaves
+   its rollout out is rolled out to everyone.
+*/
+
+const (
+	FlagCatalogReads    = "catalog.reads"
+	FlagCatalogWrites   = "catalog.writes"
+	FlagDealsBundles    = "deals.bundles"
+	FlagCheckout        = "checkout"
+	FlagPricingSimulate = "pricing.simulate"
+)
+
+var (
+	ErrFeatureDisabled = errors.New("feature disabled")
+	ErrUnknownFlag     = errors.New("no such feature flag")
+	ErrInvalidFlag     = errors.New("invalid feature flag")
+)
+
+type FeatureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Rollout int    `json:"rollout"`
+}
+
+// fullRollout is the rollout of a flag that doesn't set one
+const fullRollout = 100
+
+func defaultFlags() []FeatureFlag {
+	return []FeatureFlag{
+		{Name: FlagCatalogReads, Enabled: true, Rollout: fullRollout},
+		{Name: FlagCatalogWrites, Enabled: true, Rollout: fullRollout},
+		{Name: FlagDealsBundles, Enabled: true, Rollout: fullRollout},
+		{Name: FlagCheckout, Enabled: true, Rollout: fullRollout},
+		{Name: FlagPricingSimulate, Enabled: true, Rollout: fullRollout},
+	}
+}
+
+// UnmarshalJSON rolls a flag without a rollout out to everyone, rather than to nobody
+func (flag *FeatureFlag) UnmarshalJSON(data []byte) error {
+	type plain FeatureFlag
+	decoded := plain{Rollout: fullRollout}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*flag = FeatureFlag(decoded)
+	return nil
+}
+
+// UnmarshalYAML does the same for config files, see UnmarshalJSON
+func (flag *FeatureFlag) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain FeatureFlag
+	decoded := plain{Rollout: fullRollout}
+	if err := unmarshal(&decoded); err != nil {
+		return err
+	}
+	*flag = FeatureFlag(decoded)
+	return nil
+}
+
+/*
+   Applies settings like "checkout=off,deals.bundles=25" to the flags, from
+   STORE_FLAGS or -flags. A setting is name=on, name=off or name=<percent>.
+*/
+func parseFlagSettings(flags []FeatureFlag, settings string) ([]FeatureFlag, error) {
+	if settings == "" {
+		return flags, nil
+	}
+
+	var overrides []FeatureFlag
+	for _, setting := range strings.Split(settings, ",") {
+		parts := strings.SplitN(strings.TrimSpace(setting), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: %q should look like name=on", ErrInvalidFlag, setting)
+		}
+		switch parts[1] {
+		case "on":
+			overrides = append(overrides, FeatureFlag{Name: parts[0], Enabled: true, Rollout: fullRollout})
+		case "off":
+			overrides = append(overrides, FeatureFlag{Name: parts[0], Rollout: fullRollout})
+		default:
+			rollout, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q should be on, off or a percent", ErrInvalidFlag, setting)
+			}
+			overrides = append(overrides, FeatureFlag{Name: parts[0], Enabled: true, Rollout: rollout})
+		}
+	}
+	return mergeFlags(flags, overrides)
+}
+
+// mergeFlags replaces flags by name, every override has to be a flag that already exists
+func mergeFlags(flags []FeatureFlag, overrides []FeatureFlag) ([]FeatureFlag, error) {
+	merged := make([]FeatureFlag, len(flags))
+	copy(merged, flags)
+
+	byName := make(map[string]int)
+	for i, flag := range merged {
+		byName[flag.Name] = i
+	}
+	for _, override := range overrides {
+		i, ok := byName[override.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownFlag, override.Name)
+		}
+		if err := override.validate(); err != nil {
+			return nil, err
+		}
+		merged[i] = override
+	}
+	return merged, nil
+}
+
+func (flag FeatureFlag) validate() error {
+	if flag.Rollout < 0 || flag.Rollout > fullRollout {
+		return fmt.Errorf("%w: rollout for %s must be a percent between 0 and 100", ErrInvalidFlag, flag.Name)
+	}
+	return nil
+}
+
+// on reports whether the flag is on for whoever is identified by the key
+func (flag FeatureFlag) on(key string) bool {
+	if !flag.Enabled {
+		return false
+	}
+	if flag.Rollout == fullRollout {
+		return true
+	}
+	// buckets are 0 to 99, so a rollout of 0 has none of them
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(flag.Name + ":" + key))
+	return int(hash.Sum32()%100) < flag.Rollout
+}
+
+/* The flags the server is running with, they can be changed while it runs */
+type FeatureFlags struct {
+	mutex sync.RWMutex
+	flags map[string]FeatureFlag
+}
+
+func NewFeatureFlags(flags []FeatureFlag) *FeatureFlags {
+	featureFlags := &FeatureFlags{flags: make(map[string]FeatureFlag)}
+	for _, flag := range flags {
+		featureFlags.flags[flag.Name] = flag
+	}
+	return featureFlags
+}
+
+// enabled is false for flags that were never configured
+func (featureFlags *FeatureFlags) enabled(name string, key string) bool {
+	featureFlags.mutex.RLock()
+	defer featureFlags.mutex.RUnlock()
+	flag, ok := featureFlags.flags[name]
+	return ok && flag.on(key)
+}
+
+func (featureFlags *FeatureFlags) list() []FeatureFlag {
+	featureFlags.mutex.RLock()
+	defer featureFlags.mutex.RUnlock()
+	flags := make([]FeatureFlag, 0, len(featureFlags.flags))
+	for _, flag := range featureFlags.flags {
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// set changes a flag that's already configured, new flags only come from config
+func (featureFlags *FeatureFlags) set(flag FeatureFlag) error {
+	if err := flag.validate(); err != nil {
+		return err
+	}
+	featureFlags.mutex.Lock()
+	defer featureFlags.mutex.Unlock()
+	if _, ok := featureFlags.flags[flag.Name]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownFlag, flag.Name)
+	}
+	featureFlags.flags[flag.Name] = flag
+	return nil
+}
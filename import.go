@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+/*
+   Bulk imports of the catalog from a CSV or JSON Lines file that mixes
+   products, deals and offerings. A CSV file starts with a header naming its
+   columns by the JSON names of ImportRow, in any order and leaving out the
+   ones it doesn't need, a Tiered deal's tiers go in the tiers column as a
+   JSON array. Every line of a JSON Lines file is a row as a JSON object.
+*/
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// returned from a dry run's transaction so it's rolled back
+var errDryRun = errors.New("dry run")
+
+// the CSV columns an import understands
+var importColumns = map[string]bool{
+	"kind": true, "id": true, "name": true, "description": true, "price": true, "category": true,
+	"type": true, "coupon": true, "percent": true, "x": true, "y": true, "exclusive": true,
+	"threshold": true, "min_quantity": true, "tiers": true,
+	"product_id": true, "deal_id": true, "modified_price": true, "active": true,
+}
+
+// a reason a row can't be imported, as opposed to the import failing
+type rowError struct {
+	reason string
+}
+
+func (err rowError) Error() string {
+	return err.reason
+}
+
+/*
+   Imports a file of the catalog in one transaction, nothing is written
+   unless every row can be. A row with an id is the product, deal or offering
+   with that id: it's updated when the catalog has it and added with the id
+   when it doesn't, so importing a file again doesn't add it twice. A row
+   without an id is always added, with a new id. Products and deals are
+   imported before offerings, so an offering's product_id and deal_id can
+   refer to rows anywhere in the file as well as to the catalog. A dry run
+   imports and rolls back, so it finds the same problems a real import would.
+   Problems with rows come back in the report along with ErrInvalidImport.
+*/
+func (service *ProductService) importCatalog(ctx context.Context, file io.Reader, format string, dryRun bool) (ImportReport, error) {
+	ctx, span := startSpan(ctx, "importCatalog")
+	defer span.End()
+	if !service.enabled(ctx, FlagCatalogWrites) {
+		return ImportReport{}, ErrFeatureDisabled
+	}
+
+	rows, problems, err := parseImport(file, format)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report := ImportReport{DryRun: dryRun, Rows: len(rows) + len(problems), Errors: problems}
+
+	bundles := service.enabled(ctx, FlagDealsBundles)
+	named := map[string]map[int]bool{AuditProduct: {}, AuditDeal: {}, AuditOffering: {}}
+	for _, row := range rows {
+		err := row.validate(bundles)
+		if err == nil && row.ID != 0 {
+			if named[row.Kind][row.ID] {
+				err = fmt.Errorf("more than one %s has the id %d", row.Kind, row.ID)
+			}
+			named[row.Kind][row.ID] = true
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, ImportError{row.Line, err.Error()})
+		}
+	}
+	if len(report.Errors) > 0 {
+		sortImportErrors(report.Errors)
+		return report, ErrInvalidImport
+	}
+
+	ordered := make([]ImportRow, 0, len(rows))
+	for _, kind := range []string{AuditProduct, AuditDeal, AuditOffering} {
+		for _, row := range rows {
+			if row.Kind == kind {
+				ordered = append(ordered, row)
+			}
+		}
+	}
+
+	err = service.repository.atomically(ctx, func(ctx context.Context) error {
+		// a transaction that's retried starts over
+		report.Products, report.Deals, report.Offerings, report.Errors = 0, 0, 0, nil
+		for _, row := range ordered {
+			err := service.importRow(ctx, row)
+			var problem rowError
+			if errors.As(err, &problem) {
+				report.Errors = append(report.Errors, ImportError{row.Line, problem.Error()})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			switch row.Kind {
+			case AuditProduct:
+				report.Products++
+			case AuditDeal:
+				report.Deals++
+			case AuditOffering:
+				report.Offerings++
+			}
+		}
+
+		switch {
+		case len(report.Errors) > 0:
+			return ErrInvalidImport
+		case dryRun:
+			return errDryRun
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrInvalidImport):
+		sortImportErrors(report.Errors)
+		return report, err
+	case errors.Is(err, errDryRun):
+		return report, nil
+	case err != nil:
+		return ImportReport{}, err
+	}
+
+	service.cache.invalidate()
+	logger.Info(ctx, "catalog imported", "products", report.Products, "deals", report.Deals, "offerings", report.Offerings)
+	return report, nil
+}
+
+// importRow saves a row, adding it or updating the one with its id
+func (service *ProductService) importRow(ctx context.Context, row ImportRow) error {
+	switch row.Kind {
+	case AuditProduct:
+		return service.importProduct(ctx, row.product())
+	case AuditDeal:
+		return service.importDeal(ctx, row.deal())
+	}
+
+	offering := row.offering()
+	if err := service.importReference(ctx, AuditProduct, offering.ProductID); err != nil {
+		return err
+	}
+	if err := service.importReference(ctx, AuditDeal, offering.DealID); err != nil {
+		return err
+	}
+	return service.importOffering(ctx, offering)
+}
+
+func (service *ProductService) importProduct(ctx context.Context, product Product) error {
+	if product.ID == 0 {
+		return service.audited(ctx, AuditProduct, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			var err error
+			product.ID, err = service.repository.insertProduct(ctx, product)
+			return product.ID, nil, product, err
+		})
+	}
+
+	before, _, err := service.repository.getVersionedProduct(ctx, product.ID)
+	if err != nil {
+		return err
+	}
+	if before.ID != 0 {
+		return service.audited(ctx, AuditProduct, AuditUpdate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			return product.ID, before, product, service.repository.updateProduct(ctx, product, anyVersion)
+		})
+	}
+	return service.audited(ctx, AuditProduct, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+		inserted, err := service.repository.insertProductWithID(ctx, product)
+		if err == nil && !inserted {
+			err = rowError{fmt.Sprintf("product %d has been deleted", product.ID)}
+		}
+		return product.ID, nil, product, err
+	})
+}
+
+func (service *ProductService) importDeal(ctx context.Context, deal Deal) error {
+	if deal.ID == 0 {
+		return service.audited(ctx, AuditDeal, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			var err error
+			deal.ID, err = service.repository.insertDeal(ctx, deal)
+			return deal.ID, nil, deal, err
+		})
+	}
+
+	before, _, err := service.repository.getDeal(ctx, deal.ID)
+	if err != nil {
+		return err
+	}
+	if before.ID != 0 {
+		return service.audited(ctx, AuditDeal, AuditUpdate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			return deal.ID, before, deal, service.repository.updateDeal(ctx, deal, anyVersion)
+		})
+	}
+	return service.audited(ctx, AuditDeal, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+		return deal.ID, nil, deal, service.repository.insertDealWithID(ctx, deal)
+	})
+}
+
+func (service *ProductService) importOffering(ctx context.Context, offering Offering) error {
+	if offering.ID == 0 {
+		return service.audited(ctx, AuditOffering, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			var err error
+			offering.ID, err = service.repository.insertOffering(ctx, offering)
+			return offering.ID, nil, offering, err
+		})
+	}
+
+	before, _, err := service.repository.getOffering(ctx, offering.ID)
+	if err != nil {
+		return err
+	}
+	if before.ID != 0 {
+		return service.audited(ctx, AuditOffering, AuditUpdate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			return offering.ID, before, offering, service.repository.updateOffering(ctx, offering, anyVersion)
+		})
+	}
+	return service.audited(ctx, AuditOffering, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+		return offering.ID, nil, offering, service.repository.insertOfferingWithID(ctx, offering)
+	})
+}
+
+// importReference checks the product or deal an offering refers to is in the catalog, imported rows included
+func (service *ProductService) importReference(ctx context.Context, kind string, id int) error {
+	var found int
+	switch kind {
+	case AuditProduct:
+		product, _, err := service.repository.getVersionedProduct(ctx, id)
+		if err != nil {
+			return err
+		}
+		found = product.ID
+	case AuditDeal:
+		deal, _, err := service.repository.getDeal(ctx, id)
+		if err != nil {
+			return err
+		}
+		found = deal.ID
+	}
+	if found == 0 {
+		return rowError{fmt.Sprintf("%s %d isn't in the file or the catalog", kind, id)}
+	}
+	return nil
+}
+
+func sortImportErrors(problems []ImportError) {
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+}
+
+// validate checks a row on its own, what an offering refers to is checked as it's imported
+func (row ImportRow) validate(bundles bool) error {
+	if row.ID < 0 {
+		return errors.New("id can't be negative")
+	}
+
+	switch row.Kind {
+	case AuditProduct:
+		if row.Name == "" {
+			return errors.New("a product needs a name")
+		}
+		return validatePrice("price", row.Price)
+
+	case AuditDeal:
+		if row.Type == Bundle && !bundles {
+			return errors.New("bundle deals are turned off")
+		}
+		return validateDeal(row.deal())
+
+	case AuditOffering:
+		if row.ProductID < 1 || row.DealID < 1 {
+			return errors.New("an offering needs a product_id and a deal_id")
+		}
+		if row.ModifiedPrice != "" {
+			return validatePrice("modified_price", row.ModifiedPrice)
+		}
+		return nil
+	}
+	return fmt.Errorf("kind %q must be product, deal or offering", row.Kind)
+}
+
+// prices are stored as text, so nothing but this stops one that isn't a number
+func validatePrice(field string, value string) error {
+	price, err := decimal.NewFromString(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a number", field, value)
+	}
+	if price.IsNegative() {
+		return fmt.Errorf("%s can't be negative", field)
+	}
+	return nil
+}
+
+func (row ImportRow) product() Product {
+	return Product{ID: row.ID, Name: row.Name, Description: row.Description, Price: row.Price, Category: row.Category}
+}
+
+// a deal is exclusive and active unless the row says otherwise, like the columns' defaults
+func (row ImportRow) deal() Deal {
+	deal := Deal{
+		ID:          row.ID,
+		Name:        row.Name,
+		Type:        row.Type,
+		Coupon:      row.Coupon,
+		Percent:     row.Percent,
+		X:           row.X,
+		Y:           row.Y,
+		Exclusive:   row.Exclusive == nil || *row.Exclusive,
+		Threshold:   row.Threshold,
+		MinQuantity: row.MinQuantity,
+		Tiers:       row.Tiers,
+		Category:    row.Category,
+	}
+	if row.Active != nil {
+		deal.Active = dealActive(*row.Active)
+	}
+	return deal
+}
+
+// an offering is active unless the row says otherwise
+func (row ImportRow) offering() Offering {
+	return Offering{ID: row.ID, ProductID: row.ProductID, DealID: row.DealID, ModifiedPrice: row.ModifiedPrice, Active: row.Active == nil || *row.Active}
+}
+
+/*
+   Reads every row of the file. Rows that can't be read are reported as
+   problems and the rest are kept, so they can all be reported at once.
+   A file that can't be read at all, like a CSV file with a column nobody
+   knows, is ErrInvalidImport.
+*/
+func parseImport(file io.Reader, format string) ([]ImportRow, []ImportError, error) {
+	switch format {
+	case ImportCSV:
+		return parseImportCSV(file)
+	case ImportJSONL:
+		return parseImportJSONL(file)
+	}
+	return nil, nil, fmt.Errorf("%w: format %q must be csv or jsonl", ErrInvalidImport, format)
+}
+
+func parseImportCSV(file io.Reader) ([]ImportRow, []ImportError, error) {
+	records := csv.NewReader(file)
+	// a row only fills in the columns it needs
+	records.FieldsPerRecord = -1
+
+	header, err := records.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		if !importColumns[header[i]] {
+			return nil, nil, fmt.Errorf("%w: unknown column %q", ErrInvalidImport, header[i])
+		}
+	}
+
+	var (
+		rows     []ImportRow
+		problems []ImportError
+	)
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if errors.As(err, &parseErr) {
+			problems = append(problems, ImportError{parseErr.StartLine, parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := records.FieldPos(0)
+		if len(record) > len(header) {
+			problems = append(problems, ImportError{line, fmt.Sprintf("has %d fields but the header only names %d", len(record), len(header))})
+			continue
+		}
+		row := ImportRow{Line: line}
+		for i, value := range record {
+			if err = row.set(header[i], value); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			problems = append(problems, ImportError{line, err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, problems, nil
+}
+
+// set fills in the row's field for a CSV column, empty values leave it as it is
+func (row *ImportRow) set(column string, value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	var err error
+	switch column {
+	case "kind":
+		row.Kind = value
+	case "id":
+		row.ID, err = strconv.Atoi(value)
+	case "name":
+		row.Name = value
+	case "description":
+		row.Description = value
+	case "price":
+		row.Price = value
+	case "category":
+		row.Category = value
+	case "type":
+		row.Type = DealType(value)
+	case "coupon":
+		row.Coupon = value
+	case "percent":
+		row.Percent = value
+	case "x":
+		row.X, err = strconv.Atoi(value)
+	case "y":
+		row.Y, err = strconv.Atoi(value)
+	case "exclusive":
+		row.Exclusive, err = parseOptionalBool(value)
+	case "threshold":
+		row.Threshold = value
+	case "min_quantity":
+		row.MinQuantity, err = strconv.Atoi(value)
+	case "tiers":
+		err = json.Unmarshal([]byte(value), &row.Tiers)
+	case "product_id":
+		row.ProductID, err = strconv.Atoi(value)
+	case "deal_id":
+		row.DealID, err = strconv.Atoi(value)
+	case "modified_price":
+		row.ModifiedPrice = value
+	case "active":
+		row.Active, err = parseOptionalBool(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %q isn't valid", column, value)
+	}
+	return nil
+}
+
+// a flag a row leaves empty is left unset, so it gets its default
+func parseOptionalBool(value string) (*bool, error) {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func parseImportJSONL(file io.Reader) ([]ImportRow, []ImportError, error) {
+	lines := bufio.NewScanner(file)
+	// a deal with a lot of tiers makes for a long line
+	lines.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var (
+		rows     []ImportRow
+		problems []ImportError
+	)
+	line := 0
+	for lines.Scan() {
+		line++
+		text := bytes.TrimSpace(lines.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		row := ImportRow{}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&row); err != nil {
+			problems = append(problems, ImportError{line, err.Error()})
+			continue
+		}
+		row.Line = line
+		rows = append(rows, row)
+	}
+	if errors.Is(lines.Err(), bufio.ErrTooLong) {
+		return nil, nil, fmt.Errorf("%w: line %d is longer than 1MB", ErrInvalidImport, line+1)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rows, problems, nil
+}
+
+// importFormat guesses the format of a file from its extension
+func importFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ImportCSV
+	case ".jsonl", ".ndjson":
+		return ImportJSONL
+	}
+	return ""
+}
+
+/*
+   store import [-dry-run] [-format csv|jsonl] [server flags] file imports
+   a file straight into the database the config points at, migrating it
+   first, and prints the report as JSON. The format comes from the file's
+   extension unless it's given.
+*/
+func importCommand(args []string, out io.Writer) error {
+	commandLine := flag.NewFlagSet("store import", flag.ContinueOnError)
+	dryRun := commandLine.Bool("dry-run", false, "check the file and report what it would import, without importing it")
+	format := commandLine.String("format", "", "csv or jsonl, by default from the file's extension")
+	config, err := loadConfig(commandLine, args)
+	if err != nil {
+		return err
+	}
+	if commandLine.NArg() != 1 {
+		return errors.New("usage: store import [-dry-run] [-format csv|jsonl] [flags] file")
+	}
+	path := commandLine.Arg(0)
+	if *format == "" {
+		*format = importFormat(path)
+	}
+	logger = NewLogger(os.Stderr, config.LogLevel)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	db, err := ConnectDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	productRepository := NewProductRepository(db, config.Database.Driver)
+	if err := productRepository.migrate(ctx); err != nil {
+		return err
+	}
+
+	report, err := NewProductService(config, productRepository).importCatalog(ctx, file, *format, *dryRun)
+	if err != nil && len(report.Errors) == 0 {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(report); encodeErr != nil {
+		return encodeErr
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+   Structured logging, every line is a JSON object. Anything logged with a
+   request's context carries the request's id, so a request can be followed
+   from the handler down to the queries it ran.
+*/
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+type Logger struct {
+	mutex sync.Mutex
+	out   io.Writer
+	level int
+}
+
+// level is one of debug, info, warn or error, the config validates it
+func NewLogger(out io.Writer, level string) *Logger {
+	return &Logger{out: out, level: logLevels[level]}
+}
+
+// the server's logger, main replaces it once the config is loaded
+var logger = NewLogger(os.Stderr, "info")
+
+func (logger *Logger) Debug(ctx context.Context, msg string, fields ...interface{}) {
+	logger.log(ctx, "debug", msg, fields)
+}
+
+func (logger *Logger) Info(ctx context.Context, msg string, fields ...interface{}) {
+	logger.log(ctx, "info", msg, fields)
+}
+
+func (logger *Logger) Warn(ctx context.Context, msg string, fields ...interface{}) {
+	logger.log(ctx, "warn", msg, fields)
+}
+
+func (logger *Logger) Error(ctx context.Context, msg string, fields ...interface{}) {
+	logger.log(ctx, "error", msg, fields)
+}
+
+// fields are key, value pairs like "status", 200
+func (logger *Logger) log(ctx context.Context, level string, msg string, fields []interface{}) {
+	if logLevels[level] < logger.level {
+		return
+	}
+
+	line := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		line["request_id"] = requestID
+	}
+	if traceID := traceIDFromContext(ctx); traceID != "" {
+		line["trace_id"] = traceID
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if err, ok := fields[i+1].(error); ok {
+			line[key] = err.Error()
+			continue
+		}
+		line[key] = fields[i+1]
+	}
+
+	bytes, err := json.Marshal(line)
+	if err != nil {
+		bytes, _ = json.Marshal(map[string]string{"level": "error", "msg": "unable to log " + msg, "error": err.Error()})
+	}
+
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	_, _ = logger.out.Write(append(bytes, '\n'))
+}
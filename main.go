@@ -1,19 +1,133 @@
 package main
 
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// set when building a release, go build -ldflags "-X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	buildCommit = "unknown"
+	buildTime   = "unknown"
+)
+
 func main() {
-	config := NewConfig()
+	// store import loads a catalog file instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := importCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Import error %v", err)
+		}
+		return
+	}
+	// store create-admin makes the first admin of a new deployment
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		if err := createAdminCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("Create admin error %v", err)
+		}
+		return
+	}
+
+	config, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Config error %v", err)
+	}
+	logger = NewLogger(os.Stdout, config.LogLevel)
 
 	db, err := ConnectDatabase(config)
 
 	if err != nil {
-		panic(err)
+		log.Fatalf("Database error %v", err)
 	}
 
-	productRepository := NewProductRepository(db)
+	productRepository := NewProductRepository(db, config.Database.Driver)
+	if err := productRepository.migrate(context.Background()); err != nil {
+		log.Fatalf("Migration error %v", err)
+	}
+
+	stopTracing, err := startTracing(context.Background(), config.Tracing)
+	if err != nil {
+		log.Fatalf("Tracing error %v", err)
+	}
 
 	productService := NewProductService(config, productRepository)
 
 	server := NewServer(config, productService)
 
-	server.Run()
+	// SIGINT or SIGTERM lets the requests in flight finish before stopping
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info(ctx, "shutting down", "signal", sig.String())
+		stop()
+	}()
+
+	logger.Info(ctx, "listening", "port", config.Port, "tls", config.TLS())
+	err = server.Run(ctx)
+	stop()
+
+	// spans still waiting to be exported get flushed before exiting
+	flushCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration)
+	if traceErr := stopTracing(flushCtx); traceErr != nil {
+		logger.Error(ctx, "flushing spans", "error", traceErr)
+	}
+	cancel()
+
+	if closeErr := db.Close(); closeErr != nil {
+		logger.Error(ctx, "closing the database", "error", closeErr)
+	}
+	if err != nil {
+		log.Fatalf("Server error %v", err)
+	}
+}
+
+/*
+   Makes an account an admin, registering it when there isn't one. The
+   password of a new account is read from the first line of in, so it stays
+   out of the shell's history.
+*/
+func createAdminCommand(args []string, in io.Reader, out io.Writer) error {
+	commandLine := flag.NewFlagSet("store create-admin", flag.ContinueOnError)
+	config, err := loadConfig(commandLine, args)
+	if err != nil {
+		return err
+	}
+	if commandLine.NArg() != 1 {
+		return errors.New("usage: store create-admin [flags] email < password")
+	}
+	logger = NewLogger(os.Stderr, config.LogLevel)
+
+	db, err := ConnectDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	productRepository := NewProductRepository(db, config.Database.Driver)
+	if err := productRepository.migrate(ctx); err != nil {
+		return err
+	}
+
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	credentials := Credentials{Email: commandLine.Arg(0), Password: strings.TrimRight(password, "\r\n")}
+	user, err := NewProductService(config, productRepository).createAdmin(ctx, credentials)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s is an admin, account %d\n", user.Email, user.ID)
+	return err
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+   Prometheus metrics, scraped from GET /metrics. Routes are labelled with the
+   pattern they were registered under rather than the raw path, so the number
+   of series stays bounded.
+*/
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "store_http_request_duration_seconds",
+		Help:    "How long HTTP requests took to serve.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "store_db_query_duration_seconds",
+		Help:    "How long repository queries took, by repository method.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"query"})
+
+	pricingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "store_pricing_duration_seconds",
+		Help:    "How long it took to price a cart or simulation.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	})
+
+	cartOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_cart_operations_total",
+		Help: "Products added to, updated in and removed from carts.",
+	}, []string{"operation"})
+
+	dealApplications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_deal_applications_total",
+		Help: "Deals applied while pricing carts and simulations, by deal type.",
+	}, []string{"type"})
+
+	catalogCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "store_catalog_cache_requests_total",
+		Help: "Reads of the catalog cache, by what was read and whether it was a hit or a miss.",
+	}, []string{"entry", "result"})
+)
+
+// observeQuery is deferred at the top of a repository method, it times and traces the query: defer observeQuery(ctx, "listProducts", time.Now())
+func observeQuery(ctx context.Context, query string, start time.Time) {
+	elapsed := time.Since(start)
+	queryDuration.WithLabelValues(query).Observe(elapsed.Seconds())
+	traceQuery(ctx, query, start)
+	logger.Debug(ctx, "query", "query", query, "duration_ms", float64(elapsed.Microseconds())/1000)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+/* Records the status code a handler wrote */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// Unwrap lets http.ResponseController reach the connection underneath
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+/*
+   Counts and times every request. route names the pattern the request was
+   routed to, requests that don't match a route are labelled "unmatched".
+*/
+func instrument(route func(request *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request)
+
+		pattern := route(request)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		httpDuration.WithLabelValues(pattern, request.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(pattern, request.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
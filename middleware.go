@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+const (
+	userContextKey      contextKey = "user"
+	apiKeyContextKey    contextKey = "api_key"
+	sessionIDContextKey contextKey = "session_id"
+	requestContextKey   contextKey = "request"
+)
+
+/*
+   What the request log line says about a request. The middleware further
+   in fills in who made it as it works that out.
+*/
+type requestScope struct {
+	id       string
+	userID   int
+	apiKeyID int
+}
+
+// requestScopeFromContext never returns nil, outside of a request the scope just isn't logged
+func requestScopeFromContext(ctx context.Context) *requestScope {
+	if scope, ok := ctx.Value(requestContextKey).(*requestScope); ok {
+		return scope
+	}
+	return &requestScope{}
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	return requestScopeFromContext(ctx).id
+}
+
+// requests for these are only logged at debug, they're made every few seconds
+var probeRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+/*
+   Gives every request an id, the client's X-Request-ID when it sends a
+   sensible one, and logs a line for it once it's been served.
+*/
+func (server *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		scope := &requestScope{id: request.Header.Get("X-Request-ID")}
+		if !validRequestID(scope.id) {
+			id := make([]byte, 8)
+			_, _ = rand.Read(id)
+			scope.id = hex.EncodeToString(id)
+		}
+		writer.Header().Set("X-Request-ID", scope.id)
+
+		ctx := context.WithValue(request.Context(), requestContextKey, scope)
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+
+		fields := []interface{}{
+			"method", request.Method,
+			"path", request.URL.Path,
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if scope.userID != 0 {
+			fields = append(fields, "user_id", scope.userID)
+		}
+		if scope.apiKeyID != 0 {
+			fields = append(fields, "api_key_id", scope.apiKeyID)
+		}
+		if probeRoutes[request.URL.Path] {
+			logger.Debug(ctx, "request", fields...)
+			return
+		}
+		logger.Info(ctx, "request", fields...)
+	})
+}
+
+// ids from clients end up in the logs, so they have to be short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// userFromContext is the account making the request, ok is false for guests
+func userFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey).(User)
+	return user, ok
+}
+
+// apiKeyFromContext is the key the request was made with, ok is false for sessions and guests
+func apiKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(APIKey)
+	return key, ok
+}
+
+/*
+   Turns away request bodies over the configured size. Bodies that don't say
+   how big they are get cut off at the limit, so decoding them fails.
+*/
+func (server *Server) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.ContentLength > server.config.MaxBodyBytes {
+			http.Error(writer, "Request Entity Too Large", 413)
+			return
+		}
+		request.Body = http.MaxBytesReader(writer, request.Body, server.config.MaxBodyBytes)
+		next.ServeHTTP(writer, request)
+	})
+}
+
+/*
+   Gives each request a deadline, everything it does down to the queries runs
+   under it and is cancelled once the request times out. Exports stream the
+   whole catalog, they get the longer export timeout instead.
+*/
+func (server *Server) withDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		timeout := server.config.RequestTimeout.Duration
+		if request.URL.Path == exportPath {
+			timeout = server.config.ExportTimeout.Duration
+		}
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+/*
+   Machine clients send "Authorization: Bearer <key>" instead of a session
+   cookie. A request that sends a key has to send a good one, it doesn't fall
+   back to being a guest.
+*/
+func (server *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		header := request.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		secret := strings.TrimPrefix(header, "Bearer ")
+		if secret == header {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "Unauthorized", 401)
+			return
+		}
+		key, err := server.productService.authenticateAPIKey(request.Context(), secret)
+		if errors.Is(err, ErrInvalidAPIKey) {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "Unauthorized", 401)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Failed to look up api key", 500)
+			return
+		}
+
+		requestScopeFromContext(request.Context()).apiKeyID = key.ID
+		ctx := context.WithValue(request.Context(), apiKeyContextKey, key)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+/*
+   Gives every browser session a random id that stays the same across
+   logging in and out, percentage rollouts of feature flags are keyed on it.
+*/
+func (server *Server) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if _, ok := apiKeyFromContext(request.Context()); ok {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		session, _ := server.sessions.Get(request, sessionName)
+		if userID, ok := session.Values["user_id"].(int); ok {
+			requestScopeFromContext(request.Context()).userID = userID
+		}
+		sessionID, ok := session.Values["id"].(string)
+		if !ok {
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				http.Error(writer, "Failed to start a session", 500)
+				return
+			}
+			sessionID = hex.EncodeToString(id)
+			session.Values["id"] = sessionID
+			if err := session.Save(request, writer); err != nil {
+				http.Error(writer, "Failed to save session", 500)
+				return
+			}
+		}
+
+		ctx := context.WithValue(request.Context(), sessionIDContextKey, sessionID)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// rolloutKey is who a feature flag rollout is decided for, the session or the API key
+func rolloutKey(ctx context.Context) string {
+	if key, ok := apiKeyFromContext(ctx); ok {
+		return fmt.Sprintf("api-key:%d", key.ID)
+	}
+	sessionID, _ := ctx.Value(sessionIDContextKey).(string)
+	return sessionID
+}
+
+// currentUser looks up the account logged in to the request's session
+func (server *Server) currentUser(request *http.Request) (User, error) {
+	session, _ := server.sessions.Get(request, sessionName)
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		return User{}, nil
+	}
+	return server.productService.getUser(request.Context(), userID)
+}
+
+/*
+   Only lets accounts with one of the roles through. A guest gets a 401,
+   an account without the role gets a 403. API keys are never given a role.
+*/
+func (server *Server) requireRole(next http.HandlerFunc, roles ...Role) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if _, ok := apiKeyFromContext(request.Context()); ok {
+			http.Error(writer, "Forbidden", 403)
+			return
+		}
+
+		user, err := server.currentUser(request)
+		if err != nil {
+			http.Error(writer, "Failed to look up account", 500)
+			return
+		}
+		if user.ID == 0 {
+			http.Error(writer, "Unauthorized", 401)
+			return
+		}
+
+		for _, role := range roles {
+			if user.Role == role {
+				ctx := context.WithValue(request.Context(), userContextKey, user)
+				next(writer, request.WithContext(ctx))
+				return
+			}
+		}
+		http.Error(writer, "Forbidden", 403)
+	}
+}
+
+/*
+   restrictWrites leaves reading a resource open to everyone and only guards
+   the methods that change it. Requests made with an API key need the key to
+   be scoped to the resource instead.
+*/
+func (server *Server) restrictWrites(resource string, next http.HandlerFunc, roles ...Role) http.HandlerFunc {
+	guarded := server.requireRole(next, roles...)
+	return func(writer http.ResponseWriter, request *http.Request) {
+		write := true
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			write = false
+		}
+
+		if key, ok := apiKeyFromContext(request.Context()); ok {
+			if !key.allows(resource, write) {
+				http.Error(writer, "Forbidden", 403)
+				return
+			}
+			next(writer, request)
+			return
+		}
+
+		if write {
+			guarded(writer, request)
+			return
+		}
+		next(writer, request)
+	}
+}
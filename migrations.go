@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+/*
+   Schema changes are applied in order and the number applied is kept as the
+   database's schema version, see the dialects for where. A migration is only
+   ever appended, never edited, so a database's version says exactly which
+   changes it has. Both databases go through the same versions, a change is
+   appended to both lists.
+*/
+type migration func(ctx context.Context, repository *ProductRepository) error
+
+var sqliteMigrations = []migration{
+	// 1: the schema create_database.sh builds
+	sqliteBaseline,
+	// 2: versions for optimistic concurrency
+	addVersionColumns,
+	// 3: one line per product in a cart
+	mergeCartLines,
+	// 4: the audit log
+	func(ctx context.Context, repository *ProductRepository) error {
+		repository.createAuditLogTable(ctx)
+		return nil
+	},
+	// 5: products are deleted by marking them
+	func(ctx context.Context, repository *ProductRepository) error {
+		return repository.addColumn(ctx, "products", "deleted_at", "DATETIME")
+	},
+	// 6: deals can be switched off
+	func(ctx context.Context, repository *ProductRepository) error {
+		return repository.addColumn(ctx, "deals", "active", "BOOLEAN NOT NULL DEFAULT 1")
+	},
+	// 7: PostgreSQL's audit log refuses changes, SQLite's triggers always have
+	func(ctx context.Context, repository *ProductRepository) error {
+		return nil
+	},
+}
+
+var postgresMigrations = []migration{
+	// 1: the same schema as SQLite's, with its foreign keys
+	func(ctx context.Context, repository *ProductRepository) error {
+		repository.createUsersTable(ctx)
+		repository.createProductsTable(ctx)
+		repository.createDealsTable(ctx)
+		repository.createOfferingsTable(ctx)
+		repository.createCartTable(ctx)
+		repository.createAPIKeysTable(ctx)
+		for _, statement := range postgresForeignKeys {
+			if _, err := repository.database.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: versions for optimistic concurrency
+	addVersionColumns,
+	// 3: one line per product in a cart
+	mergeCartLines,
+	// 4: the audit log
+	func(ctx context.Context, repository *ProductRepository) error {
+		repository.createAuditLogTable(ctx)
+		return nil
+	},
+	// 5: products are deleted by marking them
+	func(ctx context.Context, repository *ProductRepository) error {
+		return repository.addColumn(ctx, "products", "deleted_at", "TIMESTAMPTZ")
+	},
+	// 6: deals can be switched off
+	func(ctx context.Context, repository *ProductRepository) error {
+		return repository.addColumn(ctx, "deals", "active", "BOOLEAN NOT NULL DEFAULT TRUE")
+	},
+	// 7: the audit log refuses changes instead of dropping them
+	auditLogTriggers,
+}
+
+/*
+   Databases made before migrations existed were built by create_database.sh,
+   and the first versions of it only had products, deals, offerings and one
+   shared cart. Whatever tables and columns of migration 1 such a database
+   doesn't have are added, so the migrations after it find the schema they
+   expect.
+*/
+func sqliteBaseline(ctx context.Context, repository *ProductRepository) error {
+	hasTable := func(table string) (bool, error) {
+		var tables int
+		err := repository.database.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&tables)
+		return tables > 0, err
+	}
+
+	products, err := hasTable("products")
+	if err != nil {
+		return err
+	}
+	if !products {
+		repository.createUsersTable(ctx)
+		repository.createProductsTable(ctx)
+		repository.createDealsTable(ctx)
+		repository.createOfferingsTable(ctx)
+		repository.createCartTable(ctx)
+		repository.createAPIKeysTable(ctx)
+		return nil
+	}
+
+	// in the order their foreign keys need
+	for _, table := range []string{"users", "carts", "api_keys", "deal_tiers"} {
+		exists, err := hasTable(table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			repository.createTable(ctx, table)
+		}
+	}
+	// the lines of the one cart there was belong to no cart in particular, like cart_id's default says
+	for _, column := range [][3]string{
+		{"products", "category", `VARCHAR(32) NOT NULL DEFAULT ''`},
+		{"deals", "threshold", `VARCHAR(8) NOT NULL DEFAULT '0.00'`},
+		{"deals", "min_quantity", `INTEGER NOT NULL DEFAULT 0`},
+		{"deals", "category", `VARCHAR(32) NOT NULL DEFAULT ''`},
+		{"cart", "cart_id", `INTEGER NOT NULL DEFAULT 0`},
+	} {
+		if err := repository.addColumn(ctx, column[0], column[1], column[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// every change to a product, deal or offering bumps its version
+func addVersionColumns(ctx context.Context, repository *ProductRepository) error {
+	for _, table := range []string{"products", "deals", "offerings"} {
+		if err := repository.addColumn(ctx, table, "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+   The audit log's rules quietly dropped updates and deletes, triggers that
+   raise an error replace them. Whatever the log has, rules or triggers, is
+   dropped first, so it can run on a log created either way.
+*/
+func auditLogTriggers(ctx context.Context, repository *ProductRepository) error {
+	statements := []string{
+		`DROP RULE IF EXISTS audit_log_no_updates ON audit_log;`,
+		`DROP RULE IF EXISTS audit_log_no_deletes ON audit_log;`,
+		`DROP TRIGGER IF EXISTS audit_log_no_updates ON audit_log;`,
+		`DROP TRIGGER IF EXISTS audit_log_no_deletes ON audit_log;`,
+		repository.dialect.table("audit_log_append_only"),
+		repository.dialect.table("audit_log_no_updates"),
+		repository.dialect.table("audit_log_no_deletes"),
+	}
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+   Carts used to get a new line every time a product was added. The lines
+   for the same product are merged into the first of them, then the unique
+   index keeps it that way.
+*/
+func mergeCartLines(ctx context.Context, repository *ProductRepository) error {
+	statements := []string{
+		`UPDATE cart SET quantity = (
+		    SELECT SUM(line.quantity) FROM cart AS line
+		    WHERE line.cart_id = cart.cart_id AND line.product_id = cart.product_id)
+		 WHERE id IN (SELECT MIN(id) FROM cart GROUP BY cart_id, product_id HAVING COUNT(*) > 1);`,
+		`DELETE FROM cart WHERE id NOT IN (SELECT MIN(id) FROM cart GROUP BY cart_id, product_id);`,
+		repository.dialect.table("cart_lines"),
+	}
+	return repository.transaction(ctx, func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+   Adds a column to a table that doesn't have it yet. Tables created by the
+   first migration already have every column, only older databases need it.
+*/
+func (repository *ProductRepository) addColumn(ctx context.Context, table string, column string, definition string) error {
+	exists, err := repository.dialect.hasColumn(ctx, repository.database, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = repository.database.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition))
+	return err
+}
+
+// latestSchemaVersion is the version the server expects the database to be at
+func (repository *ProductRepository) latestSchemaVersion() int {
+	return len(repository.dialect.migrations())
+}
+
+func (repository *ProductRepository) schemaVersion(ctx context.Context) (int, error) {
+	return repository.dialect.schemaVersion(ctx, repository.database)
+}
+
+func (repository *ProductRepository) setSchemaVersion(ctx context.Context, version int) error {
+	return repository.dialect.setSchemaVersion(ctx, repository.database, version)
+}
+
+// migrate brings the database up to the latest version, it does nothing when it's already there
+func (repository *ProductRepository) migrate(ctx context.Context) error {
+	version, err := repository.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > repository.latestSchemaVersion() {
+		return fmt.Errorf("database is at schema version %d, newer than this server's %d", version, repository.latestSchemaVersion())
+	}
+
+	migrations := repository.dialect.migrations()
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](ctx, repository); err != nil {
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if err := repository.setSchemaVersion(ctx, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"log"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,6 +20,7 @@ type Product struct {
 	Name        string `json:"name"`
 	Description string `json:"description,omitempty"`
 	Price       string `json:"price"`
+	Category    string `json:"category,omitempty"`
 }
 
 /*
@@ -24,12 +29,16 @@ type Product struct {
 type DealType string
 
 const (
-	Retail   DealType = "Retail"
-	Flat              = "Flat"
-	Percent           = "Percent"
-	Bundle            = "Bundle"
-	BuyXGetY          = "BuyXGetY"
-	Other             = "Other"
+	Retail      DealType = "Retail"
+	Flat                 = "Flat"
+	Coupon               = "Coupon"
+	Percent              = "Percent"
+	Bundle               = "Bundle"
+	BuyXGetY             = "BuyXGetY"
+	CartFlat             = "CartFlat"
+	CartPercent          = "CartPercent"
+	Tiered               = "Tiered"
+	Other                = "Other"
 )
 
 /*
@@ -43,19 +52,68 @@ const (
    @Coupon is a flat reduction in price from the msdrg price
    @X the first number of a Buy X Get Y Free modifier
    @Y the second number of a Buy X GEt Y Free modifier
+   @Threshold the cart subtotal a cart-level promotion needs before it applies
+   @MinQuantity the number of qualifying items a cart-level promotion needs
 
+   Cart-level promotions (CartFlat, CartPercent) are evaluated after every
+   item-level deal. CartFlat takes @Coupon off the qualifying subtotal,
+   CartPercent takes @Percent (a fraction, "0.10" for 10%) off of it.
+   Exclusive cart-level promotions are never stacked with other promotions.
+   Lines priced by an exclusive item-level deal don't count towards any
+   cart-level promotion.
+
+   Tiered deals price every unit on a line at the price of the tier the line's
+   quantity falls in, see Tier.
+
+   A BuyXGetY deal pools the quantities of every product offered under it,
+   @Category offers it on every product in that category instead of listing
+   offerings one by one. A category deal takes precedence over the product's
+   own offerings, the cheapest units in the pool are the free ones.
+
+   @Active false switches a deal off without deleting it: it isn't applied
+   through its offerings, its category or as a cart-level promotion. Left out
+   the deal is on, deals read back only carry it when they're switched off.
 
    TODO: Add start and end timestamps
 */
 type Deal struct {
-	ID        int      `json:"id,omitempty"`
-	Name      string   `json:"name,omitempty"`
-	Type      DealType `json:"type,omitempty"`
-	Coupon    string   `json:"coupon,omitempty"`
-	Percent   string   `json:"percent,omitempty"`
-	X         int      `json:"x,omitempty"`
-	Y         int      `json:"y,omitempty"`
-	Exclusive bool     `json:"exclusive,omitempty"`
+	ID          int      `json:"id,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Type        DealType `json:"type,omitempty"`
+	Coupon      string   `json:"coupon,omitempty"`
+	Percent     string   `json:"percent,omitempty"`
+	X           int      `json:"x,omitempty"`
+	Y           int      `json:"y,omitempty"`
+	Exclusive   bool     `json:"exclusive,omitempty"`
+	Threshold   string   `json:"threshold,omitempty"`
+	MinQuantity int      `json:"min_quantity,omitempty"`
+	Tiers       []Tier   `json:"tiers,omitempty"`
+	Category    string   `json:"category,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+}
+
+// isActive is whether the deal is applied at all
+func (deal Deal) isActive() bool {
+	return deal.Active == nil || *deal.Active
+}
+
+// dealActive is the Active of a deal read back, only a deal that's switched off has one
+func dealActive(active bool) *bool {
+	if active {
+		return nil
+	}
+	return &active
+}
+
+/*
+   A quantity break for a Tiered deal, stored in the deal_tiers table.
+   A MaxQuantity of 0 means the tier has no upper bound. Tiers of the same
+   deal can't overlap, quantities no tier covers are charged the regular price.
+*/
+type Tier struct {
+	MinQuantity int    `json:"min_quantity"`
+	MaxQuantity int    `json:"max_quantity,omitempty"`
+	Price       string `json:"price"`
 }
 
 /* The offering model is a relationship between one or more products and
@@ -103,11 +161,37 @@ type ProductOffering struct {
 	ProductName   string   `json:"product_name"`
 	Description   string   `json:"description,omitempty"`
 	Price         string   `json:"price"`
+	Category      string   `json:"category,omitempty"`
+}
+
+/*
+   A cart-level promotion along with the products that count towards it.
+   An empty ProductIDs means every item in the cart qualifies.
+*/
+type CartPromotion struct {
+	Deal
+	ProductIDs []int
+}
+
+/*
+   A line in the price breakdown describing a promotion applied to the cart,
+   or the units of a product a mix-and-match deal made free
+*/
+type Adjustment struct {
+	DealID      int      `json:"deal_id"`
+	DealName    string   `json:"deal_name,omitempty"`
+	Type        DealType `json:"type"`
+	ProductID   int      `json:"product_id,omitempty"`
+	Quantity    int      `json:"quantity,omitempty"`
+	Threshold   string   `json:"threshold,omitempty"`
+	MinQuantity int      `json:"min_quantity,omitempty"`
+	Discount    string   `json:"discount"`
 }
 
 type ShoppingCart struct {
-	Items []Item `json:"items"`
-	Total string `json:"total"`
+	Items     []Item       `json:"items"`
+	Total     string       `json:"total"`
+	Breakdown []Adjustment `json:"breakdown,omitempty"`
 }
 
 type Item struct {
@@ -115,118 +199,296 @@ type Item struct {
 	Quantity int     `json:"quantity"`
 }
 
+/*
+   A what-if request for the pricing engine. Items only need a product id,
+   Deals and Offerings are laid over the saved catalog for this request only,
+   a deal with the id of a saved deal replaces it.
+*/
+type Simulation struct {
+	Items     []Item     `json:"items"`
+	Deals     []Deal     `json:"deals,omitempty"`
+	Offerings []Offering `json:"offerings,omitempty"`
+}
+
+/*
+   Enum for what an account is allowed to do. Everyone registers as a
+   customer, merchandisers manage the catalog and admins manage accounts too.
+*/
+type Role string
+
+const (
+	RoleCustomer     Role = "customer"
+	RoleMerchandiser Role = "merchandiser"
+	RoleAdmin        Role = "admin"
+)
+
+/*
+   A customer account. Passwords are only ever stored as bcrypt hashes.
+*/
+type User struct {
+	ID           int    `json:"id,omitempty"`
+	Email        string `json:"email"`
+	Role         Role   `json:"role,omitempty"`
+	PasswordHash string `json:"-"`
+}
+
+/*
+   A key for clients that can't hold a session, like the inventory sync job or
+   a POS terminal. Only the SHA-256 hash of the key is stored, the key itself
+   is handed out once when it's issued. Scopes are "resource:read" or
+   "resource:write", and write implies read.
+*/
+type APIKey struct {
+	ID         int        `json:"id,omitempty"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  int        `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	KeyHash    string     `json:"-"`
+}
+
+/*
+   A change to a product, deal or offering, kept in the append-only audit_log.
+   Before is empty for a create or restore and After for a delete. Who made it is the
+   account or API key behind the request, neither for changes made outside
+   of one.
+*/
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	Entity    string          `json:"entity"`
+	EntityID  int             `json:"entity_id"`
+	Action    string          `json:"action"`
+	UserID    int             `json:"user_id,omitempty"`
+	APIKeyID  int             `json:"api_key_id,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// what the audit log records changes to
+const (
+	AuditProduct  = "product"
+	AuditDeal     = "deal"
+	AuditOffering = "offering"
+)
+
+// what was done to it
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+)
+
+/*
+   One row of a catalog import, a product, deal or offering depending on Kind,
+   with the fields of whichever it is. Line is where the row is in the file.
+   ID keys the upsert: the row updates the product, deal or offering with
+   that id, or adds it with that id when the catalog hasn't one. Without an
+   id the row is added with a new one, see importCatalog.
+*/
+type ImportRow struct {
+	Kind          string   `json:"kind"`
+	ID            int      `json:"id,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	Description   string   `json:"description,omitempty"`
+	Price         string   `json:"price,omitempty"`
+	Category      string   `json:"category,omitempty"`
+	Type          DealType `json:"type,omitempty"`
+	Coupon        string   `json:"coupon,omitempty"`
+	Percent       string   `json:"percent,omitempty"`
+	X             int      `json:"x,omitempty"`
+	Y             int      `json:"y,omitempty"`
+	Exclusive     *bool    `json:"exclusive,omitempty"`
+	Threshold     string   `json:"threshold,omitempty"`
+	MinQuantity   int      `json:"min_quantity,omitempty"`
+	Tiers         []Tier   `json:"tiers,omitempty"`
+	ProductID     int      `json:"product_id,omitempty"`
+	DealID        int      `json:"deal_id,omitempty"`
+	ModifiedPrice string   `json:"modified_price,omitempty"`
+	Active        *bool    `json:"active,omitempty"`
+	Line          int      `json:"-"`
+}
+
+/* What an import did, or would have done for a dry run */
+type ImportReport struct {
+	DryRun    bool          `json:"dry_run"`
+	Rows      int           `json:"rows"`
+	Products  int           `json:"products"`
+	Deals     int           `json:"deals"`
+	Offerings int           `json:"offerings"`
+	Errors    []ImportError `json:"errors,omitempty"`
+}
+
+// a row that couldn't be imported and why
+type ImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// the files an import takes
+const (
+	ImportCSV   = "csv"
+	ImportJSONL = "jsonl"
+)
+
+/*
+   A product as the catalog export lists it. Price is what one unit costs
+   in a cart of its own after the product's active offerings, ListPrice what
+   it costs before them. A product is in stock when there's an active
+   offering or a category deal to sell it under.
+*/
+type ExportedProduct struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	Category     string `json:"category,omitempty"`
+	ListPrice    string `json:"list_price"`
+	Price        string `json:"price"`
+	Availability string `json:"availability"`
+}
+
+// an exported product's availability, spelled the way product feeds spell it
+const (
+	InStock    = "in_stock"
+	OutOfStock = "out_of_stock"
+)
+
+// the formats the catalog is exported in
+const (
+	ExportCSV   = "csv"
+	ExportJSONL = "jsonl"
+	ExportXML   = "xml"
+)
+
+/* What a customer sends to register or log in */
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+/* What GET /version reports about the running server */
+type Version struct {
+	Commit        string `json:"commit"`
+	BuildTime     string `json:"build_time"`
+	GoVersion     string `json:"go_version"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
 /* Database service */
 
-func NewProductRepository(database *sql.DB) *ProductRepository {
-	return &ProductRepository{database: database}
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+func NewProductRepository(database *sql.DB, driver string) *ProductRepository {
+	return &ProductRepository{database: database, dialect: dialects[driver]}
 }
 
 type ProductRepository struct {
 	database *sql.DB
+	dialect  dialect
 }
 
 func ConnectDatabase(config *Config) (*sql.DB, error) {
-	return sql.Open("sqlite3", config.DatabasePath)
-}
-
-/* Helpers */
-func (repository *ProductRepository) createCartTable() {
-	createProductsTableSQL := `CREATE TABLE cart (
-		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		"product_id" INTEGER NOT NULL,
-		"quantity" INTEGER NOT NULL DEFAULT 1,
-		FOREIGN KEY (product_id) REFERENCES products (id)
-	  );`
-
-	statement, err := repository.database.Prepare(createProductsTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to open database connection")
+	var db *sql.DB
+	var err error
+	switch config.Database.Driver {
+	case DriverPostgres:
+		db, err = sql.Open("postgres", config.Database.DSN)
+	default:
+		db, err = sql.Open("sqlite3", sqliteDSN(config.DatabasePath))
 	}
-
-	defer statement.Close()
 	if err != nil {
-		log.Fatalf("Failed to create table: %v", err.Error())
+		return nil, err
 	}
-	_, err = statement.Exec()
-	if err != nil {
-		log.Fatalf("Database transaction failed: %v", err.Error())
+	db.SetMaxOpenConns(config.Database.MaxOpenConns)
+	db.SetMaxIdleConns(config.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(config.Database.ConnMaxLifetime.Duration)
+	return db, nil
+}
+
+// SQLite only enforces foreign keys on connections that ask it to
+func sqliteDSN(path string) string {
+	if strings.Contains(path, "?") {
+		return path + "&_foreign_keys=1"
 	}
+	return path + "?_foreign_keys=1"
+}
 
+func (repository *ProductRepository) ping(ctx context.Context) error {
+	return repository.database.PingContext(ctx)
 }
 
-func (repository *ProductRepository) createProductsTable() {
-	createProductsTableSQL := `CREATE TABLE products (
-		id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-		price VARCHAR(8) NOT NULL DEFAULT "NAN",
-		name VARCHAR(32) NOT NULL DEFAULT "EMPTY",
-		description TEXT
-	  );`
+/* Helpers */
+func (repository *ProductRepository) createCartTable(ctx context.Context) {
+	// every line of the cart belongs to one of the carts
+	repository.createCartsTable(ctx)
+	repository.createTable(ctx, "cart")
+	repository.createTable(ctx, "cart_lines")
+}
 
-	statement, err := repository.database.Prepare(createProductsTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to open database connection")
-	}
+/*
+   A cart belongs to a customer, or to an anonymous session when user_id is null
+*/
+func (repository *ProductRepository) createCartsTable(ctx context.Context) {
+	repository.createTable(ctx, "carts")
+}
 
-	defer statement.Close()
-	if err != nil {
-		log.Fatalf("Failed to create table: %v", err.Error())
-	}
-	_, err = statement.Exec()
-	if err != nil {
-		log.Fatalf("Database transaction failed: %v", err.Error())
-	}
+func (repository *ProductRepository) createUsersTable(ctx context.Context) {
+	repository.createTable(ctx, "users")
+}
 
+func (repository *ProductRepository) createAPIKeysTable(ctx context.Context) {
+	repository.createTable(ctx, "api_keys")
 }
 
-func (repository *ProductRepository) createDealsTable() {
-	createDealsTableSQL := `CREATE TABLE deals (
-	    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	    name VARCHAR(32) NOT NULL DEFAULT "Regular Price",
-	    type VARCHAR(16) NOT NULL DEFAULT "Retail",
-	    coupon VARCHAR(8) NOT NULL DEFAULT "0.00",
-	    percent VARCHAR(8) NOT NULL DEFAULT "0.00",
-	    x INTEGER NOT NULL DEFAULT 0,
-	    y INTEGER NOT NULL DEFAULT 0,
-	    exclusive BOOLEAN NOT NULL DEFAULT 1
-	);`
+func (repository *ProductRepository) createProductsTable(ctx context.Context) {
+	repository.createTable(ctx, "products")
+}
 
-	statement, err := repository.database.Prepare(createDealsTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to open database connection")
-	}
+func (repository *ProductRepository) createDealsTable(ctx context.Context) {
+	repository.createTable(ctx, "deals")
 
-	defer statement.Close()
-	if err != nil {
-		log.Fatalf("Failed to create table: %v", err.Error())
-	}
-	_, err = statement.Exec()
-	if err != nil {
-		log.Fatalf("Database transaction failed: %v", err.Error())
-	}
+	// tiers only exist as part of a deal
+	repository.createDealTiersTable(ctx)
+}
 
+func (repository *ProductRepository) createDealTiersTable(ctx context.Context) {
+	repository.createTable(ctx, "deal_tiers")
 }
 
-func (repository *ProductRepository) createOfferingsTable() {
-	createOfferingsTableSQL := `CREATE TABLE offerings (
-	    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	    product_id INTEGER NOT NULL,
-	    deal_id INTEGER NOT NULL,
-	    modified_price VARCHAR(8) NOT NULL DEFAULT "NAN",
-	    active BOOLEAN NOT NULL DEFAULT 1,
-	    FOREIGN KEY (product_id) REFERENCES products (id),
-	    FOREIGN KEY (deal_id) REFERENCES deals (id) );`
+func (repository *ProductRepository) createOfferingsTable(ctx context.Context) {
+	repository.createTable(ctx, "offerings")
+}
 
-	statement, err := repository.database.Prepare(createOfferingsTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to open database connection")
+func (repository *ProductRepository) createAuditLogTable(ctx context.Context) {
+	repository.createTable(ctx, "audit_log")
+	repository.createTable(ctx, "audit_log_entities")
+	// entries are never changed or removed, the database holds to that as well
+	if repository.dialect.table("audit_log_append_only") != "" {
+		repository.createTable(ctx, "audit_log_append_only")
 	}
-	defer statement.Close()
+	repository.createTable(ctx, "audit_log_no_updates")
+	repository.createTable(ctx, "audit_log_no_deletes")
+}
+
+// createTable runs the dialect's CREATE TABLE for one of the store's tables
+func (repository *ProductRepository) createTable(ctx context.Context, table string) {
+	statement, err := repository.database.PrepareContext(ctx, repository.dialect.table(table))
 	if err != nil {
 		log.Fatalf("Failed to create table: %v", err.Error())
 	}
-	_, err = statement.Exec()
+
+	defer statement.Close()
+	_, err = statement.ExecContext(ctx)
 	if err != nil {
 		log.Fatalf("Database transaction failed: %v", err.Error())
 	}
-
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+/*
+   PostgreSQL, for when one SQLite file isn't enough. Queries use numbered
+   placeholders, the schema version is kept in a schema_version table and
+   transactions that lose a serialization conflict or a deadlock are retried.
+*/
+type postgresDialect struct{}
+
+// rebind numbers the placeholders, ? ? becomes $1 $2, leaving quoted strings alone
+func (postgresDialect) rebind(query string) string {
+	var rebound strings.Builder
+	placeholder := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			placeholder++
+			rebound.WriteString("$" + strconv.Itoa(placeholder))
+			continue
+		}
+		rebound.WriteRune(c)
+	}
+	return rebound.String()
+}
+
+func (postgresDialect) table(name string) string {
+	return postgresTables[name]
+}
+
+func (postgresDialect) migrations() []migration {
+	return postgresMigrations
+}
+
+func (postgresDialect) schemaVersion(ctx context.Context, database *sql.DB) (int, error) {
+	// a database that's never been migrated doesn't have the table yet
+	var exists bool
+	err := database.QueryRowContext(ctx, `SELECT to_regclass('schema_version') IS NOT NULL;`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = database.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&version)
+	return version, err
+}
+
+func (postgresDialect) setSchemaVersion(ctx context.Context, database *sql.DB, version int) error {
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);`,
+		`DELETE FROM schema_version;`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_version (version) VALUES ($1);`, version); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (postgresDialect) hasColumn(ctx context.Context, database *sql.DB, table string, column string) (bool, error) {
+	var columns int
+	err := database.QueryRowContext(ctx, `SELECT count(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2;`, table, column).Scan(&columns)
+	return columns > 0, err
+}
+
+func (postgresDialect) retryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		return true
+	}
+	return false
+}
+
+// a SERIAL column's sequence doesn't know about ids inserted without it
+func (postgresDialect) advanceSequence(ctx context.Context, database querier, table string) error {
+	_, err := database.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence($1, 'id'), (SELECT MAX(id) FROM `+table+`));`, table)
+	return err
+}
+
+/*
+   The tables match SQLite's, with Postgres types. Foreign keys are added by
+   the first migration once every table exists, so tables can be created in
+   any order.
+*/
+var postgresTables = map[string]string{
+	"cart": `CREATE TABLE cart (
+		id SERIAL PRIMARY KEY,
+		cart_id INTEGER NOT NULL DEFAULT 0,
+		product_id INTEGER NOT NULL,
+		quantity INTEGER NOT NULL DEFAULT 1
+	  );`,
+
+	"cart_lines": `CREATE UNIQUE INDEX IF NOT EXISTS cart_lines ON cart (cart_id, product_id);`,
+
+	"carts": `CREATE TABLE carts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER UNIQUE
+	  );`,
+
+	"users": `CREATE TABLE users (
+		id SERIAL PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'customer'
+	  );`,
+
+	"api_keys": `CREATE TABLE api_keys (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_by INTEGER,
+		created_at TIMESTAMPTZ NOT NULL,
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	  );`,
+
+	"products": `CREATE TABLE products (
+		id SERIAL PRIMARY KEY,
+		price TEXT NOT NULL DEFAULT 'NAN',
+		name TEXT NOT NULL DEFAULT 'EMPTY',
+		description TEXT,
+		category TEXT NOT NULL DEFAULT '',
+		version INTEGER NOT NULL DEFAULT 1,
+		deleted_at TIMESTAMPTZ
+	  );`,
+
+	"deals": `CREATE TABLE deals (
+	    id SERIAL PRIMARY KEY,
+	    name TEXT NOT NULL DEFAULT 'Regular Price',
+	    type TEXT NOT NULL DEFAULT 'Retail',
+	    coupon TEXT NOT NULL DEFAULT '0.00',
+	    percent TEXT NOT NULL DEFAULT '0.00',
+	    x INTEGER NOT NULL DEFAULT 0,
+	    y INTEGER NOT NULL DEFAULT 0,
+	    exclusive BOOLEAN NOT NULL DEFAULT TRUE,
+	    threshold TEXT NOT NULL DEFAULT '0.00',
+	    min_quantity INTEGER NOT NULL DEFAULT 0,
+	    category TEXT NOT NULL DEFAULT '',
+	    version INTEGER NOT NULL DEFAULT 1,
+	    active BOOLEAN NOT NULL DEFAULT TRUE
+	);`,
+
+	"deal_tiers": `CREATE TABLE deal_tiers (
+	    id SERIAL PRIMARY KEY,
+	    deal_id INTEGER NOT NULL,
+	    min_quantity INTEGER NOT NULL DEFAULT 1,
+	    max_quantity INTEGER NOT NULL DEFAULT 0,
+	    price TEXT NOT NULL DEFAULT 'NAN'
+	);`,
+
+	"audit_log": `CREATE TABLE audit_log (
+	    id SERIAL PRIMARY KEY,
+	    entity TEXT NOT NULL,
+	    entity_id INTEGER NOT NULL,
+	    action TEXT NOT NULL,
+	    user_id INTEGER,
+	    api_key_id INTEGER,
+	    request_id TEXT NOT NULL DEFAULT '',
+	    before_state TEXT,
+	    after_state TEXT,
+	    created_at TIMESTAMPTZ NOT NULL
+	);`,
+
+	"audit_log_entities": `CREATE INDEX IF NOT EXISTS audit_log_entities ON audit_log (entity, entity_id);`,
+
+	// what the triggers run, SQLite's have it inline
+	"audit_log_append_only": `CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	    BEGIN RAISE EXCEPTION 'audit_log is append-only'; END;
+	    $$ LANGUAGE plpgsql;`,
+
+	"audit_log_no_updates": `CREATE TRIGGER audit_log_no_updates BEFORE UPDATE ON audit_log
+	    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();`,
+
+	"audit_log_no_deletes": `CREATE TRIGGER audit_log_no_deletes BEFORE DELETE ON audit_log
+	    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();`,
+
+	"offerings": `CREATE TABLE offerings (
+	    id SERIAL PRIMARY KEY,
+	    product_id INTEGER NOT NULL,
+	    deal_id INTEGER NOT NULL,
+	    modified_price TEXT NOT NULL DEFAULT 'NAN',
+	    active BOOLEAN NOT NULL DEFAULT TRUE,
+	    version INTEGER NOT NULL DEFAULT 1
+	);`,
+}
+
+var postgresForeignKeys = []string{
+	`ALTER TABLE cart ADD FOREIGN KEY (cart_id) REFERENCES carts (id);`,
+	`ALTER TABLE cart ADD FOREIGN KEY (product_id) REFERENCES products (id);`,
+	`ALTER TABLE carts ADD FOREIGN KEY (user_id) REFERENCES users (id);`,
+	`ALTER TABLE api_keys ADD FOREIGN KEY (created_by) REFERENCES users (id);`,
+	`ALTER TABLE deal_tiers ADD FOREIGN KEY (deal_id) REFERENCES deals (id);`,
+	`ALTER TABLE offerings ADD FOREIGN KEY (product_id) REFERENCES products (id);`,
+	`ALTER TABLE offerings ADD FOREIGN KEY (deal_id) REFERENCES deals (id);`,
+}
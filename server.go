@@ -1,81 +1,348 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
 )
 
 type Server struct {
 	config         *Config
 	productService *ProductService
+	sessions       *sessions.CookieStore
 }
 
-const jsonContentType = "application/json"
+const (
+	jsonContentType = "application/json"
+	sessionName     = "store-session"
+)
 
 func NewServer(config *Config, service *ProductService) *Server {
+	store := sessions.NewCookieStore(config.SessionKey)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		// served over HTTPS, the cookie is never sent without it
+		Secure: config.TLS(),
+	}
 	return &Server{
 		config:         config,
 		productService: service,
+		sessions:       store,
 	}
 }
 
 func (server *Server) Handler() http.Handler {
 	router := http.NewServeMux()
-	router.HandleFunc("/products", server.products)
-	router.HandleFunc("/deals", server.deals)
-	router.HandleFunc("/offerings", server.offerings)
+	router.HandleFunc("/products", server.restrictWrites("products", server.products, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc("/products/", server.restrictWrites("products", server.product, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc("/deals", server.restrictWrites("deals", server.deals, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc("/deals/", server.restrictWrites("deals", server.deal, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc("/offerings", server.restrictWrites("offerings", server.offerings, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc("/offerings/", server.restrictWrites("offerings", server.offering, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc(exportPath, server.restrictWrites("products", server.exportProducts, RoleMerchandiser, RoleAdmin))
 	router.HandleFunc("/cart", server.cart)
-	return router
+	router.HandleFunc("/pricing/simulate", server.requireRole(server.simulate, RoleMerchandiser, RoleAdmin))
+	router.HandleFunc("/auth/register", server.register)
+	router.HandleFunc("/auth/login", server.login)
+	router.HandleFunc("/auth/logout", server.logout)
+	router.HandleFunc("/admin/users", server.requireRole(server.users, RoleAdmin))
+	router.HandleFunc("/admin/api-keys", server.requireRole(server.apiKeys, RoleAdmin))
+	router.HandleFunc("/admin/flags", server.requireRole(server.flags, RoleAdmin))
+	router.HandleFunc("/admin/audit", server.requireRole(server.audit, RoleAdmin))
+	router.HandleFunc("/admin/import", server.requireRole(server.importCatalog, RoleAdmin))
+
+	// probes skip the middleware, they shouldn't start sessions or need a key
+	probes := http.NewServeMux()
+	probes.HandleFunc("/healthz", server.healthz)
+	probes.HandleFunc("/readyz", server.readyz)
+	probes.HandleFunc("/version", server.version)
+	probes.Handle("/metrics", metricsHandler())
+	probes.Handle("/", server.limitBody(server.withDeadline(server.authenticate(server.identify(router)))))
+
+	route := func(request *http.Request) string {
+		_, pattern := probes.Handler(request)
+		if pattern == "/" {
+			_, pattern = router.Handler(request)
+		}
+		return pattern
+	}
+	return traceRequests(route, server.logRequests(instrument(route, probes)))
 }
 
-func (server *Server) Run() {
+// Run listens on the configured port until ctx is cancelled, see Serve
+func (server *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", ":"+server.config.Port)
+	if err != nil {
+		return err
+	}
+	return server.Serve(ctx, listener)
+}
+
+/*
+   Serves requests on the listener until ctx is cancelled. It then stops
+   accepting connections and waits up to the shutdown timeout for requests
+   that are still in flight before returning.
+*/
+func (server *Server) Serve(ctx context.Context, listener net.Listener) error {
 	httpServer := &http.Server{
-		Addr:    ":" + server.config.Port,
-		Handler: server.Handler(),
+		Handler:      server.Handler(),
+		ReadTimeout:  server.config.ReadTimeout.Duration,
+		WriteTimeout: server.config.WriteTimeout.Duration,
+		IdleTimeout:  server.config.IdleTimeout.Duration,
 	}
-	err := httpServer.ListenAndServe()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.config.TLS() {
+			serveErr <- httpServer.ServeTLS(listener, server.config.TLSCertFile, server.config.TLSKeyFile)
+		} else {
+			serveErr <- httpServer.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), server.config.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+/* Health Handlers */
+
+// healthz only says the process is up and serving
+func (server *Server) healthz(writer http.ResponseWriter, request *http.Request) {
+	writeStatus(writer, request, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz says whether the server can take traffic, the database has to answer and be migrated
+func (server *Server) readyz(writer http.ResponseWriter, request *http.Request) {
+	err := server.productService.ready(request.Context())
 	if err != nil {
-		log.Fatalf("Statement error %v", err.Error())
+		writeStatus(writer, request, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	writeStatus(writer, request, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (server *Server) version(writer http.ResponseWriter, request *http.Request) {
+	writeStatus(writer, request, http.StatusOK, server.productService.version(request.Context()))
+}
+
+/* Responds to a failed read or write, requests that ran out of time get a 503 */
+func storeError(writer http.ResponseWriter, err error, message string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(writer, "Request timed out", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(writer, message, 500)
+}
+
+func writeStatus(writer http.ResponseWriter, request *http.Request, status int, body interface{}) {
+	bytes, err := encodeResponse(request.Context(), body)
+	if err != nil {
+		http.Error(writer, "Failed to write response", 500)
+		return
+	}
+	writer.Header().Set("Content-Type", jsonContentType)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(bytes)
+}
+
+/*
+   Writes a list with an ETag of its contents. A client that sends the ETag
+   back in If-None-Match gets a 304 with no body while the list hasn't changed.
+*/
+func writeCacheable(writer http.ResponseWriter, request *http.Request, body interface{}) {
+	bytes, err := encodeResponse(request.Context(), body)
+	if err != nil {
+		http.Error(writer, "Failed to write response", 500)
+		return
+	}
+	sum := sha256.Sum256(bytes)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	writer.Header().Set("ETag", etag)
+	if etagMatches(request.Header.Get("If-None-Match"), etag) {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writer.Header().Set("Content-Type", jsonContentType)
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(bytes)
+}
+
+// writeVersioned writes one product or deal with its version as the ETag
+func writeVersioned(writer http.ResponseWriter, request *http.Request, body interface{}, version int) {
+	etag := versionETag(version)
+	writer.Header().Set("ETag", etag)
+	if etagMatches(request.Header.Get("If-None-Match"), etag) {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeStatus(writer, request, http.StatusOK, body)
+}
+
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+/*
+   Reads the version a write expects from If-Match, the ETag of a GET of the
+   product, deal or offering. Writes without one are refused with a 428, so a client can't
+   overwrite a change it hasn't seen by leaving it off; If-Match: * writes
+   whatever the version. ok is false when the response has been written.
+*/
+func ifMatch(writer http.ResponseWriter, request *http.Request) (version int, ok bool) {
+	header := strings.TrimSpace(request.Header.Get("If-Match"))
+	switch {
+	case header == "":
+		http.Error(writer, "If-Match is required, send the ETag it was read with", http.StatusPreconditionRequired)
+		return 0, false
+	case header == "*":
+		return anyVersion, true
+	}
+	version, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil || version < 1 || header != versionETag(version) {
+		// weak and unknown ETags never match
+		http.Error(writer, ErrVersionMismatch.Error(), http.StatusPreconditionFailed)
+		return 0, false
+	}
+	return version, true
+}
+
+// versionError responds to a versioned write that failed because of the version, or because nothing was there
+func versionError(writer http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, ErrVersionMismatch):
+		http.Error(writer, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, ErrUnknownProduct), errors.Is(err, ErrUnknownDeal), errors.Is(err, ErrUnknownOffering):
+		http.Error(writer, err.Error(), 404)
+	default:
+		return false
 	}
+	return true
+}
 
+// etagMatches compares weakly, as If-None-Match does, header is a list of ETags or *
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+   The cart of whoever is making the request. Customers that are logged in get
+   their account's cart, everyone else gets an anonymous cart kept in their session.
+   Without one yet it's 0, unless create starts the anonymous cart.
+*/
+func (server *Server) cartID(writer http.ResponseWriter, request *http.Request, create bool) (int, error) {
+	// a cookie we can't decode just starts a new session
+	session, _ := server.sessions.Get(request, sessionName)
+	if cartID, ok := session.Values["cart_id"].(int); ok || !create {
+		return cartID, nil
+	}
+
+	cartID, err := server.productService.newCart(request.Context())
+	if err != nil {
+		return 0, err
+	}
+	session.Values["cart_id"] = cartID
+	return cartID, session.Save(request, writer)
 }
 
 /* Cart Handler */
 func (server *Server) cart(writer http.ResponseWriter, request *http.Request) {
 
+	// looking at a cart doesn't start one, the first change to it does
+	cartID, err := server.cartID(writer, request, request.Method != http.MethodGet)
+	if err != nil {
+		storeError(writer, err, "Failed to find a cart")
+		return
+	}
+
 	switch request.Method {
 
 	case http.MethodPost:
 		var shoppingCart ShoppingCart
 		var product Product
-		err := json.NewDecoder(request.Body).Decode(&product)
+		err = json.NewDecoder(request.Body).Decode(&product)
 		if err != nil {
 			http.Error(writer, "Bad Request", 400)
 		}
 
-		p := server.productService.getProduct(product)
+		p, err := server.productService.getProduct(request.Context(), product)
+		if err != nil {
+			storeError(writer, err, "Failed to find the product")
+			return
+		}
 		if (Product{} == p) {
 			http.Error(writer, "Product Does Not Exist", 404)
+			return
+		}
+		err = server.productService.addToCart(request.Context(), cartID, p)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrUnknownProduct) {
+			http.Error(writer, "Product Does Not Exist", 404)
+			return
 		}
-		err = server.productService.addToCart(p)
 		if err != nil {
-			http.Error(writer, "Failed to add product to cart", 500)
+			storeError(writer, err, "Failed to add product to cart")
+			return
 		}
 
-		items := server.productService.listCartItems()
+		items, err := server.productService.listCartItems(request.Context(), cartID)
+		if err != nil {
+			storeError(writer, err, "Failed to list the cart")
+			return
+		}
 
 		if len(items) == 0 {
 			shoppingCart = ShoppingCart{}
 		} else {
-			total, err := server.productService.calculateTotalPrice()
+			total, breakdown, err := server.productService.calculateTotalPrice(request.Context(), items)
+			if errors.Is(err, ErrFeatureDisabled) {
+				http.Error(writer, err.Error(), 503)
+				return
+			}
 			if err != nil {
-				http.Error(writer, "Error calculating total", 500)
+				storeError(writer, err, "Error calculating total")
+				return
 			}
-			shoppingCart = ShoppingCart{items, total}
+			shoppingCart = ShoppingCart{items, total, breakdown}
 		}
 
-		bytes, err := json.Marshal(shoppingCart)
+		bytes, err := encodeResponse(request.Context(), shoppingCart)
 		if err != nil {
 			http.Error(writer, "Failed to write a response", 500)
 		}
@@ -90,29 +357,47 @@ func (server *Server) cart(writer http.ResponseWriter, request *http.Request) {
 	case http.MethodPut:
 		var shoppingCart ShoppingCart
 		var item Item
-		err := json.NewDecoder(request.Body).Decode(&item)
+		err = json.NewDecoder(request.Body).Decode(&item)
 		if err != nil {
 			http.Error(writer, "Bad Request", 400)
 		}
 
-		err = server.productService.updateCart(item)
+		err = server.productService.updateCart(request.Context(), cartID, item)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrInvalidQuantity) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
 		if err != nil {
-			http.Error(writer, "Failed to update cart", 500)
+			storeError(writer, err, "Failed to update cart")
+			return
 		}
 
-		items := server.productService.listCartItems()
+		items, err := server.productService.listCartItems(request.Context(), cartID)
+		if err != nil {
+			storeError(writer, err, "Failed to list the cart")
+			return
+		}
 
 		if len(items) == 0 {
 			shoppingCart = ShoppingCart{}
 		} else {
-			total, err := server.productService.calculateTotalPrice()
+			total, breakdown, err := server.productService.calculateTotalPrice(request.Context(), items)
+			if errors.Is(err, ErrFeatureDisabled) {
+				http.Error(writer, err.Error(), 503)
+				return
+			}
 			if err != nil {
-				http.Error(writer, "Error calculating total", 500)
+				storeError(writer, err, "Error calculating total")
+				return
 			}
-			shoppingCart = ShoppingCart{items, total}
+			shoppingCart = ShoppingCart{items, total, breakdown}
 		}
 
-		bytes, err := json.Marshal(shoppingCart)
+		bytes, err := encodeResponse(request.Context(), shoppingCart)
 		if err != nil {
 			http.Error(writer, "Failed to write response", 500)
 		}
@@ -127,29 +412,43 @@ func (server *Server) cart(writer http.ResponseWriter, request *http.Request) {
 
 		var shoppingCart ShoppingCart
 		var product Product
-		err := json.NewDecoder(request.Body).Decode(&product)
+		err = json.NewDecoder(request.Body).Decode(&product)
 		if err != nil {
 			http.Error(writer, "Bad Request", 400)
 		}
 
-		err = server.productService.removeFromCart(product)
+		err = server.productService.removeFromCart(request.Context(), cartID, product)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
 		if err != nil {
-			http.Error(writer, "Failed to update cart", 500)
+			storeError(writer, err, "Failed to update cart")
+			return
 		}
 
-		items := server.productService.listCartItems()
+		items, err := server.productService.listCartItems(request.Context(), cartID)
+		if err != nil {
+			storeError(writer, err, "Failed to list the cart")
+			return
+		}
 
 		if len(items) == 0 {
 			shoppingCart = ShoppingCart{}
 		} else {
-			total, err := server.productService.calculateTotalPrice()
+			total, breakdown, err := server.productService.calculateTotalPrice(request.Context(), items)
+			if errors.Is(err, ErrFeatureDisabled) {
+				http.Error(writer, err.Error(), 503)
+				return
+			}
 			if err != nil {
-				http.Error(writer, "Error calculating total", 500)
+				storeError(writer, err, "Error calculating total")
+				return
 			}
-			shoppingCart = ShoppingCart{items, total}
+			shoppingCart = ShoppingCart{items, total, breakdown}
 		}
 
-		bytes, err := json.Marshal(shoppingCart)
+		bytes, err := encodeResponse(request.Context(), shoppingCart)
 		if err != nil {
 			http.Error(writer, "Failed to write response", 500)
 		}
@@ -162,20 +461,32 @@ func (server *Server) cart(writer http.ResponseWriter, request *http.Request) {
 
 	case http.MethodGet:
 
-		items := server.productService.listCartItems()
+		var items []Item
+		if cartID != 0 {
+			items, err = server.productService.listCartItems(request.Context(), cartID)
+		}
+		if err != nil {
+			storeError(writer, err, "Failed to list the cart")
+			return
+		}
 		var shoppingCart ShoppingCart
 
 		if len(items) < 1 {
 			shoppingCart = ShoppingCart{}
 		} else {
-			total, err := server.productService.calculateTotalPrice()
+			total, breakdown, err := server.productService.calculateTotalPrice(request.Context(), items)
+			if errors.Is(err, ErrFeatureDisabled) {
+				http.Error(writer, err.Error(), 503)
+				return
+			}
 			if err != nil {
-				http.Error(writer, "Error calculating total", 500)
+				storeError(writer, err, "Error calculating total")
+				return
 			}
-			shoppingCart = ShoppingCart{items, total}
+			shoppingCart = ShoppingCart{items, total, breakdown}
 		}
 
-		bytes, err := json.Marshal(shoppingCart)
+		bytes, err := encodeResponse(request.Context(), shoppingCart)
 		if err != nil {
 			http.Error(writer, "Failed to write response", 500)
 		}
@@ -190,6 +501,314 @@ func (server *Server) cart(writer http.ResponseWriter, request *http.Request) {
 
 }
 
+/* Account Handlers */
+func (server *Server) register(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+
+	var credentials Credentials
+	err := json.NewDecoder(request.Body).Decode(&credentials)
+	if err != nil {
+		http.Error(writer, "Bad Request", 400)
+		return
+	}
+
+	user, err := server.productService.register(request.Context(), credentials)
+	if errors.Is(err, ErrInvalidCredentials) {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		http.Error(writer, err.Error(), 409)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Failed to create account", 500)
+		return
+	}
+
+	server.startSession(writer, request, user, http.StatusCreated)
+}
+
+func (server *Server) login(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+
+	var credentials Credentials
+	err := json.NewDecoder(request.Body).Decode(&credentials)
+	if err != nil {
+		http.Error(writer, "Bad Request", 400)
+		return
+	}
+
+	user, err := server.productService.login(request.Context(), credentials)
+	if errors.Is(err, ErrInvalidCredentials) {
+		http.Error(writer, err.Error(), 401)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Failed to log in", 500)
+		return
+	}
+
+	server.startSession(writer, request, user, http.StatusOK)
+}
+
+func (server *Server) logout(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+
+	session, _ := server.sessions.Get(request, sessionName)
+	session.Values = make(map[interface{}]interface{})
+	session.Options.MaxAge = -1
+	err := session.Save(request, writer)
+	if err != nil {
+		http.Error(writer, "Failed to log out", 500)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+/* Admin: change what an account is allowed to do */
+func (server *Server) users(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+
+	case http.MethodPut:
+		var user User
+		err := json.NewDecoder(request.Body).Decode(&user)
+		if err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+
+		err = server.productService.setRole(request.Context(), user)
+		if errors.Is(err, ErrInvalidRole) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+		if errors.Is(err, ErrUnknownUser) {
+			http.Error(writer, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Failed to update the account", 500)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+/* Admin: look at and flip feature flags while the server is running */
+func (server *Server) flags(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+
+	case http.MethodGet:
+		bytes, err := encodeResponse(request.Context(), server.productService.listFlags(request.Context()))
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+			return
+		}
+		writer.Header().Set("Content-Type", jsonContentType)
+		writer.WriteHeader(http.StatusOK)
+		_, err = writer.Write(bytes)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+		}
+
+	case http.MethodPut:
+		var flag FeatureFlag
+		err := json.NewDecoder(request.Body).Decode(&flag)
+		if err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+
+		err = server.productService.setFlag(request.Context(), flag)
+		if errors.Is(err, ErrInvalidFlag) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+		if errors.Is(err, ErrUnknownFlag) {
+			http.Error(writer, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Failed to update the flag", 500)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+/* Admin: issue, list and revoke API keys */
+func (server *Server) apiKeys(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+
+	case http.MethodGet:
+		keys, err := server.productService.listAPIKeys(request.Context())
+		if err != nil {
+			http.Error(writer, "Failed to list api keys", 500)
+			return
+		}
+		bytes, err := encodeResponse(request.Context(), keys)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+			return
+		}
+		writer.Header().Set("Content-Type", jsonContentType)
+		writer.WriteHeader(http.StatusOK)
+		_, err = writer.Write(bytes)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+		}
+
+	case http.MethodPost:
+		var key APIKey
+		err := json.NewDecoder(request.Body).Decode(&key)
+		if err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+
+		admin, _ := userFromContext(request.Context())
+		key, err = server.productService.issueAPIKey(request.Context(), admin, key)
+		if errors.Is(err, ErrInvalidAPIKey) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Failed to issue api key", 500)
+			return
+		}
+
+		bytes, err := encodeResponse(request.Context(), key)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+			return
+		}
+		writer.Header().Set("Content-Type", jsonContentType)
+		writer.WriteHeader(http.StatusCreated)
+		_, err = writer.Write(bytes)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+		}
+
+	case http.MethodDelete:
+		var key APIKey
+		err := json.NewDecoder(request.Body).Decode(&key)
+		if err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+
+		err = server.productService.revokeAPIKey(request.Context(), key.ID)
+		if errors.Is(err, ErrUnknownAPIKey) {
+			http.Error(writer, err.Error(), 404)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Failed to revoke api key", 500)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+// startSession logs the user in, bringing along whatever they put in their anonymous cart
+func (server *Server) startSession(writer http.ResponseWriter, request *http.Request, user User, status int) {
+	session, _ := server.sessions.Get(request, sessionName)
+
+	anonymousCartID := 0
+	if _, loggedIn := session.Values["user_id"].(int); !loggedIn {
+		anonymousCartID, _ = session.Values["cart_id"].(int)
+	}
+
+	cartID, err := server.productService.accountCart(request.Context(), user, anonymousCartID)
+	if err != nil {
+		http.Error(writer, "Failed to find a cart", 500)
+		return
+	}
+
+	session.Values["user_id"] = user.ID
+	session.Values["cart_id"] = cartID
+	requestScopeFromContext(request.Context()).userID = user.ID
+	err = session.Save(request, writer)
+	if err != nil {
+		http.Error(writer, "Failed to save session", 500)
+		return
+	}
+
+	bytes, err := encodeResponse(request.Context(), user)
+	if err != nil {
+		http.Error(writer, "Failed to write response", 500)
+		return
+	}
+	writer.Header().Set("Content-Type", jsonContentType)
+	writer.WriteHeader(status)
+	_, err = writer.Write(bytes)
+	if err != nil {
+		http.Error(writer, "Failed to write response", 500)
+	}
+}
+
+/* Pricing Simulation Handler */
+func (server *Server) simulate(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+
+	case http.MethodPost:
+		var simulation Simulation
+		err := json.NewDecoder(request.Body).Decode(&simulation)
+		if err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+
+		shoppingCart, err := server.productService.simulatePrice(request.Context(), simulation)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrInvalidDeal) || errors.Is(err, ErrInvalidSimulation) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Error calculating total", 500)
+			return
+		}
+
+		bytes, err := encodeResponse(request.Context(), shoppingCart)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+			return
+		}
+		writer.Header().Set("Content-Type", jsonContentType)
+		writer.WriteHeader(http.StatusOK)
+		_, err = writer.Write(bytes)
+		if err != nil {
+			http.Error(writer, "Failed to write response", 500)
+		}
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
 /* Offerings Handler */
 func (server *Server) offerings(writer http.ResponseWriter, request *http.Request) {
 	switch request.Method {
@@ -202,7 +821,11 @@ func (server *Server) offerings(writer http.ResponseWriter, request *http.Reques
 			http.Error(writer, "Bad Request", 400)
 		}
 
-		err = server.productService.newOffering(offering)
+		err = server.productService.newOffering(request.Context(), offering)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
 		if err != nil {
 			http.Error(writer, "Failed create new deal", 500)
 		}
@@ -215,17 +838,12 @@ func (server *Server) deals(writer http.ResponseWriter, request *http.Request) {
 	switch request.Method {
 	case http.MethodGet:
 
-		deals := server.productService.listDeals()
-		bytes, err := json.Marshal(deals)
+		deals, err := server.productService.listDeals(request.Context())
 		if err != nil {
-			http.Error(writer, "Bad Request", 400)
-		}
-		writer.Header().Set("Content-Type", jsonContentType)
-		writer.WriteHeader(http.StatusOK)
-		_, err = writer.Write(bytes)
-		if err != nil {
-			http.Error(writer, "Failed to write response", 500)
+			storeError(writer, err, "Failed to list deals")
+			return
 		}
+		writeCacheable(writer, request, deals)
 
 	case http.MethodPost:
 
@@ -236,9 +854,18 @@ func (server *Server) deals(writer http.ResponseWriter, request *http.Request) {
 			http.Error(writer, "Bad Request", 400)
 		}
 
-		err = server.productService.newDeal(deal)
+		err = server.productService.newDeal(request.Context(), deal)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrInvalidDeal) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
 		if err != nil {
 			http.Error(writer, "Failed create new deal", 500)
+			return
 		}
 		writer.WriteHeader(http.StatusCreated)
 	}
@@ -249,54 +876,81 @@ func (server *Server) products(writer http.ResponseWriter, request *http.Request
 
 	switch request.Method {
 	case http.MethodGet:
-		products := server.productService.listProducts()
-		bytes, err := json.Marshal(products)
+		products, err := server.productService.listProducts(request.Context())
 		if err != nil {
-			http.Error(writer, "Bad Request", 400)
-		}
-		writer.Header().Set("Content-Type", jsonContentType)
-		writer.WriteHeader(http.StatusOK)
-		_, err = writer.Write(bytes)
-		if err != nil {
-			http.Error(writer, "Failed to write response", 500)
+			storeError(writer, err, "Failed to list products")
+			return
 		}
+		writeCacheable(writer, request, products)
 
 	case http.MethodPost:
 		var product Product
 		err := json.NewDecoder(request.Body).Decode(&product)
 		if err != nil {
 			http.Error(writer, "Bad Request", 400)
+			return
+		}
+		err = server.productService.newProduct(request.Context(), product)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
 		}
-		err = server.productService.newProduct(product)
 		if err != nil {
-			http.Error(writer, "Failed to create new product", 500)
+			storeError(writer, err, "Failed to create new product")
+			return
 		}
 
 		writer.WriteHeader(http.StatusCreated)
 
 	case http.MethodPut:
+		version, ok := ifMatch(writer, request)
+		if !ok {
+			return
+		}
 		var product Product
 		err := json.NewDecoder(request.Body).Decode(&product)
 		if err != nil {
 			http.Error(writer, "Bad Request", 400)
+			return
+		}
+		err = server.productService.updateProduct(request.Context(), product, version)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if versionError(writer, err) {
+			return
 		}
-		err = server.productService.updateProduct(product)
 		if err != nil {
-			http.Error(writer, "Failed to update the product", 500)
+			storeError(writer, err, "Failed to update the product")
+			return
 		}
 		writer.WriteHeader(http.StatusNoContent)
 
 	case http.MethodDelete:
+		version, ok := ifMatch(writer, request)
+		if !ok {
+			return
+		}
 		var product Product
 		err := json.NewDecoder(request.Body).Decode(&product)
 
 		if err != nil {
 			http.Error(writer, "Bad Request", 400)
+			return
 		}
 
-		err = server.productService.deleteProduct(product)
+		err = server.productService.deleteProduct(request.Context(), product, version)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if versionError(writer, err) {
+			return
+		}
 		if err != nil {
-			http.Error(writer, "Failed to delete new product", 500)
+			storeError(writer, err, "Failed to delete new product")
+			return
 		}
 
 		writer.WriteHeader(http.StatusOK)
@@ -304,3 +958,351 @@ func (server *Server) products(writer http.ResponseWriter, request *http.Request
 	}
 
 }
+
+/*
+   A single product, GET /products/{id}, with its version as the ETag.
+   POST /products/{id}/restore brings back a deleted product.
+*/
+func (server *Server) product(writer http.ResponseWriter, request *http.Request) {
+	path := strings.TrimPrefix(request.URL.Path, "/products/")
+	restore := strings.HasSuffix(path, "/restore")
+	productID, err := strconv.Atoi(strings.TrimSuffix(path, "/restore"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+
+	switch {
+	case restore && request.Method == http.MethodPost:
+		err := server.productService.restoreProduct(request.Context(), productID)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrNotDeleted) {
+			http.Error(writer, err.Error(), http.StatusConflict)
+			return
+		}
+		if versionError(writer, err) {
+			return
+		}
+		if err != nil {
+			storeError(writer, err, "Failed to restore the product")
+			return
+		}
+		product, version, err := server.productService.getVersionedProduct(request.Context(), productID)
+		if err != nil {
+			storeError(writer, err, "Failed to find the product")
+			return
+		}
+		writeVersioned(writer, request, product, version)
+
+	case restore:
+		http.Error(writer, "Method Not Allowed", 405)
+
+	case request.Method == http.MethodGet:
+		product, version, err := server.productService.getVersionedProduct(request.Context(), productID)
+		if err != nil {
+			storeError(writer, err, "Failed to find the product")
+			return
+		}
+		if product.ID == 0 {
+			http.Error(writer, "Product Does Not Exist", 404)
+			return
+		}
+		writeVersioned(writer, request, product, version)
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+/*
+   A single deal, GET /deals/{id} with its version as the ETag. PUT replaces
+   it and DELETE deletes it, both with the ETag in If-Match.
+*/
+func (server *Server) deal(writer http.ResponseWriter, request *http.Request) {
+	dealID, err := strconv.Atoi(strings.TrimPrefix(request.URL.Path, "/deals/"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		deal, version, err := server.productService.getDeal(request.Context(), dealID)
+		if err != nil {
+			storeError(writer, err, "Failed to find the deal")
+			return
+		}
+		if deal.ID == 0 {
+			http.Error(writer, "Deal Does Not Exist", 404)
+			return
+		}
+		writeVersioned(writer, request, deal, version)
+
+	case http.MethodPut:
+		version, ok := ifMatch(writer, request)
+		if !ok {
+			return
+		}
+		var deal Deal
+		if err := json.NewDecoder(request.Body).Decode(&deal); err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+		deal.ID = dealID
+		err := server.productService.updateDeal(request.Context(), deal, version)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrInvalidDeal) {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+		if versionError(writer, err) {
+			return
+		}
+		if err != nil {
+			storeError(writer, err, "Failed to update the deal")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		version, ok := ifMatch(writer, request)
+		if !ok {
+			return
+		}
+		err := server.productService.deleteDeal(request.Context(), dealID, version)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if errors.Is(err, ErrDealInUse) {
+			http.Error(writer, err.Error(), http.StatusConflict)
+			return
+		}
+		if versionError(writer, err) {
+			return
+		}
+		if err != nil {
+			storeError(writer, err, "Failed to delete the deal")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+/* A single offering, like a single deal: GET, PUT and DELETE /offerings/{id} */
+func (server *Server) offering(writer http.ResponseWriter, request *http.Request) {
+	offeringID, err := strconv.Atoi(strings.TrimPrefix(request.URL.Path, "/offerings/"))
+	if err != nil {
+		http.NotFound(writer, request)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		offering, version, err := server.productService.getOffering(request.Context(), offeringID)
+		if err != nil {
+			storeError(writer, err, "Failed to find the offering")
+			return
+		}
+		if offering.ID == 0 {
+			http.Error(writer, "Offering Does Not Exist", 404)
+			return
+		}
+		writeVersioned(writer, request, offering, version)
+
+	case http.MethodPut:
+		version, ok := ifMatch(writer, request)
+		if !ok {
+			return
+		}
+		var offering Offering
+		if err := json.NewDecoder(request.Body).Decode(&offering); err != nil {
+			http.Error(writer, "Bad Request", 400)
+			return
+		}
+		offering.ID = offeringID
+		err := server.productService.updateOffering(request.Context(), offering, version)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if versionError(writer, err) {
+			return
+		}
+		if err != nil {
+			storeError(writer, err, "Failed to update the offering")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		version, ok := ifMatch(writer, request)
+		if !ok {
+			return
+		}
+		err := server.productService.deleteOffering(request.Context(), offeringID, version)
+		if errors.Is(err, ErrFeatureDisabled) {
+			http.Error(writer, err.Error(), 503)
+			return
+		}
+		if versionError(writer, err) {
+			return
+		}
+		if err != nil {
+			storeError(writer, err, "Failed to delete the offering")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+/* The audit log of one product, deal or offering, GET /admin/audit?entity=product&id=3 */
+func (server *Server) audit(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+
+	query := request.URL.Query()
+	entityID := 0
+	if id := query.Get("id"); id != "" {
+		var err error
+		if entityID, err = strconv.Atoi(id); err != nil || entityID < 1 {
+			http.Error(writer, "id must be a positive number", 400)
+			return
+		}
+	}
+
+	entries, err := server.productService.listAuditEntries(request.Context(), query.Get("entity"), entityID)
+	if errors.Is(err, ErrUnknownEntity) {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	if err != nil {
+		storeError(writer, err, "Failed to read the audit log")
+		return
+	}
+	writeStatus(writer, request, http.StatusOK, entries)
+}
+
+// the Content-Types an import can be sent as
+var importContentTypes = map[string]string{
+	"text/csv":             ImportCSV,
+	"application/x-ndjson": ImportJSONL,
+	"application/jsonl":    ImportJSONL,
+}
+
+/*
+   Imports a catalog file, POST /admin/import with the file as the body and
+   a Content-Type of text/csv or application/x-ndjson. ?dry_run=true reports
+   what it would import without importing anything. Rows that can't be
+   imported get a 422 with the report saying why.
+*/
+func (server *Server) importCatalog(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	format, ok := importContentTypes[mediaType]
+	if !ok {
+		http.Error(writer, "the file has to be text/csv or application/x-ndjson", http.StatusUnsupportedMediaType)
+		return
+	}
+	dryRun := false
+	if value := request.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			http.Error(writer, "dry_run has to be true or false", 400)
+			return
+		}
+	}
+
+	report, err := server.productService.importCatalog(request.Context(), request.Body, format, dryRun)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrFeatureDisabled):
+		http.Error(writer, err.Error(), 503)
+	case errors.As(err, &tooLarge):
+		http.Error(writer, "Request Entity Too Large", 413)
+	case errors.Is(err, ErrInvalidImport) && len(report.Errors) > 0:
+		writeStatus(writer, request, http.StatusUnprocessableEntity, report)
+	case errors.Is(err, ErrInvalidImport):
+		http.Error(writer, err.Error(), 400)
+	case err != nil:
+		storeError(writer, err, "Failed to import the catalog")
+	default:
+		writeStatus(writer, request, http.StatusOK, report)
+	}
+}
+
+// what each export format is sent as
+var exportContentTypes = map[string]string{
+	ExportCSV:   "text/csv; charset=utf-8",
+	ExportJSONL: "application/x-ndjson",
+	ExportXML:   "application/xml; charset=utf-8",
+}
+
+/*
+   Streams the catalog as a product feed, GET /export/products?format=csv,
+   jsonl or xml, CSV when there's no format. A failure once the feed has
+   started can't change the status any more, the feed just ends early.
+*/
+func (server *Server) exportProducts(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+
+	format := request.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		http.Error(writer, "format has to be csv, jsonl or xml", 400)
+		return
+	}
+
+	// the server's write timeout is for ordinary responses, the feed is written for as long as the export runs
+	deadline := time.Now().Add(server.config.ExportTimeout.Duration)
+	if err := http.NewResponseController(writer).SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Warn(request.Context(), "unable to extend the write deadline for the export", "error", err)
+	}
+
+	sent := &sentWriter{ResponseWriter: writer}
+	buffered := bufio.NewWriter(sent)
+	writer.Header().Set("Content-Type", contentType)
+	feed, err := newFeedWriter(format, buffered)
+	if err == nil {
+		err = server.productService.exportProducts(request.Context(), feed.write)
+	}
+	if err == nil {
+		err = feed.close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		return
+	}
+
+	if sent.sent {
+		logger.Error(request.Context(), "export cut short", "format", format, "error", err)
+		return
+	}
+	storeError(writer, err, "Failed to export the catalog")
+}
@@ -2,47 +2,84 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testDatabaseDir holds the SQLite database the tests use, it's removed once they've run
+var testDatabaseDir string
+
+func TestMain(m *testing.M) {
+	// request logs would bury the test output, tests that check logging swap in their own logger
+	logger = NewLogger(ioutil.Discard, "error")
+	dir, err := ioutil.TempDir("", "store-test")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	testDatabaseDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func TestShoppingCart(t *testing.T) {
 	// scaffolding
 	config := NewConfig()
 	productRepository := setupTestDatabase(config)
 	productService := NewProductService(config, productRepository)
 	server := NewServer(config, productService)
+	customer := newBrowser(server)
 	//add cart table
-	productService.repository.createCartTable()
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
 
 	// some deals to offer
-	productService.repository.createDealsTable()
-	productService.repository.insertDeal(Deal{Name: "Regular Price", Type: "Retail"})
-	productService.repository.insertDeal(Deal{Name: "Half Off", Type: "Percent", Percent: "0.5"})
-	productService.repository.insertDeal(Deal{Name: "Laptop Mouse Bundle", Type: "Bundle"})
-	productService.repository.insertDeal(Deal{Name: "Buy 3 Get 2 free", Type: "BuyXGetY", X: 3, Y: 2})
-	productService.repository.insertDeal(Deal{Name: "$10 keyboard", Type: "Coupon", Coupon: "10"})
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Half Off", Type: "Percent", Percent: "0.5"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Laptop Mouse Bundle", Type: "Bundle"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Buy 3 Get 2 free", Type: "BuyXGetY", X: 3, Y: 2})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "$10 keyboard", Type: "Coupon", Coupon: "10"})
 
 	// some products to list
-	productService.repository.createProductsTable()
-	productService.repository.insertProduct(Product{1, "laptop", "very fast", "1000.00"})
-	productService.repository.insertProduct(Product{2, "mouse", "much clicky", "10.00"})
-	productService.repository.insertProduct(Product{3, "monitor", "four kay", "100.00"})
-	productService.repository.insertProduct(Product{4, "usb", "type see", "5.00"})
-	productService.repository.insertProduct(Product{5, "keyboard", "mecha", "25.00"})
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{3, "monitor", "four kay", "100.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{4, "usb", "type see", "5.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{5, "keyboard", "mecha", "25.00", ""})
 
 	// actual items
-	productService.repository.createOfferingsTable()
-	productService.repository.insertOffering(Offering{ProductID: 2, DealID: 3, Active: true, ModifiedPrice: "1000.00"})
-	productService.repository.insertOffering(Offering{ProductID: 1, DealID: 3, Active: true, ModifiedPrice: "1000.00"})
-	productService.repository.insertOffering(Offering{ProductID: 3, DealID: 2, Active: true, ModifiedPrice: "NAN"})
-	productService.repository.insertOffering(Offering{ProductID: 4, DealID: 4, Active: true, ModifiedPrice: "NAN"})
-	productService.repository.insertOffering(Offering{ProductID: 5, DealID: 5, Active: true, ModifiedPrice: "NAN"})
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 3, Active: true, ModifiedPrice: "1000.00"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 3, Active: true, ModifiedPrice: "1000.00"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 3, DealID: 2, Active: true, ModifiedPrice: "NAN"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 4, DealID: 4, Active: true, ModifiedPrice: "NAN"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 5, DealID: 5, Active: true, ModifiedPrice: "NAN"})
 
 	t.Run("get empty cart", func(t *testing.T) {
 
@@ -53,7 +90,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -77,7 +114,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -92,17 +129,17 @@ func TestShoppingCart(t *testing.T) {
 
 	t.Run("Modify the quantity of a certain product", func(t *testing.T) {
 
-		body, _ := json.Marshal(Item{Product{3, "laptop", "very fast", "1000.00"}, 2})
+		body, _ := json.Marshal(Item{Product{3, "laptop", "very fast", "1000.00", ""}, 2})
 
 		req, _ := http.NewRequest(http.MethodPut, "/cart", bytes.NewBuffer(body))
 		req.Header.Set("Content-Type", jsonContentType)
 
-		items := []Item{{Product{3, "monitor", "four kay", "100.00"}, 2}}
+		items := []Item{{Product{3, "monitor", "four kay", "100.00", ""}, 2}}
 		want := ShoppingCart{Items: items, Total: "100"}
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -126,7 +163,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -141,7 +178,7 @@ func TestShoppingCart(t *testing.T) {
 
 	t.Run(" Trigger a buy x get y discount ", func(t *testing.T) {
 
-		body, _ := json.Marshal(Item{Product{4, "useb", "type see", "5.00"}, 7})
+		body, _ := json.Marshal(Item{Product{4, "useb", "type see", "5.00", ""}, 7})
 
 		req, _ := http.NewRequest(http.MethodPut, "/cart", bytes.NewBuffer(body))
 		req.Header.Set("Content-Type", jsonContentType)
@@ -152,7 +189,7 @@ func TestShoppingCart(t *testing.T) {
 		want := ShoppingCart{Items: items, Total: "125"}
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -177,7 +214,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -204,7 +241,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -232,7 +269,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -259,7 +296,7 @@ func TestShoppingCart(t *testing.T) {
 
 		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
@@ -270,219 +307,3128 @@ func TestShoppingCart(t *testing.T) {
 
 		assertShoppingCart(t, got, want)
 	})
+	t.Run("a coupon worth more than the product makes it free, not negative", func(t *testing.T) {
+		productService.repository.insertProduct(context.Background(), Product{6, "sticker", "shiny", "4.00", ""})
+		productService.repository.insertOffering(context.Background(), Offering{ProductID: 6, DealID: 5, Active: true, ModifiedPrice: "NAN"})
+		productService.cache.invalidate()
+
+		shopper := newBrowser(server)
+		shopper.addToCart(5)
+		shopper.addToCart(6)
+		body, _ := json.Marshal(Item{Product{ID: 6}, 2})
+		req, _ := http.NewRequest(http.MethodPut, "/cart", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		items := []Item{{Product{ID: 5, Name: "keyboard", Price: "25.00", Description: "mecha"}, 1},
+			{Product{ID: 6, Name: "sticker", Price: "4.00", Description: "shiny"}, 2}}
+		want := ShoppingCart{Items: items, Total: "15"}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		shopper.ServeHTTP(response, req)
+		_ = json.NewDecoder(response.Body).Decode(&got)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
+	t.Run("looking at a cart doesn't start one, adding to it does", func(t *testing.T) {
+		carts := func() (count int) {
+			productRepository.database.QueryRow(`SELECT count(*) FROM carts;`).Scan(&count)
+			return count
+		}
+		before := carts()
+
+		shopper := newBrowser(server)
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
+		response := httptest.NewRecorder()
+		shopper.ServeHTTP(response, req)
+
+		var got ShoppingCart
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, ShoppingCart{})
+		if carts() != before {
+			t.Errorf("expected no cart for a look at an empty cart, got %d", carts()-before)
+		}
 
+		shopper.addToCart(4)
+		shopper.addToCart(4)
+		if carts() != before+1 {
+			t.Errorf("expected the first item to start a cart, got %d", carts()-before)
+		}
+	})
+	t.Run("the session cookie is only sent over HTTPS when serving it", func(t *testing.T) {
+		tlsConfig := NewConfig()
+		tlsConfig.TLSCertFile, tlsConfig.TLSKeyFile = "store.crt", "store.key"
+		for _, config := range []*Config{config, tlsConfig} {
+			shopper := newBrowser(NewServer(config, productService))
+			shopper.addToCart(4)
+			if len(shopper.cookies) != 1 || shopper.cookies[0].Secure != config.TLS() {
+				t.Errorf("expected a cookie that's secure only with TLS, got %+v", shopper.cookies)
+			}
+		}
+	})
 }
 
-func TestOfferings(t *testing.T) {
+func TestCartConcurrency(t *testing.T) {
 	// scaffolding
 	config := NewConfig()
 	productRepository := setupTestDatabase(config)
 	productService := NewProductService(config, productRepository)
 	server := NewServer(config, productService)
+	handler := server.Handler()
+	customer := newBrowser(server)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1, Active: true})
+
+	cartRequest := func(method string, body interface{}) *http.Request {
+		encoded, _ := json.Marshal(body)
+		request, _ := http.NewRequest(method, "/cart", bytes.NewBuffer(encoded))
+		request.Header.Set("Content-Type", jsonContentType)
+		return request
+	}
+	getCart := func() ShoppingCart {
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, cartRequest(http.MethodGet, nil))
+		var got ShoppingCart
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		return got
+	}
+	laptop, mouse := Product{1, "laptop", "very fast", "1000.00", ""}, Product{2, "mouse", "much clicky", "10.00", ""}
 
-	// some deals to offer
-	productService.repository.createDealsTable()
-	productService.repository.insertDeal(Deal{Name: "Regular Price", Type: "Retail"})
-	productService.repository.insertDeal(Deal{Name: "Half Off", Type: "Percent", Percent: "50"})
-	productService.repository.insertDeal(Deal{Name: "Laptop Mouse Bundle", Type: "Bundle"})
-	productService.repository.insertDeal(Deal{Name: "Buy 3 USB get 1 free", Type: "BuyXGetYFree", X: 3, Y: 1})
-
-	// some products to list
-	productService.repository.createProductsTable()
-	productService.repository.insertProduct(Product{1, "laptop", "very fast", "1000.00"})
-	productService.repository.insertProduct(Product{2, "mouse", "much clicky", "10.00"})
-	productService.repository.insertProduct(Product{3, "monitor", "four kay", "100.00"})
-	productService.repository.insertProduct(Product{4, "usb", "type see", "1.00"})
+	t.Run("adding a product again adds to its line", func(t *testing.T) {
+		customer.addToCart(1)
+		customer.addToCart(1)
+		assertShoppingCart(t, getCart(), ShoppingCart{[]Item{{laptop, 2}}, "2000", nil})
+	})
 
-	// actual items
-	productService.repository.createOfferingsTable()
-	// regular priced mouse
-	productService.repository.insertOffering(Offering{ProductID: 2, DealID: 1})
-	// laptop with a mouse free
-	productService.repository.insertOffering(Offering{ProductID: 2, DealID: 3})
-	productService.repository.insertOffering(Offering{ProductID: 1, DealID: 3})
-	// 50% off monitors
-	productService.repository.insertOffering(Offering{ProductID: 3, DealID: 2})
+	t.Run("concurrent adds are all counted", func(t *testing.T) {
+		const laptops, mice = 30, 20
+		statuses := make(chan int, laptops+mice)
+		var wg sync.WaitGroup
+		for i := 0; i < laptops+mice; i++ {
+			product := Product{ID: 1}
+			if i%5 < 2 {
+				product = Product{ID: 2}
+			}
+			wg.Add(1)
+			go func(product Product) {
+				defer wg.Done()
+				// the browser isn't safe to share, every request carries the session it already has
+				request := cartRequest(http.MethodPost, product)
+				for _, cookie := range customer.cookies {
+					request.AddCookie(cookie)
+				}
+				response := httptest.NewRecorder()
+				handler.ServeHTTP(response, request)
+				statuses <- response.Code
+			}(product)
+		}
+		wg.Wait()
+		close(statuses)
 
-	t.Run("create new offering connecting usbs to the buy 3 USBs get 1 free offering", func(t *testing.T) {
+		for status := range statuses {
+			assertStatus(t, status, http.StatusOK)
+		}
+		assertShoppingCart(t, getCart(), ShoppingCart{[]Item{{laptop, 2 + laptops}, {mouse, mice}}, "32200", nil})
+	})
 
-		body, _ := json.Marshal(Offering{ProductID: 4, DealID: 4})
-		req, _ := http.NewRequest(http.MethodPost, "/offerings", bytes.NewBuffer(body))
-		req.Header.Set("Content-Type", jsonContentType)
+	t.Run("a quantity of 0 removes the product", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, cartRequest(http.MethodPut, Item{Product{ID: 2}, 0}))
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, getCart(), ShoppingCart{[]Item{{laptop, 32}}, "32000", nil})
+	})
 
-		want := ""
-		var got string
+	t.Run("a negative quantity is refused", func(t *testing.T) {
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, cartRequest(http.MethodPut, Item{Product{ID: 1}, -1}))
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
 
-		assertStatus(t, response.Code, http.StatusCreated)
+	t.Run("carts from before have their lines merged", func(t *testing.T) {
+		ctx := context.Background()
+		statements := []string{
+			`DROP TABLE cart;`,
+			`CREATE TABLE cart (id INTEGER PRIMARY KEY, cart_id INTEGER NOT NULL, product_id INTEGER NOT NULL, quantity INTEGER NOT NULL);`,
+			`INSERT INTO cart (id, cart_id, product_id, quantity) VALUES (1, 1, 1, 1), (2, 1, 2, 1), (3, 1, 1, 2), (4, 2, 1, 1);`,
+		}
+		for _, statement := range statements {
+			if _, err := productRepository.database.Exec(statement); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mergeCartLines(ctx, productRepository); err != nil {
+			t.Fatalf("unable to merge the cart lines, '%v'", err)
+		}
 
-		assertResponseBody(t, got, want)
+		items, _ := productRepository.listCart(ctx, 1)
+		if !reflect.DeepEqual(items, []Item{{laptop, 3}, {mouse, 1}}) {
+			t.Errorf("got %v", items)
+		}
+		if err := productRepository.addToCart(ctx, 2, laptop); err != nil {
+			t.Fatalf("unable to add to the cart, '%v'", err)
+		}
+		items, _ = productRepository.listCart(ctx, 2)
+		if !reflect.DeepEqual(items, []Item{{laptop, 2}}) {
+			t.Errorf("got %v", items)
+		}
 	})
-
 }
 
-func TestDeals(t *testing.T) {
+func TestCartPromotions(t *testing.T) {
 	// scaffolding
 	config := NewConfig()
 	productRepository := setupTestDatabase(config)
 	productService := NewProductService(config, productRepository)
 	server := NewServer(config, productService)
+	customer := newBrowser(server)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+
+	// item-level and cart-level deals
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "$50 off orders over $500", Type: "CartFlat", Coupon: "50", Threshold: "500"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "10% off 3+ accessories", Type: "CartPercent", Percent: "0.10", MinQuantity: 3})
+
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{3, "usb", "type see", "5.00", ""})
+
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 3, DealID: 1, Active: true})
+	// mice and usbs are accessories
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 3, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 3, DealID: 3, Active: true})
+
+	usb := Product{ID: 3, Name: "usb", Description: "type see", Price: "5.00"}
+	laptop := Product{ID: 1, Name: "laptop", Description: "very fast", Price: "1000.00"}
+	accessories := Adjustment{DealID: 3, DealName: "10% off 3+ accessories", Type: "CartPercent", MinQuantity: 3, Discount: "1.5"}
+	overFiveHundred := Adjustment{DealID: 2, DealName: "$50 off orders over $500", Type: "CartFlat", Threshold: "500", Discount: "50"}
+
+	t.Run("a cart under every threshold pays full price", func(t *testing.T) {
 
-	// database reset seed
-	productService.repository.createDealsTable()
+		body, _ := json.Marshal(Product{ID: 3})
+		req, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
 
-	productService.repository.insertDeal(Deal{Name: "Regular Price", Type: "Retail"})
-	productService.repository.insertDeal(Deal{Name: "Half Off", Type: "Percent", Percent: "50"})
+		want := ShoppingCart{Items: []Item{{usb, 1}}, Total: "5"}
 
-	t.Run("get the list of deals", func(t *testing.T) {
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
 
-		request, _ := http.NewRequest(http.MethodGet, "/deals", nil)
-		want := []Deal{{ID: 1, Name: "Regular Price", Type: "Retail"}, {ID: 2, Name: "Half Off", Type: "Percent", Percent: "50"}}
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
 
+	t.Run("buying 3 accessories triggers the percent promotion", func(t *testing.T) {
+
+		body, _ := json.Marshal(Item{usb, 3})
+		req, _ := http.NewRequest(http.MethodPut, "/cart", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ShoppingCart{Items: []Item{{usb, 3}}, Total: "13.5", Breakdown: []Adjustment{accessories}}
+
+		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, request)
-		var got []Deal
+		customer.ServeHTTP(response, req)
+
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
-			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
 		}
+
 		assertStatus(t, response.Code, http.StatusOK)
-		assertDeals(t, got, want)
+		assertShoppingCart(t, got, want)
+	})
+
+	t.Run("going over the threshold stacks the flat promotion", func(t *testing.T) {
+
+		body, _ := json.Marshal(Product{ID: 1})
+		req, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ShoppingCart{Items: []Item{{usb, 3}, {laptop, 1}}, Total: "963.5",
+			Breakdown: []Adjustment{overFiveHundred, accessories}}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
 
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
 	})
-	t.Run("inserts a new deal", func(t *testing.T) {
 
-		body, _ := json.Marshal(Deal{Name: "Half off any regular price item", Type: "Percent", Percent: "50"})
-		req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+	t.Run("a better exclusive promotion replaces the stacked ones", func(t *testing.T) {
+
+		productService.repository.createAuditLogTable(context.Background())
+		productService.newDeal(context.Background(), Deal{Name: "$100 off orders over $1000", Type: "CartFlat", Coupon: "100", Threshold: "1000", Exclusive: true})
+
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
 		req.Header.Set("Content-Type", jsonContentType)
 
-		want := ""
-		var got string
+		want := ShoppingCart{Items: []Item{{usb, 3}, {laptop, 1}}, Total: "915",
+			Breakdown: []Adjustment{{DealID: 4, DealName: "$100 off orders over $1000", Type: "CartFlat", Threshold: "1000", Discount: "100"}}}
+
+		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, req)
+		customer.ServeHTTP(response, req)
 
-		assertStatus(t, response.Code, http.StatusCreated)
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
 
-		assertResponseBody(t, got, want)
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
+
+	t.Run("lines under an exclusive item deal don't count towards promotions", func(t *testing.T) {
+
+		productService.newDeal(context.Background(), Deal{Name: "Laptop clearance", Type: "Percent", Percent: "0.90", Exclusive: true})
+		productService.updateOffering(context.Background(), Offering{ID: 1, ProductID: 1, DealID: 5, Active: true}, anyVersion)
 
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
+		req.Header.Set("Content-Type", jsonContentType)
+
+		// the laptop's 900 is too far under any threshold without it, the usbs still get the accessories promotion
+		want := ShoppingCart{Items: []Item{{usb, 3}, {laptop, 1}}, Total: "913.5", Breakdown: []Adjustment{accessories}}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
 	})
 }
 
-func TestProducts(t *testing.T) {
+func TestTieredPricing(t *testing.T) {
 	// scaffolding
 	config := NewConfig()
 	productRepository := setupTestDatabase(config)
 	productService := NewProductService(config, productRepository)
 	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	customer := newBrowser(server)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	productService.repository.insertProduct(context.Background(), Product{1, "usb", "type see", "5.00", ""})
+
+	t.Run("rejects overlapping tiers", func(t *testing.T) {
+
+		body, _ := json.Marshal(Deal{Name: "Overlapping usb tiers", Type: "Tiered", Tiers: []Tier{
+			{MinQuantity: 1, MaxQuantity: 10, Price: "5.00"},
+			{MinQuantity: 10, Price: "4.50"},
+		}})
+		req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
 
-	// database reset seed
-	productService.repository.createProductsTable()
-	productService.repository.insertProduct(Product{1, "laptop", "very fast", "1000.00"})
-	productService.repository.insertProduct(Product{2, "mouse", "much clicky", "10.00"})
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
 
-	t.Run("get the list of products", func(t *testing.T) {
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
 
-		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
-		want := []Product{{1, "laptop", "very fast", "1000.00"}, {2, "mouse", "much clicky", "10.00"}}
+	t.Run("creates a tiered deal", func(t *testing.T) {
+
+		body, _ := json.Marshal(Deal{Name: "Bulk usb", Type: "Tiered", Tiers: []Tier{
+			{MinQuantity: 50, Price: "4.00"},
+			{MinQuantity: 1, MaxQuantity: 9, Price: "5.00"},
+			{MinQuantity: 10, MaxQuantity: 49, Price: "4.50"},
+		}})
+		req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
 
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, request)
-		var got []Product
-		err := json.NewDecoder(response.Body).Decode(&got)
+		merchandiser.ServeHTTP(response, req)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+		customer.addToCart(1)
+	})
+
+	usb := Product{ID: 1, Name: "usb", Description: "type see", Price: "5.00"}
+	cases := []struct {
+		quantity int
+		total    string
+	}{
+		{9, "45"},
+		{10, "45"},
+		{49, "220.5"},
+		{100, "400"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d usbs cost %s", c.quantity, c.total), func(t *testing.T) {
+
+			body, _ := json.Marshal(Item{usb, c.quantity})
+			req, _ := http.NewRequest(http.MethodPut, "/cart", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", jsonContentType)
+
+			want := ShoppingCart{Items: []Item{{usb, c.quantity}}, Total: c.total}
+
+			var got ShoppingCart
+			response := httptest.NewRecorder()
+			customer.ServeHTTP(response, req)
+
+			err := json.NewDecoder(response.Body).Decode(&got)
+			if err != nil {
+				t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+			}
+
+			assertStatus(t, response.Code, http.StatusOK)
+			assertShoppingCart(t, got, want)
+		})
+	}
+}
+
+func TestPricingQueries(t *testing.T) {
+	small, smallCart := bundleCart(1)
+	large, largeCart := bundleCart(25)
+
+	var smallTotal, largeTotal string
+	var smallErr, largeErr error
+	priceCart := func(productService *ProductService, cartID int) (string, error) {
+		items, err := productService.listCartItems(context.Background(), cartID)
 		if err != nil {
-			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+			return "", err
 		}
-		assertStatus(t, response.Code, http.StatusOK)
-		assertProducts(t, got, want)
+		total, _, err := productService.calculateTotalPrice(context.Background(), items)
+		return total, err
+	}
+	// the first time loads the catalog into the cache
+	priceCart(small, smallCart)
+	priceCart(large, largeCart)
+	smallQueries := countQueries(func() {
+		smallTotal, smallErr = priceCart(small, smallCart)
+	})
+	largeQueries := countQueries(func() {
+		largeTotal, largeErr = priceCart(large, largeCart)
+	})
+
+	if smallErr != nil || largeErr != nil {
+		t.Fatalf("unable to price the carts, '%v' '%v'", smallErr, largeErr)
+	}
+	assertResponseBody(t, smallTotal, "8")
+	assertResponseBody(t, largeTotal, "200")
+	if smallQueries != 1 || largeQueries != 1 {
+		t.Errorf("expected only the cart lines to be queried for 1 and 25 bundles, got %d and %d queries", smallQueries, largeQueries)
+	}
 
+	t.Run("a catalog write is seen by the next cart", func(t *testing.T) {
+		large.repository.createAuditLogTable(context.Background())
+		if err := large.newDeal(context.Background(), Deal{Name: "Ten Off", Type: CartFlat, Coupon: "10", Threshold: "0"}); err != nil {
+			t.Fatalf("unable to add a deal, '%v'", err)
+		}
+		total, err := priceCart(large, largeCart)
+		if err != nil {
+			t.Fatalf("unable to price the cart, '%v'", err)
+		}
+		assertResponseBody(t, total, "190")
 	})
+}
 
-	t.Run("inserts a new product", func(t *testing.T) {
+func BenchmarkCartPricing(b *testing.B) {
+	for _, bundles := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("%d bundles", bundles), func(b *testing.B) {
+			productService, cartID := bundleCart(bundles)
+			items, _ := productService.listCartItems(context.Background(), cartID)
+			productService.calculateTotalPrice(context.Background(), items)
+			queries := countQueries(func() {
+				items, _ := productService.listCartItems(context.Background(), cartID)
+				productService.calculateTotalPrice(context.Background(), items)
+			})
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				items, err := productService.listCartItems(context.Background(), cartID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := productService.calculateTotalPrice(context.Background(), items); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(queries), "queries/op")
+		})
+	}
+}
 
-		request := newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00")
-		want := ""
-		var got string
-		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, request)
+// bundleCart is a cart holding both products of n two product bundles, every bundle comes to 8
+func bundleCart(n int) (*ProductService, int) {
+	ctx := context.Background()
+	config := NewConfig()
+	productService := NewProductService(config, setupTestDatabase(config))
+	productService.repository.createUsersTable(ctx)
+	productService.repository.createCartTable(ctx)
+	productService.repository.createProductsTable(ctx)
+	productService.repository.createDealsTable(ctx)
+	productService.repository.createOfferingsTable(ctx)
+
+	cartID, err := productService.repository.newCart(ctx, 0)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	for bundle := 1; bundle <= n; bundle++ {
+		productService.repository.insertDeal(ctx, Deal{Name: fmt.Sprintf("Bundle %d", bundle), Type: Bundle})
+		for _, productID := range []int{2*bundle - 1, 2 * bundle} {
+			productService.repository.insertProduct(ctx, Product{Name: fmt.Sprintf("part %d", productID), Price: "10.00"})
+			productService.repository.insertOffering(ctx, Offering{ProductID: productID, DealID: bundle, ModifiedPrice: "8.00", Active: true})
+			productService.repository.addToCart(ctx, cartID, Product{ID: productID})
+		}
+	}
+	return productService, cartID
+}
 
-		assertStatus(t, response.Code, http.StatusCreated)
+// countQueries is how many repository queries fn made, counted from their spans
+func countQueries(fn func()) int {
+	spans := tracetest.NewSpanRecorder()
+	defer func(previous trace.Tracer) { tracer = previous }(tracer)
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("store")
 
-		assertResponseBody(t, got, want)
+	fn()
 
-	})
+	queries := 0
+	for _, span := range spans.Ended() {
+		if span.SpanKind() == trace.SpanKindClient {
+			queries++
+		}
+	}
+	return queries
+}
 
-	t.Run("update a product name and description", func(t *testing.T) {
+func TestMixAndMatch(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	customer := newBrowser(server)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
 
-		request := newProductRequest(http.MethodPut, 1, "laptop", "older", "85.00")
-		want := ""
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
 
-		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, request)
+	productService.repository.insertProduct(context.Background(), Product{1, "hdmi", "eight kay", "10.00", "cables"})
+	productService.repository.insertProduct(context.Background(), Product{2, "usb cable", "type see", "6.00", "cables"})
+	productService.repository.insertProduct(context.Background(), Product{3, "aux cable", "analog", "3.00", "cables"})
 
-		var got string
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 3, DealID: 1, Active: true})
 
-		assertStatus(t, response.Code, http.StatusNoContent)
-		assertResponseBody(t, got, want)
+	hdmi := Product{1, "hdmi", "eight kay", "10.00", "cables"}
+	usb := Product{2, "usb cable", "type see", "6.00", "cables"}
+	aux := Product{3, "aux cable", "analog", "3.00", "cables"}
 
-	})
+	t.Run("only BuyXGetY deals can span a category", func(t *testing.T) {
 
-	t.Run("delete the a product (id = 2)", func(t *testing.T) {
-		request := newProductRequest(http.MethodDelete, 2, "monitor", "fourkay", "100.00")
-		want := ""
+		body, _ := json.Marshal(Deal{Name: "Half off cables", Type: "Percent", Percent: "0.5", Category: "cables"})
+		req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
 
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, request)
+		merchandiser.ServeHTTP(response, req)
 
-		var got string
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
 
-		assertStatus(t, response.Code, http.StatusOK)
-		assertResponseBody(t, got, want)
+	t.Run("creates a deal across the cables category", func(t *testing.T) {
+
+		body, _ := json.Marshal(Deal{Name: "Buy any 2 cables get the cheapest free", Type: "BuyXGetY", X: 2, Y: 1, Category: "cables"})
+		req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
 
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		customer.addToCart(1)
+		customer.addToCart(2)
 	})
 
-	t.Run("veirfy the database state", func(t *testing.T) {
+	t.Run("two different cables don't meet the threshold", func(t *testing.T) {
 
-		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
-		want := []Product{{1, "laptop", "older", "85.00"}, {3, "monitor", "fourkay", "100.00"}}
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
+
+		want := ShoppingCart{Items: []Item{{hdmi, 1}, {usb, 1}}, Total: "16"}
 
+		var got ShoppingCart
 		response := httptest.NewRecorder()
-		server.Handler().ServeHTTP(response, request)
-		var got []Product
+		customer.ServeHTTP(response, req)
+
 		err := json.NewDecoder(response.Body).Decode(&got)
 		if err != nil {
-			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
 		}
+
 		assertStatus(t, response.Code, http.StatusOK)
-		assertProducts(t, got, want)
+		assertShoppingCart(t, got, want)
 	})
 
-}
-
-func setupTestDatabase(config *Config) (repository *ProductRepository) {
-	// Helper method for resetting the database
-	os.Remove("store.db")
-	file, err := os.Create("store.db")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	file.Close()
+	t.Run("a third cable makes the cheapest one free", func(t *testing.T) {
 
-	db, err := ConnectDatabase(config)
+		body, _ := json.Marshal(Product{ID: 3})
+		req, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ShoppingCart{Items: []Item{{hdmi, 1}, {usb, 1}, {aux, 1}}, Total: "16",
+			Breakdown: []Adjustment{{DealID: 2, DealName: "Buy any 2 cables get the cheapest free", Type: "BuyXGetY", ProductID: 3, Quantity: 1, Discount: "3"}}}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
+
+	t.Run("more units pool into more free cables", func(t *testing.T) {
+
+		body, _ := json.Marshal(Item{aux, 4})
+		req, _ := http.NewRequest(http.MethodPut, "/cart", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ShoppingCart{Items: []Item{{hdmi, 1}, {usb, 1}, {aux, 4}}, Total: "22",
+			Breakdown: []Adjustment{{DealID: 2, DealName: "Buy any 2 cables get the cheapest free", Type: "BuyXGetY", ProductID: 3, Quantity: 2, Discount: "6"}}}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
+
+	t.Run("a category deal that's switched off isn't applied", func(t *testing.T) {
+		off := false
+		body, _ := json.Marshal(Simulation{
+			Items: []Item{{hdmi, 1}, {usb, 1}, {aux, 1}},
+			Deals: []Deal{{ID: 2, Name: "Buy any 2 cables get the cheapest free", Type: "BuyXGetY", X: 2, Y: 1, Category: "cables", Active: &off}},
+		})
+		req, _ := http.NewRequest(http.MethodPost, "/pricing/simulate", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		var simulated ShoppingCart
+		json.NewDecoder(response.Body).Decode(&simulated)
+		assertStatus(t, response.Code, http.StatusOK)
+		if simulated.Total != "19" || len(simulated.Breakdown) != 0 {
+			t.Errorf("expected no cable free in the simulation, got %v", simulated)
+		}
+
+		deal, _, err := productService.repository.getDeal(context.Background(), 2)
+		if err != nil {
+			t.Fatalf("unable to read the deal, '%v'", err)
+		}
+		deal.Active = dealActive(false)
+		if err := productService.repository.updateDeal(context.Background(), deal, anyVersion); err != nil {
+			t.Fatalf("unable to switch the deal off, '%v'", err)
+		}
+		productService.cache.invalidate()
+
+		req, _ = http.NewRequest(http.MethodGet, "/cart", nil)
+		response = httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		var got ShoppingCart
+		json.NewDecoder(response.Body).Decode(&got)
+		assertShoppingCart(t, got, ShoppingCart{Items: []Item{{hdmi, 1}, {usb, 1}, {aux, 4}}, Total: "28"})
+
+		deal, _, _ = productService.getDeal(context.Background(), 2)
+		if deal.isActive() {
+			t.Errorf("expected the deal to read back switched off, got %+v", deal)
+		}
+	})
+}
+
+func TestPricingSimulation(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	customer := newBrowser(server)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "keyboard", "mecha", "25.00", ""})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1, Active: true})
+	customer.addToCart(1)
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	laptop := Product{1, "laptop", "very fast", "1000.00", ""}
+	keyboard := Product{2, "keyboard", "mecha", "25.00", ""}
+
+	t.Run("prices a hypothetical deal in place of the retail offering", func(t *testing.T) {
+
+		body, _ := json.Marshal(Simulation{
+			Items: []Item{{Product{ID: 2}, 2}},
+			Deals: []Deal{{ID: 2, Name: "Half off keyboards", Type: "Percent", Percent: "0.5"}},
+			Offerings: []Offering{
+				{ProductID: 2, DealID: 1, Active: false},
+				{ProductID: 2, DealID: 2, Active: true},
+			},
+		})
+		req, _ := http.NewRequest(http.MethodPost, "/pricing/simulate", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ShoppingCart{Items: []Item{{keyboard, 2}}, Total: "25"}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
+
+	t.Run("shows a hypothetical cart promotion in the breakdown", func(t *testing.T) {
+
+		body, _ := json.Marshal(Simulation{
+			Items: []Item{{Product{ID: 1}, 1}},
+			Deals: []Deal{{ID: 2, Name: "$50 off orders over $500", Type: "CartFlat", Coupon: "50", Threshold: "500"}},
+		})
+		req, _ := http.NewRequest(http.MethodPost, "/pricing/simulate", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ShoppingCart{Items: []Item{{laptop, 1}}, Total: "950",
+			Breakdown: []Adjustment{{DealID: 2, DealName: "$50 off orders over $500", Type: "CartFlat", Threshold: "500", Discount: "50"}}}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+	})
+
+	t.Run("rejects items that aren't in the catalog", func(t *testing.T) {
+
+		body, _ := json.Marshal(Simulation{Items: []Item{{Product{ID: 42}, 1}}})
+		req, _ := http.NewRequest(http.MethodPost, "/pricing/simulate", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("only merchandisers and admins simulate", func(t *testing.T) {
+		body, _ := json.Marshal(Simulation{Items: []Item{{Product{ID: 1}, 1}}})
+		signedIn := signIn(t, server, "ada@example.com", RoleCustomer)
+		for c, status := range map[*browser]int{customer: http.StatusUnauthorized, signedIn: http.StatusForbidden} {
+			req, _ := http.NewRequest(http.MethodPost, "/pricing/simulate", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", jsonContentType)
+			response := httptest.NewRecorder()
+			c.ServeHTTP(response, req)
+
+			assertStatus(t, response.Code, status)
+		}
+	})
+
+	t.Run("leaves the cart and the deals alone", func(t *testing.T) {
+
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
+
+		want := ShoppingCart{Items: []Item{{laptop, 1}}, Total: "1000"}
+
+		var got ShoppingCart
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, want)
+
+		if deals, _ := productService.listDeals(context.Background()); len(deals) != 1 {
+			t.Errorf("simulation saved deals, got %d want 1", len(deals))
+		}
+	})
+}
+
+func TestAccounts(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	customer := newBrowser(server)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1, Active: true})
+
+	laptop := Product{1, "laptop", "very fast", "1000.00", ""}
+	mouse := Product{2, "mouse", "much clicky", "10.00", ""}
+
+	authenticate := func(path string, credentials Credentials) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(credentials)
+		req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+		return response
+	}
+
+	getCart := func(c *browser) ShoppingCart {
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
+		response := httptest.NewRecorder()
+		c.ServeHTTP(response, req)
+
+		var got ShoppingCart
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into ShoppingCart, '%v'", response.Body, err)
+		}
+		assertStatus(t, response.Code, http.StatusOK)
+		return got
+	}
+
+	t.Run("rejects a password that is too short", func(t *testing.T) {
+		response := authenticate("/auth/register", Credentials{"ada@example.com", "short"})
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("registering keeps the guest cart", func(t *testing.T) {
+		customer.addToCart(1)
+
+		response := authenticate("/auth/register", Credentials{"Ada@Example.com", "correct horse"})
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		var user User
+		err := json.NewDecoder(response.Body).Decode(&user)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into User, '%v'", response.Body, err)
+		}
+		if user.ID != 1 || user.Email != "ada@example.com" {
+			t.Errorf("got %v want the new account", user)
+		}
+
+		assertShoppingCart(t, getCart(customer), ShoppingCart{Items: []Item{{laptop, 1}}, Total: "1000"})
+	})
+
+	t.Run("other shoppers don't see the customer's cart", func(t *testing.T) {
+		assertShoppingCart(t, getCart(newBrowser(server)), ShoppingCart{})
+	})
+
+	t.Run("an email can only be registered once", func(t *testing.T) {
+		response := authenticate("/auth/register", Credentials{"ada@example.com", "another password"})
+		assertStatus(t, response.Code, http.StatusConflict)
+	})
+
+	t.Run("logging out starts an empty guest cart", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "/auth/logout", nil)
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		assertStatus(t, response.Code, http.StatusNoContent)
+		assertShoppingCart(t, getCart(customer), ShoppingCart{})
+	})
+
+	t.Run("rejects the wrong password", func(t *testing.T) {
+		response := authenticate("/auth/login", Credentials{"ada@example.com", "wrong password"})
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("logging in merges the guest cart into the account cart", func(t *testing.T) {
+		customer.addToCart(1)
+		customer.addToCart(2)
+
+		response := authenticate("/auth/login", Credentials{"ada@example.com", "correct horse"})
+		assertStatus(t, response.Code, http.StatusOK)
+
+		assertShoppingCart(t, getCart(customer), ShoppingCart{Items: []Item{{laptop, 2}, {mouse, 1}}, Total: "2010"})
+	})
+
+	t.Run("store create-admin makes the first admin", func(t *testing.T) {
+		dir, _ := ioutil.TempDir("", "store-admin")
+		defer os.RemoveAll(dir)
+		database := filepath.Join(dir, "store.db")
+		defer func(previous *Logger) { logger = previous }(logger)
+
+		var out bytes.Buffer
+		if err := createAdminCommand([]string{"-database", database, "Grace@Example.com"}, strings.NewReader("correct horse\n"), &out); err != nil {
+			t.Fatalf("unable to create an admin, '%v'", err)
+		}
+		if out.String() != "grace@example.com is an admin, account 1\n" {
+			t.Errorf("got %q", out.String())
+		}
+
+		db, _ := ConnectDatabase(&Config{DatabasePath: database})
+		defer db.Close()
+		repository := NewProductRepository(db, DriverSQLite)
+		repository.insertUser(context.Background(), User{Email: "ada@example.com", PasswordHash: "x"})
+		// an account that's already there only needs promoting, so no password
+		if err := createAdminCommand([]string{"-database", database, "ada@example.com"}, strings.NewReader(""), &out); err != nil {
+			t.Fatalf("unable to promote an account, '%v'", err)
+		}
+		for _, email := range []string{"grace@example.com", "ada@example.com"} {
+			user, _ := repository.getUserByEmail(context.Background(), email)
+			if user.Role != RoleAdmin {
+				t.Errorf("expected %s to be an admin, got %q", email, user.Role)
+			}
+		}
+		grace, _ := repository.getUserByEmail(context.Background(), "grace@example.com")
+		if bcrypt.CompareHashAndPassword([]byte(grace.PasswordHash), []byte("correct horse")) != nil {
+			t.Errorf("expected the password from stdin")
+		}
+
+		if err := createAdminCommand([]string{"-database", database, "new@example.com"}, strings.NewReader(""), &out); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("expected a new account without a password to be refused, got %v", err)
+		}
+	})
+}
+
+func TestAuthorization(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+
+	guest := newBrowser(server)
+	shopper := signIn(t, server, "shopper@example.com", RoleCustomer)
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+	admin := signIn(t, server, "admin@example.com", RoleAdmin)
+
+	t.Run("anyone can list products", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		response := httptest.NewRecorder()
+		guest.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("guests have to log in to change the catalog", func(t *testing.T) {
+		request := newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00")
+		response := httptest.NewRecorder()
+		guest.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("customers can't change the catalog", func(t *testing.T) {
+		request := newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00")
+		response := httptest.NewRecorder()
+		shopper.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("merchandisers can change the catalog but not accounts", func(t *testing.T) {
+		request := newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00")
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		body, _ := json.Marshal(User{ID: 2, Role: RoleAdmin})
+		request, _ = http.NewRequest(http.MethodPut, "/admin/users", bytes.NewBuffer(body))
+		response = httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("admins can promote a customer", func(t *testing.T) {
+		body, _ := json.Marshal(User{ID: 1, Role: RoleMerchandiser})
+		request, _ := http.NewRequest(http.MethodPut, "/admin/users", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNoContent)
+
+		request = newProductRequest(http.MethodPost, 0, "keyboard", "mecha", "25.00")
+		response = httptest.NewRecorder()
+		shopper.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+	})
+
+	t.Run("admins can only hand out known roles", func(t *testing.T) {
+		body, _ := json.Marshal(User{ID: 1, Role: "owner"})
+		request, _ := http.NewRequest(http.MethodPut, "/admin/users", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createAPIKeysTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+
+	admin := signIn(t, server, "admin@example.com", RoleAdmin)
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+	pos := newBrowser(server)
+
+	var issued APIKey
+
+	withKey := func(request *http.Request, key string) *http.Request {
+		request.Header.Set("Authorization", "Bearer "+key)
+		return request
+	}
+
+	t.Run("only admins can issue keys", func(t *testing.T) {
+		body, _ := json.Marshal(APIKey{Name: "inventory sync", Scopes: []string{"products:write"}})
+		request, _ := http.NewRequest(http.MethodPost, "/admin/api-keys", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("issuing a key needs known scopes", func(t *testing.T) {
+		body, _ := json.Marshal(APIKey{Name: "inventory sync", Scopes: []string{"products:delete"}})
+		request, _ := http.NewRequest(http.MethodPost, "/admin/api-keys", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("an admin issues a key and sees it once", func(t *testing.T) {
+		body, _ := json.Marshal(APIKey{Name: "inventory sync", Scopes: []string{"products:write", "deals:read"}})
+		request, _ := http.NewRequest(http.MethodPost, "/admin/api-keys", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+		_ = json.NewDecoder(response.Body).Decode(&issued)
+		if issued.Key == "" || issued.Prefix == "" || issued.Key[:len(issued.Prefix)] != issued.Prefix {
+			t.Fatalf("expected a key starting with its prefix, got %+v", issued)
+		}
+
+		stored, _ := productService.listAPIKeys(context.Background())
+		if len(stored) != 1 || stored[0].KeyHash == issued.Key || stored[0].KeyHash != hashAPIKey(issued.Key) {
+			t.Errorf("expected only the hash of the key to be stored, got %+v", stored)
+		}
+	})
+
+	t.Run("the key can write the resources it's scoped to", func(t *testing.T) {
+		request := withKey(newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00"), issued.Key)
+		response := httptest.NewRecorder()
+		pos.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+	})
+
+	t.Run("the key can only read what it's scoped to read", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/deals", nil)
+		response := httptest.NewRecorder()
+		pos.ServeHTTP(response, withKey(request, issued.Key))
+
+		assertStatus(t, response.Code, http.StatusOK)
+
+		body, _ := json.Marshal(Deal{Name: "sale", Type: Percent, Percent: "0.5"})
+		request, _ = http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		response = httptest.NewRecorder()
+		pos.ServeHTTP(response, withKey(request, issued.Key))
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+
+		body, _ = json.Marshal(APIKey{Name: "another", Scopes: []string{"deals:write"}})
+		request, _ = http.NewRequest(http.MethodPost, "/admin/api-keys", bytes.NewBuffer(body))
+		response = httptest.NewRecorder()
+		pos.ServeHTTP(response, withKey(request, issued.Key))
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("using a key records when it was last used", func(t *testing.T) {
+		keys, _ := productService.listAPIKeys(context.Background())
+		if keys[0].LastUsedAt == nil {
+			t.Errorf("expected a last used time, got %+v", keys[0])
+		}
+	})
+
+	t.Run("unknown keys are turned away", func(t *testing.T) {
+		request := withKey(newProductRequest(http.MethodPost, 0, "keyboard", "mecha", "25.00"), apiKeyPrefix+"0000")
+		response := httptest.NewRecorder()
+		pos.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+	})
+
+	t.Run("a revoked key stops working", func(t *testing.T) {
+		body, _ := json.Marshal(APIKey{ID: issued.ID})
+		request, _ := http.NewRequest(http.MethodDelete, "/admin/api-keys", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNoContent)
+
+		request = withKey(newProductRequest(http.MethodPost, 0, "keyboard", "mecha", "25.00"), issued.Key)
+		response = httptest.NewRecorder()
+		pos.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnauthorized)
+
+		request, _ = http.NewRequest(http.MethodDelete, "/admin/api-keys", bytes.NewBuffer(body))
+		response = httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+	})
+}
+
+func TestFeatureFlags(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+
+	admin := signIn(t, server, "admin@example.com", RoleAdmin)
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+	customer := newBrowser(server)
+
+	setFlag := func(t *testing.T, flag FeatureFlag, want int) {
+		t.Helper()
+		body, _ := json.Marshal(flag)
+		request, _ := http.NewRequest(http.MethodPut, "/admin/flags", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+		assertStatus(t, response.Code, want)
+	}
+
+	t.Run("admins can list the flags", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/admin/flags", nil)
+		response := httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+
+		var got []FeatureFlag
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertStatus(t, response.Code, http.StatusOK)
+		if !reflect.DeepEqual(got, NewFeatureFlags(defaultFlags()).list()) {
+			t.Errorf("got %v, want the default flags", got)
+		}
+	})
+
+	t.Run("only admins can flip flags", func(t *testing.T) {
+		body, _ := json.Marshal(FeatureFlag{Name: FlagCheckout})
+		request, _ := http.NewRequest(http.MethodPut, "/admin/flags", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("flags have to exist and rollouts have to be a percent", func(t *testing.T) {
+		setFlag(t, FeatureFlag{Name: "checkout.v2", Enabled: true, Rollout: 100}, http.StatusNotFound)
+		setFlag(t, FeatureFlag{Name: FlagCheckout, Enabled: true, Rollout: 150}, http.StatusBadRequest)
+	})
+
+	t.Run("turning checkout off stops carts changing", func(t *testing.T) {
+		setFlag(t, FeatureFlag{Name: FlagCheckout}, http.StatusNoContent)
+
+		body, _ := json.Marshal(Product{ID: 1})
+		request, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+
+		setFlag(t, FeatureFlag{Name: FlagCheckout, Enabled: true, Rollout: 100}, http.StatusNoContent)
+
+		request, _ = http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		response = httptest.NewRecorder()
+		customer.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("bundles can be turned off on their own", func(t *testing.T) {
+		setFlag(t, FeatureFlag{Name: FlagDealsBundles}, http.StatusNoContent)
+		defer setFlag(t, FeatureFlag{Name: FlagDealsBundles, Enabled: true, Rollout: 100}, http.StatusNoContent)
+
+		body, _ := json.Marshal(Deal{Name: "Desk Setup", Type: Bundle})
+		request, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+
+		body, _ = json.Marshal(Deal{Name: "Half Off", Type: Percent, Percent: "0.5"})
+		request, _ = http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		response = httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusCreated)
+	})
+
+	t.Run("turning catalog reads off hides the catalog", func(t *testing.T) {
+		setFlag(t, FeatureFlag{Name: FlagCatalogReads}, http.StatusNoContent)
+		defer setFlag(t, FeatureFlag{Name: FlagCatalogReads, Enabled: true, Rollout: 100}, http.StatusNoContent)
+
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Body.String(), "[]")
+	})
+
+	t.Run("a rollout of 0 reaches nobody, leaving it out reaches everyone", func(t *testing.T) {
+		setFlag(t, FeatureFlag{Name: FlagCheckout, Enabled: true, Rollout: 0}, http.StatusNoContent)
+		body, _ := json.Marshal(Product{ID: 1})
+		request, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+
+		request, _ = http.NewRequest(http.MethodPut, "/admin/flags", strings.NewReader(`{"name": "checkout", "enabled": true}`))
+		response = httptest.NewRecorder()
+		admin.ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusNoContent)
+		if flags := productService.listFlags(context.Background()); !reflect.DeepEqual(flags, NewFeatureFlags(defaultFlags()).list()) {
+			t.Errorf("expected checkout back at a full rollout, got %v", flags)
+		}
+
+		for i := 0; i < 100; i++ {
+			if (FeatureFlag{Name: FlagCheckout, Enabled: true}).on(fmt.Sprintf("session-%d", i)) {
+				t.Fatalf("expected a rollout of 0 to leave out session-%d", i)
+			}
+		}
+	})
+
+	t.Run("a rollout reaches some of the sessions and always the same ones", func(t *testing.T) {
+		flag := FeatureFlag{Name: FlagCheckout, Enabled: true, Rollout: 25}
+		on := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("session-%d", i)
+			if flag.on(key) {
+				on++
+			}
+			if flag.on(key) != flag.on(key) {
+				t.Fatalf("rollout changed its mind about %s", key)
+			}
+		}
+		if on < 150 || on > 350 {
+			t.Errorf("expected about a quarter of sessions to get the flag, got %d of 1000", on)
+		}
+	})
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlPath := filepath.Join(dir, "store.yaml")
+	ioutil.WriteFile(yamlPath, []byte(`port: "9000"
+database_path: ./catalog.db
+log_level: debug
+read_timeout: 3s
+database:
+  max_open_conns: 4
+flags:
+  - name: checkout
+    enabled: false
+  - name: deals.bundles
+    enabled: true
+`), 0600)
+
+	t.Run("the file overrides the defaults", func(t *testing.T) {
+		config, err := LoadConfig([]string{"-config", yamlPath})
+		if err != nil {
+			t.Fatalf("unable to load config, '%v'", err)
+		}
+		if config.Port != "9000" || config.DatabasePath != "./catalog.db" || config.LogLevel != "debug" {
+			t.Errorf("expected the settings from the file, got %+v", config)
+		}
+		if config.ReadTimeout.Duration != 3*time.Second || config.WriteTimeout.Duration != 10*time.Second {
+			t.Errorf("expected a 3s read timeout and the default write timeout, got %v and %v", config.ReadTimeout, config.WriteTimeout)
+		}
+		if config.Database.MaxOpenConns != 4 {
+			t.Errorf("expected 4 open connections, got %d", config.Database.MaxOpenConns)
+		}
+
+		flags := NewFeatureFlags(config.Flags)
+		if flags.enabled(FlagCheckout, "") || !flags.enabled(FlagCatalogReads, "") {
+			t.Errorf("expected only checkout to be turned off, got %v", flags.list())
+		}
+		if !flags.enabled(FlagDealsBundles, "session") {
+			t.Errorf("expected a flag without a rollout to be on for everyone, got %v", flags.list())
+		}
+	})
+
+	t.Run("env overrides the file and the command line overrides env", func(t *testing.T) {
+		os.Setenv("STORE_PORT", "9100")
+		os.Setenv("STORE_LOG_LEVEL", "warn")
+		os.Setenv("STORE_FLAGS", "checkout=on")
+		defer os.Unsetenv("STORE_PORT")
+		defer os.Unsetenv("STORE_LOG_LEVEL")
+		defer os.Unsetenv("STORE_FLAGS")
+
+		config, err := LoadConfig([]string{"-config", yamlPath, "-port", "9200"})
+		if err != nil {
+			t.Fatalf("unable to load config, '%v'", err)
+		}
+		if config.Port != "9200" || config.LogLevel != "warn" || config.DatabasePath != "./catalog.db" {
+			t.Errorf("got port %s, log level %s and database %s", config.Port, config.LogLevel, config.DatabasePath)
+		}
+		if !NewFeatureFlags(config.Flags).enabled(FlagCheckout, "") {
+			t.Errorf("expected STORE_FLAGS to turn checkout back on")
+		}
+	})
+
+	t.Run("JSON files work too", func(t *testing.T) {
+		jsonPath := filepath.Join(dir, "store.json")
+		ioutil.WriteFile(jsonPath, []byte(`{"port": "9300", "idle_timeout": "2m"}`), 0600)
+
+		config, err := LoadConfig([]string{"-config", jsonPath})
+		if err != nil {
+			t.Fatalf("unable to load config, '%v'", err)
+		}
+		if config.Port != "9300" || config.IdleTimeout.Duration != 2*time.Minute {
+			t.Errorf("expected the settings from the file, got %+v", config)
+		}
+	})
+
+	cases := map[string][]string{
+		"bad port":             {"-port", "eighty"},
+		"unknown log level":    {"-log-level", "chatty"},
+		"cert without a key":   {"-tls-cert", yamlPath},
+		"missing cert":         {"-tls-cert", "nope.pem", "-tls-key", "nope.key"},
+		"negative timeout":     {"-read-timeout", "-1s"},
+		"no request timeout":   {"-request-timeout", "0s"},
+		"more idle than open":  {"-db-max-open-conns", "1", "-db-max-idle-conns", "2"},
+		"unknown feature flag": {"-flags", "teleport=on"},
+		"unknown driver":       {"-db-driver", "mysql"},
+		"postgres without dsn": {"-db-driver", "postgres"},
+		"rollout over 100":     {"-flags", "checkout=150"},
+		"missing config file":  {"-config", filepath.Join(dir, "missing.yaml")},
+	}
+	for name, args := range cases {
+		args := args
+		t.Run("rejects "+name, func(t *testing.T) {
+			if _, err := LoadConfig(args); err == nil {
+				t.Errorf("expected %v to be rejected", args)
+			}
+		})
+	}
+}
+
+func TestPostgresDialect(t *testing.T) {
+	postgres := postgresDialect{}
+
+	t.Run("placeholders are numbered", func(t *testing.T) {
+		got := postgres.rebind(`UPDATE cart SET quantity = ? WHERE cart_id = ? AND product_id = ?;`)
+		want := `UPDATE cart SET quantity = $1 WHERE cart_id = $2 AND product_id = $3;`
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	})
+
+	t.Run("question marks in strings aren't placeholders", func(t *testing.T) {
+		got := postgres.rebind(`SELECT id FROM products WHERE name = 'what?' AND id = ?;`)
+		want := `SELECT id FROM products WHERE name = 'what?' AND id = $1;`
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	})
+
+	t.Run("only conflicts are retried", func(t *testing.T) {
+		if !postgres.retryable(fmt.Errorf("merging carts: %w", &pq.Error{Code: "40001"})) {
+			t.Errorf("expected a serialization failure to be retried")
+		}
+		if postgres.retryable(&pq.Error{Code: "23505"}) || postgres.retryable(context.DeadlineExceeded) {
+			t.Errorf("expected other errors not to be retried")
+		}
+	})
+
+	t.Run("both databases go through the same schema versions", func(t *testing.T) {
+		if len(sqliteMigrations) != len(postgresMigrations) {
+			t.Errorf("sqlite has %d migrations, postgres has %d", len(sqliteMigrations), len(postgresMigrations))
+		}
+		for name := range sqliteTables {
+			if postgresTables[name] == "" {
+				t.Errorf("postgres has no %s table", name)
+			}
+		}
+	})
+}
+
+func TestServerLifecycle(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	config.MaxBodyBytes = 64
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	t.Run("bodies over the limit are turned away", func(t *testing.T) {
+		request := newProductRequest(http.MethodPost, 0, "monitor", strings.Repeat("four kay ", 10), "100.00")
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusRequestEntityTooLarge)
+	})
+
+	t.Run("requests that run out of time get a 503", func(t *testing.T) {
+		config.RequestTimeout = Duration{time.Nanosecond}
+		defer func() { config.RequestTimeout = NewConfig().RequestTimeout }()
+
+		// looking at an empty cart has nothing to query, adding to it does
+		for path, method := range map[string]string{"/products": http.MethodGet, "/cart": http.MethodPost} {
+			request, _ := http.NewRequest(method, path, strings.NewReader(`{"id": 1}`))
+			response := httptest.NewRecorder()
+			server.Handler().ServeHTTP(response, request)
+
+			assertStatus(t, response.Code, http.StatusServiceUnavailable)
+		}
+	})
+
+	t.Run("stops serving when the context is cancelled", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := "http://" + listener.Addr().String() + "/products"
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan error, 1)
+		go func() { stopped <- server.Serve(ctx, listener) }()
+
+		response, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("unable to reach the server, '%v'", err)
+		}
+		response.Body.Close()
+		assertStatus(t, response.StatusCode, http.StatusOK)
+
+		cancel()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("expected a clean shutdown, got '%v'", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("server didn't shut down")
+		}
+
+		if _, err := http.Get(url); err == nil {
+			t.Errorf("expected the server to stop accepting connections")
+		}
+	})
+}
+
+func TestHealth(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+
+	t.Run("healthz only needs the process to be up", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Body.String(), `{"status":"ok"}`)
+		if cookies := response.Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("probes shouldn't start sessions, got %v", cookies)
+		}
+	})
+
+	t.Run("not ready until the database is migrated", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+
+		if err := productRepository.migrate(context.Background()); err != nil {
+			t.Fatalf("unable to migrate, '%v'", err)
+		}
+
+		request, _ = http.NewRequest(http.MethodGet, "/readyz", nil)
+		response = httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+	})
+
+	t.Run("migrating again changes nothing", func(t *testing.T) {
+		if err := productRepository.migrate(context.Background()); err != nil {
+			t.Fatalf("expected migrate to be a no-op, got '%v'", err)
+		}
+	})
+
+	t.Run("version reports the build and schema", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/version", nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+
+		var got Version
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		want := Version{Commit: "unknown", BuildTime: "unknown", GoVersion: runtime.Version(), SchemaVersion: productRepository.latestSchemaVersion()}
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("not ready when the database is gone", func(t *testing.T) {
+		productRepository.database.Close()
+
+		request, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+	})
+}
+
+func TestBaselineMigration(t *testing.T) {
+	if os.Getenv("STORE_TEST_POSTGRES_DSN") != "" {
+		t.Skip("only SQLite databases predate the migrations")
+	}
+	// scaffolding, the schema and some of the rows the first create_database.sh made
+	config := NewConfig()
+	config.DatabasePath = filepath.Join(testDatabaseDir, "baseline.db")
+	db, err := ConnectDatabase(config)
+	if err != nil {
+		t.Fatalf("unable to open the database, '%v'", err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		`CREATE TABLE products (
+		    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		    name VARCHAR(32) NOT NULL,
+		    description TEXT,
+		    price VARCHAR(8) NOT NULL);`,
+		`CREATE TABLE deals (
+		    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		    name VARCHAR(32) NOT NULL DEFAULT "Regular Price",
+		    type VARCHAR(16) NOT NULL DEFAULT "Retail",
+		    coupon VARCHAR(8) NOT NULL DEFAULT "0.0",
+		    percent VARCHAR(8) NOT NULL DEFAULT "0.0",
+		    x INTEGER NOT NULL DEFAULT 0,
+		    y INTEGER NOT NULL DEFAULT 0,
+		    exclusive BOOLEAN NOT NULL DEFAULT 1);`,
+		`CREATE TABLE offerings (
+		    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		    product_id INTEGER NOT NULL,
+		    deal_id INTEGER NOT NULL,
+		    active BOOLEAN,
+		    modified_price VARCHAR(8) NOT NULL DEFAULT "NAN",
+		    FOREIGN KEY (product_id) REFERENCES products (id) ON UPDATE RESTRICT,
+		    FOREIGN KEY (deal_id) REFERENCES deals (id) ON UPDATE RESTRICT);`,
+		`CREATE TABLE cart (
+		    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		    product_id INTEGER NOT NULL,
+		    quantity INTEGER NOT NULL DEFAULT 1,
+		    FOREIGN KEY (product_id) REFERENCES products (id));`,
+		`INSERT INTO products (name, description, price) VALUES ("laptop", "very fast", "1000.00");`,
+		`INSERT INTO deals (name, type) VALUES ("Regular Price", "Retail");`,
+		`INSERT INTO offerings (product_id, deal_id, active) VALUES (1, 1, 1);`,
+		`INSERT INTO cart (product_id, quantity) VALUES (1, 1);`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("unable to build the baseline schema, '%v'", err)
+		}
+	}
+	productRepository := NewProductRepository(db, config.Database.Driver)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+
+	t.Run("a database from before the migrations is brought up to date", func(t *testing.T) {
+		if err := productRepository.migrate(context.Background()); err != nil {
+			t.Fatalf("unable to migrate, '%v'", err)
+		}
+		if version, _ := productRepository.schemaVersion(context.Background()); version != productRepository.latestSchemaVersion() {
+			t.Errorf("expected schema version %d, got %d", productRepository.latestSchemaVersion(), version)
+		}
+	})
+
+	t.Run("its catalog is served and priced", func(t *testing.T) {
+		products, err := productService.listProducts(context.Background())
+		if err != nil || len(products) != 1 || products[0].Name != "laptop" {
+			t.Fatalf("expected the laptop, got %v and '%v'", products, err)
+		}
+
+		customer := newBrowser(server)
+		customer.addToCart(1)
+		req, _ := http.NewRequest(http.MethodGet, "/cart", nil)
+		response := httptest.NewRecorder()
+		customer.ServeHTTP(response, req)
+
+		var got ShoppingCart
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertStatus(t, response.Code, http.StatusOK)
+		assertShoppingCart(t, got, ShoppingCart{Items: []Item{{Product{1, "laptop", "very fast", "1000.00", ""}, 1}}, Total: "1000"})
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+
+	customer := newBrowser(server)
+	customer.addToCart(1)
+
+	request, _ := http.NewRequest(http.MethodGet, "/nowhere", nil)
+	customer.ServeHTTP(httptest.NewRecorder(), request)
+
+	request, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+	response := httptest.NewRecorder()
+	server.Handler().ServeHTTP(response, request)
+	assertStatus(t, response.Code, http.StatusOK)
+
+	for _, want := range []string{
+		`store_http_requests_total{method="POST",route="/cart",status="200"}`,
+		`store_http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`store_http_request_duration_seconds_count{method="POST",route="/cart"}`,
+		`store_db_query_duration_seconds_count{query="addToCart"}`,
+		`store_pricing_duration_seconds_count`,
+		`store_cart_operations_total{operation="add"}`,
+		`store_deal_applications_total{type="Retail"}`,
+	} {
+		if !strings.Contains(response.Body.String(), want) {
+			t.Errorf("expected the metrics to include %s", want)
+		}
+	}
+}
+
+func TestCatalogCache(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	listProducts := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		return response
+	}
+
+	var etag string
+	t.Run("the catalog is read from the database once", func(t *testing.T) {
+		first := countQueries(func() { etag = listProducts("").Header().Get("ETag") })
+		second := countQueries(func() { listProducts("") })
+		if first != 1 || second != 0 {
+			t.Errorf("expected 1 query and then none, got %d and %d", first, second)
+		}
+		if etag == "" {
+			t.Errorf("expected the list to have an ETag")
+		}
+	})
+
+	t.Run("an unchanged list is not sent again", func(t *testing.T) {
+		response := listProducts(`"stale", ` + etag)
+		assertStatus(t, response.Code, http.StatusNotModified)
+		assertResponseBody(t, response.Body.String(), "")
+		if got := response.Header().Get("ETag"); got != etag {
+			t.Errorf("expected ETag %s, got %s", etag, got)
+		}
+
+		response = listProducts(`W/` + etag)
+		assertStatus(t, response.Code, http.StatusNotModified)
+	})
+
+	t.Run("a write invalidates the cache", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, newProductRequest(http.MethodPost, 0, "mouse", "much clicky", "10.00"))
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		response = listProducts(etag)
+		assertStatus(t, response.Code, http.StatusOK)
+		var got []Product
+		if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+		}
+		assertProducts(t, got, []Product{{1, "laptop", "very fast", "1000.00", ""}, {2, "mouse", "much clicky", "10.00", ""}})
+		if response.Header().Get("ETag") == etag {
+			t.Errorf("expected a new ETag once the list changed")
+		}
+	})
+
+	t.Run("hits and misses are counted", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		for _, want := range []string{
+			`store_catalog_cache_requests_total{entry="products",result="hit"}`,
+			`store_catalog_cache_requests_total{entry="products",result="miss"}`,
+		} {
+			if !strings.Contains(response.Body.String(), want) {
+				t.Errorf("expected the metrics to include %s", want)
+			}
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	admin := signIn(t, server, "admin@example.com", RoleAdmin)
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	change := func(request *http.Request, requestID string, want int) {
+		t.Helper()
+		request.Header.Set("X-Request-ID", requestID)
+		request.Header.Set("If-Match", `"1"`)
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+		assertStatus(t, response.Code, want)
+	}
+	audit := func(c *browser, query string) ([]AuditEntry, int) {
+		request, _ := http.NewRequest(http.MethodGet, "/admin/audit?"+query, nil)
+		response := httptest.NewRecorder()
+		c.ServeHTTP(response, request)
+		var entries []AuditEntry
+		_ = json.NewDecoder(response.Body).Decode(&entries)
+		return entries, response.Code
+	}
+
+	t.Run("every change to a product is recorded", func(t *testing.T) {
+		change(newProductRequest(http.MethodPost, 0, "laptop", "very fast", "1000.00"), "create-laptop", http.StatusCreated)
+		change(newProductRequest(http.MethodPut, 1, "laptop", "very fast", "900.00"), "reprice-laptop", http.StatusNoContent)
+		// refused, so there's nothing to record
+		change(newProductRequest(http.MethodPut, 1, "laptop", "very fast", "1.00"), "stale-laptop", http.StatusPreconditionFailed)
+		change(newProductRequest(http.MethodPost, 0, "mouse", "much clicky", "10.00"), "create-mouse", http.StatusCreated)
+
+		entries, status := audit(admin, "entity=product&id=1")
+		assertStatus(t, status, http.StatusOK)
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %+v", entries)
+		}
+
+		created, updated := entries[0], entries[1]
+		if created.Action != "create" || created.Entity != AuditProduct || created.EntityID != 1 || created.UserID != 2 || created.RequestID != "create-laptop" {
+			t.Errorf("unexpected create entry %+v", created)
+		}
+		assertResponseBody(t, string(created.Before), "")
+		assertResponseBody(t, string(created.After), `{"id":1,"name":"laptop","description":"very fast","price":"1000.00"}`)
+
+		if updated.Action != "update" || updated.RequestID != "reprice-laptop" || updated.CreatedAt.IsZero() {
+			t.Errorf("unexpected update entry %+v", updated)
+		}
+		assertResponseBody(t, string(updated.Before), `{"id":1,"name":"laptop","description":"very fast","price":"1000.00"}`)
+		assertResponseBody(t, string(updated.After), `{"id":1,"name":"laptop","description":"very fast","price":"900.00"}`)
+	})
+
+	t.Run("a delete keeps what was deleted", func(t *testing.T) {
+		request := newProductRequest(http.MethodDelete, 2, "mouse", "", "")
+		change(request, "delete-mouse", http.StatusOK)
+
+		entries, _ := audit(admin, "entity=product&id=2")
+		if len(entries) != 2 || entries[1].Action != "delete" || entries[1].After != nil {
+			t.Fatalf("expected a create and a delete, got %+v", entries)
+		}
+		assertResponseBody(t, string(entries[1].Before), `{"id":2,"name":"mouse","description":"much clicky","price":"10.00"}`)
+
+		entries, _ = audit(admin, "entity=product")
+		if len(entries) != 4 {
+			t.Errorf("expected every product's 4 entries, got %d", len(entries))
+		}
+	})
+
+	t.Run("deals and offerings are recorded", func(t *testing.T) {
+		body, _ := json.Marshal(Deal{Name: "Half Off", Type: Percent, Percent: "0.5"})
+		request, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		change(request, "create-deal", http.StatusCreated)
+		body, _ = json.Marshal(Offering{ProductID: 1, DealID: 1, Active: true})
+		request, _ = http.NewRequest(http.MethodPost, "/offerings", bytes.NewBuffer(body))
+		change(request, "create-offering", http.StatusCreated)
+
+		deals, _ := audit(admin, "entity=deal&id=1")
+		offerings, _ := audit(admin, "entity=offering&id=1")
+		if len(deals) != 1 || deals[0].RequestID != "create-deal" || len(offerings) != 1 || offerings[0].RequestID != "create-offering" {
+			t.Errorf("expected an entry for each, got %+v and %+v", deals, offerings)
+		}
+	})
+
+	t.Run("only admins can read it", func(t *testing.T) {
+		_, status := audit(merchandiser, "entity=product&id=1")
+		assertStatus(t, status, http.StatusForbidden)
+		_, status = audit(admin, "entity=user&id=1")
+		assertStatus(t, status, http.StatusBadRequest)
+		_, status = audit(admin, "entity=product&id=laptop")
+		assertStatus(t, status, http.StatusBadRequest)
+	})
+
+	t.Run("entries can't be changed or removed", func(t *testing.T) {
+		before, _ := audit(admin, "entity=product&id=1")
+		// the migration to PostgreSQL's triggers can run again over them
+		migrations := productRepository.dialect.migrations()
+		for i := 0; i < 2; i++ {
+			if err := migrations[6](context.Background(), productRepository); err != nil {
+				t.Fatalf("unable to migrate the audit log, '%v'", err)
+			}
+		}
+
+		if _, err := productRepository.database.Exec(`UPDATE audit_log SET request_id = 'rewritten';`); err == nil {
+			t.Errorf("expected updating an entry to be refused")
+		}
+		if _, err := productRepository.database.Exec(`DELETE FROM audit_log;`); err == nil {
+			t.Errorf("expected deleting an entry to be refused")
+		}
+		after, _ := audit(admin, "entity=product&id=1")
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("expected the entries to be left alone, got %+v", after)
+		}
+	})
+}
+
+func TestRequestLogging(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	var logs bytes.Buffer
+	defer func(previous *Logger) { logger = previous }(logger)
+	logger = NewLogger(&logs, "debug")
+
+	readLines := func() []map[string]interface{} {
+		var lines []map[string]interface{}
+		decoder := json.NewDecoder(&logs)
+		for decoder.More() {
+			var line map[string]interface{}
+			if err := decoder.Decode(&line); err != nil {
+				t.Fatalf("log line isn't JSON, '%v'", err)
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	t.Run("the request id follows the request down to its queries", func(t *testing.T) {
+		request := newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00")
+		request.Header.Set("X-Request-ID", "sync-42")
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+		if got := response.Header().Get("X-Request-ID"); got != "sync-42" {
+			t.Errorf("expected the request id to be echoed back, got %q", got)
+		}
+
+		var requestLine, queryLine map[string]interface{}
+		for _, line := range readLines() {
+			if line["request_id"] != "sync-42" {
+				t.Errorf("expected every line to have the request id, got %v", line)
+			}
+			switch line["msg"] {
+			case "request":
+				requestLine = line
+			case "query":
+				if line["query"] == "insertProduct" {
+					queryLine = line
+				}
+			}
+		}
+		if queryLine == nil {
+			t.Errorf("expected the insert to be logged with the request id")
+		}
+		if requestLine == nil {
+			t.Fatalf("expected a request line")
+		}
+		for _, field := range []string{"method", "path", "status", "duration_ms", "user_id"} {
+			if _, ok := requestLine[field]; !ok {
+				t.Errorf("expected the request line to have %s, got %v", field, requestLine)
+			}
+		}
+		if requestLine["status"] != float64(http.StatusCreated) || requestLine["user_id"] != float64(1) {
+			t.Errorf("got %v", requestLine)
+		}
+	})
+
+	t.Run("requests without an id are given one", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		request.Header.Set("X-Request-ID", "not\tprintable")
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+
+		id := response.Header().Get("X-Request-ID")
+		if id == "" || id == "not\tprintable" {
+			t.Errorf("expected a generated request id, got %q", id)
+		}
+		lines := readLines()
+		if last := lines[len(lines)-1]; last["request_id"] != id {
+			t.Errorf("expected the request line to use %q, got %v", id, last)
+		}
+	})
+}
+
+func TestTracing(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+
+	spans := tracetest.NewSpanRecorder()
+	defer func(previous trace.Tracer) { tracer = previous }(tracer)
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("store")
+
+	customer := newBrowser(server)
+	customer.addToCart(1)
+
+	named := func(name string) sdktrace.ReadOnlySpan {
+		for _, span := range spans.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		t.Fatalf("expected a %s span", name)
+		return nil
+	}
+
+	t.Run("queries are traced under the service method under the request", func(t *testing.T) {
+		request := named("POST /cart")
+		listing := named("ProductService.listCartItems")
+		query := named("listCart")
+
+		if listing.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("expected listCartItems to be a child of the request")
+		}
+		if query.Parent().SpanID() != listing.SpanContext().SpanID() {
+			t.Errorf("expected listCart to be a child of listCartItems")
+		}
+		if query.StartTime().After(query.EndTime()) || query.StartTime().Before(listing.StartTime()) {
+			t.Errorf("expected the query to be timed inside the service method")
+		}
+
+		attributes := map[string]string{}
+		for _, attribute := range request.Attributes() {
+			attributes[string(attribute.Key)] = attribute.Value.Emit()
+		}
+		if attributes["http.route"] != "/cart" || attributes["http.status_code"] != "200" || attributes["request.id"] == "" {
+			t.Errorf("got request attributes %v", attributes)
+		}
+	})
+
+	t.Run("encoding the response is traced under the request", func(t *testing.T) {
+		request := named("POST /cart")
+		encoding := named("encodeResponse")
+
+		if encoding.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("expected encodeResponse to be a child of the request")
+		}
+	})
+
+	t.Run("a traceparent header continues the caller's trace", func(t *testing.T) {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		server.Handler().ServeHTTP(httptest.NewRecorder(), request)
+
+		span := named("GET /products")
+		if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("expected the caller's trace id, got %s", got)
+		}
+	})
+
+	t.Run("config picks the exporter", func(t *testing.T) {
+		config, err := LoadConfig([]string{"-trace-exporter", "otlp", "-trace-endpoint", "collector:4318"})
+		if err != nil {
+			t.Fatalf("unable to load config, '%v'", err)
+		}
+		if config.Tracing.Exporter != TraceExporterOTLP || config.Tracing.Endpoint != "collector:4318" {
+			t.Errorf("got %+v", config.Tracing)
+		}
+		if _, err := LoadConfig([]string{"-trace-exporter", "jaeger"}); err == nil {
+			t.Errorf("expected an unknown exporter to be rejected")
+		}
+	})
+}
+
+func TestOfferings(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	// some deals to offer
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Half Off", Type: "Percent", Percent: "50"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Laptop Mouse Bundle", Type: "Bundle"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Buy 3 USB get 1 free", Type: "BuyXGetYFree", X: 3, Y: 1})
+
+	// some products to list
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{3, "monitor", "four kay", "100.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{4, "usb", "type see", "1.00", ""})
+
+	// actual items
+	productService.repository.createOfferingsTable(context.Background())
+	// regular priced mouse
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1})
+	// laptop with a mouse free
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 3})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 3})
+	// 50% off monitors
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 3, DealID: 2})
+
+	t.Run("create new offering connecting usbs to the buy 3 USBs get 1 free offering", func(t *testing.T) {
+
+		body, _ := json.Marshal(Offering{ProductID: 4, DealID: 4})
+		req, _ := http.NewRequest(http.MethodPost, "/offerings", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ""
+		var got string
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		assertResponseBody(t, got, want)
+	})
+
+}
+
+func TestDeals(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	// database reset seed
+	productService.repository.createDealsTable(context.Background())
+
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Half Off", Type: "Percent", Percent: "50"})
+
+	t.Run("get the list of deals", func(t *testing.T) {
+
+		request, _ := http.NewRequest(http.MethodGet, "/deals", nil)
+		want := []Deal{{ID: 1, Name: "Regular Price", Type: "Retail"}, {ID: 2, Name: "Half Off", Type: "Percent", Percent: "50"}}
+
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		var got []Deal
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+		}
+		assertStatus(t, response.Code, http.StatusOK)
+		assertDeals(t, got, want)
+
+	})
+	t.Run("inserts a new deal", func(t *testing.T) {
+
+		body, _ := json.Marshal(Deal{Name: "Half off any regular price item", Type: "Percent", Percent: "0.5"})
+		req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", jsonContentType)
+
+		want := ""
+		var got string
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, req)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		assertResponseBody(t, got, want)
+
+	})
+
+	t.Run("rejects deals the pricing engine can't price", func(t *testing.T) {
+
+		invalid := []Deal{
+			{Name: "Mystery deal", Type: "Other"},
+			{Name: "Lowercase percent", Type: "percent", Percent: "0.5"},
+			{Name: "Fifty percent as a whole number", Type: "Percent", Percent: "50"},
+			{Name: "$10 off with no amount", Type: "Flat"},
+			{Name: "Buy 2 get nothing", Type: "BuyXGetY", X: 2},
+		}
+
+		for _, deal := range invalid {
+			body, _ := json.Marshal(deal)
+			req, _ := http.NewRequest(http.MethodPost, "/deals", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", jsonContentType)
+
+			response := httptest.NewRecorder()
+			merchandiser.ServeHTTP(response, req)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestProducts(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	// database reset seed
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+
+	t.Run("get the list of products", func(t *testing.T) {
+
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		want := []Product{{1, "laptop", "very fast", "1000.00", ""}, {2, "mouse", "much clicky", "10.00", ""}}
+
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		var got []Product
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+		}
+		assertStatus(t, response.Code, http.StatusOK)
+		assertProducts(t, got, want)
+
+	})
+
+	t.Run("inserts a new product", func(t *testing.T) {
+
+		request := newProductRequest(http.MethodPost, 0, "monitor", "fourkay", "100.00")
+		want := ""
+		var got string
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+
+		assertResponseBody(t, got, want)
+
+	})
+
+	t.Run("update a product name and description", func(t *testing.T) {
+
+		request := newProductRequest(http.MethodPut, 1, "laptop", "older", "85.00")
+		request.Header.Set("If-Match", `"1"`)
+		want := ""
+
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		var got string
+
+		assertStatus(t, response.Code, http.StatusNoContent)
+		assertResponseBody(t, got, want)
+
+	})
+
+	t.Run("delete the a product (id = 2)", func(t *testing.T) {
+		request := newProductRequest(http.MethodDelete, 2, "monitor", "fourkay", "100.00")
+		request.Header.Set("If-Match", `"1"`)
+		want := ""
+
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+
+		var got string
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, got, want)
+
+	})
+
+	t.Run("veirfy the database state", func(t *testing.T) {
+
+		request, _ := http.NewRequest(http.MethodGet, "/products", nil)
+		want := []Product{{1, "laptop", "older", "85.00", ""}, {3, "monitor", "fourkay", "100.00", ""}}
+
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		var got []Product
+		err := json.NewDecoder(response.Body).Decode(&got)
+		if err != nil {
+			t.Fatalf("Unable to parse response from server %q into slice of Product, '%v'", response.Body, err)
+		}
+		assertStatus(t, response.Code, http.StatusOK)
+		assertProducts(t, got, want)
+	})
+
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Tiered", Type: Tiered, Tiers: []Tier{{MinQuantity: 1, Price: "9.00"}}})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, ModifiedPrice: "NAN", Active: true})
+	alice := signIn(t, server, "alice@example.com", RoleMerchandiser)
+	bob := signIn(t, server, "bob@example.com", RoleMerchandiser)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		return response
+	}
+	write := func(merchandiser *browser, request *http.Request, etag string) int {
+		if etag != "" {
+			request.Header.Set("If-Match", etag)
+		}
+		response := httptest.NewRecorder()
+		merchandiser.ServeHTTP(response, request)
+		return response.Code
+	}
+	jsonRequest := func(method string, path string, body interface{}) *http.Request {
+		bytes, _ := json.Marshal(body)
+		request, _ := http.NewRequest(method, path, strings.NewReader(string(bytes)))
+		request.Header.Set("Content-Type", jsonContentType)
+		return request
+	}
+
+	var etag string
+	t.Run("a product is read with its version", func(t *testing.T) {
+		response := get("/products/1")
+		assertStatus(t, response.Code, http.StatusOK)
+		etag = response.Header().Get("ETag")
+		assertResponseBody(t, etag, `"1"`)
+
+		var got Product
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertProducts(t, []Product{got}, []Product{{1, "laptop", "very fast", "1000.00", ""}})
+
+		assertStatus(t, get("/products/2").Code, http.StatusNotFound)
+		assertStatus(t, get("/products/laptop").Code, http.StatusNotFound)
+	})
+
+	t.Run("writes need If-Match", func(t *testing.T) {
+		assertStatus(t, write(alice, newProductRequest(http.MethodPut, 1, "laptop", "faster", "900.00"), ""), http.StatusPreconditionRequired)
+		assertStatus(t, write(alice, newProductRequest(http.MethodDelete, 1, "laptop", "", ""), ""), http.StatusPreconditionRequired)
+	})
+
+	t.Run("a malformed write is refused and changes nothing", func(t *testing.T) {
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			request, _ := http.NewRequest(method, "/products", strings.NewReader("not json"))
+			request.Header.Set("Content-Type", jsonContentType)
+			request.Header.Set("If-Match", etag)
+			response := httptest.NewRecorder()
+			alice.ServeHTTP(response, request)
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertResponseBody(t, response.Body.String(), "Bad Request\n")
+		}
+
+		response := get("/products/1")
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Header().Get("ETag"), etag)
+	})
+
+	t.Run("the second of two edits from the same version is refused", func(t *testing.T) {
+		assertStatus(t, write(alice, newProductRequest(http.MethodPut, 1, "laptop", "faster", "900.00"), etag), http.StatusNoContent)
+		assertStatus(t, write(bob, newProductRequest(http.MethodPut, 1, "laptop", "cheaper", "800.00"), etag), http.StatusPreconditionFailed)
+		assertStatus(t, write(bob, newProductRequest(http.MethodDelete, 1, "laptop", "", ""), etag), http.StatusPreconditionFailed)
+		assertStatus(t, write(bob, newProductRequest(http.MethodPut, 1, "laptop", "cheaper", "800.00"), `W/`+etag), http.StatusPreconditionFailed)
+
+		response := get("/products/1")
+		assertResponseBody(t, response.Header().Get("ETag"), `"2"`)
+		var got Product
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertProducts(t, []Product{got}, []Product{{1, "laptop", "faster", "900.00", ""}})
+	})
+
+	t.Run("an unchanged product is not sent again", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/products/1", nil)
+		request.Header.Set("If-None-Match", `"2"`)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		assertStatus(t, response.Code, http.StatusNotModified)
+	})
+
+	t.Run("a product that doesn't exist is not found", func(t *testing.T) {
+		assertStatus(t, write(bob, newProductRequest(http.MethodPut, 7, "laptop", "", ""), `"1"`), http.StatusNotFound)
+	})
+
+	t.Run("If-Match: * writes whatever the version", func(t *testing.T) {
+		assertStatus(t, write(bob, newProductRequest(http.MethodPut, 1, "laptop", "cheaper", "800.00"), "*"), http.StatusNoContent)
+		assertResponseBody(t, get("/products/1").Header().Get("ETag"), `"3"`)
+		assertStatus(t, write(bob, newProductRequest(http.MethodDelete, 1, "laptop", "", ""), `"3"`), http.StatusOK)
+		assertStatus(t, get("/products/1").Code, http.StatusNotFound)
+	})
+
+	t.Run("a deal is read with its version", func(t *testing.T) {
+		response := get("/deals/1")
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Header().Get("ETag"), `"1"`)
+
+		var got Deal
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertDeals(t, []Deal{got}, []Deal{{ID: 1, Name: "Tiered", Type: Tiered, Tiers: []Tier{{MinQuantity: 1, Price: "9.00"}}}})
+		assertStatus(t, get("/deals/2").Code, http.StatusNotFound)
+	})
+
+	t.Run("deals are written at their version", func(t *testing.T) {
+		cheaper := Deal{Name: "Tiered", Type: Tiered, Tiers: []Tier{{MinQuantity: 1, Price: "8.00"}}}
+		assertStatus(t, write(alice, jsonRequest(http.MethodPut, "/deals/1", cheaper), ""), http.StatusPreconditionRequired)
+		assertStatus(t, write(alice, jsonRequest(http.MethodPut, "/deals/1", cheaper), `"1"`), http.StatusNoContent)
+		assertStatus(t, write(bob, jsonRequest(http.MethodPut, "/deals/1", Deal{Name: "Tiered", Type: Tiered, Tiers: []Tier{{MinQuantity: 1, Price: "7.00"}}}), `"1"`), http.StatusPreconditionFailed)
+		assertStatus(t, write(bob, jsonRequest(http.MethodPut, "/deals/1", Deal{Name: "Broken", Type: Percent}), `"2"`), http.StatusBadRequest)
+		assertStatus(t, write(bob, jsonRequest(http.MethodPut, "/deals/7", cheaper), `"1"`), http.StatusNotFound)
+
+		response := get("/deals/1")
+		assertResponseBody(t, response.Header().Get("ETag"), `"2"`)
+		var got Deal
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		cheaper.ID = 1
+		assertDeals(t, []Deal{got}, []Deal{cheaper})
+	})
+
+	t.Run("offerings are read and written at their version", func(t *testing.T) {
+		response := get("/offerings/1")
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Header().Get("ETag"), `"1"`)
+		assertStatus(t, get("/offerings/2").Code, http.StatusNotFound)
+
+		paused := Offering{ProductID: 1, DealID: 1, ModifiedPrice: "NAN"}
+		assertStatus(t, write(alice, jsonRequest(http.MethodPut, "/offerings/1", paused), ""), http.StatusPreconditionRequired)
+		assertStatus(t, write(alice, jsonRequest(http.MethodPut, "/offerings/1", paused), `"1"`), http.StatusNoContent)
+		assertStatus(t, write(bob, jsonRequest(http.MethodPut, "/offerings/1", paused), `"1"`), http.StatusPreconditionFailed)
+
+		response = get("/offerings/1")
+		assertResponseBody(t, response.Header().Get("ETag"), `"2"`)
+		var got Offering
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		if got != (Offering{ID: 1, ProductID: 1, DealID: 1, ModifiedPrice: "NAN"}) {
+			t.Errorf("expected the offering to be switched off, got %+v", got)
+		}
+	})
+
+	t.Run("a deal can only be deleted once it isn't offered", func(t *testing.T) {
+		assertStatus(t, write(bob, jsonRequest(http.MethodDelete, "/deals/1", nil), "*"), http.StatusConflict)
+
+		assertStatus(t, write(bob, jsonRequest(http.MethodDelete, "/offerings/1", nil), ""), http.StatusPreconditionRequired)
+		assertStatus(t, write(bob, jsonRequest(http.MethodDelete, "/offerings/1", nil), `"1"`), http.StatusPreconditionFailed)
+		assertStatus(t, write(bob, jsonRequest(http.MethodDelete, "/offerings/1", nil), `"2"`), http.StatusNoContent)
+		assertStatus(t, get("/offerings/1").Code, http.StatusNotFound)
+
+		assertStatus(t, write(bob, jsonRequest(http.MethodDelete, "/deals/1", nil), `"1"`), http.StatusPreconditionFailed)
+		assertStatus(t, write(bob, jsonRequest(http.MethodDelete, "/deals/1", nil), `"2"`), http.StatusNoContent)
+		assertStatus(t, get("/deals/1").Code, http.StatusNotFound)
+		var tiers int
+		productRepository.database.QueryRow(`SELECT count(*) FROM deal_tiers;`).Scan(&tiers)
+		if tiers != 0 {
+			t.Errorf("expected the deal's tiers to go with it, %d are left", tiers)
+		}
+
+		entries, _ := productService.listAuditEntries(context.Background(), AuditDeal, 1)
+		if len(entries) != 2 || entries[0].Action != AuditUpdate || entries[1].Action != AuditDelete {
+			t.Errorf("expected the update and delete to be audited, got %v", entries)
+		}
+	})
+
+	t.Run("tables from before versions get them", func(t *testing.T) {
+		ctx := context.Background()
+		for _, statement := range []string{`DROP TABLE IF EXISTS offerings;`, `CREATE TABLE offerings (id INTEGER PRIMARY KEY, product_id INTEGER);`} {
+			if _, err := productRepository.database.Exec(statement); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := addVersionColumns(ctx, productRepository); err != nil {
+			t.Fatalf("unable to add the versions, '%v'", err)
+		}
+		exists, err := productRepository.dialect.hasColumn(ctx, productRepository.database, "offerings", "version")
+		if err != nil || !exists {
+			t.Errorf("expected offerings to have a version, got %v '%v'", exists, err)
+		}
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	productService.repository.insertProduct(context.Background(), Product{2, "mouse", "much clicky", "10.00", ""})
+	productService.repository.insertDeal(context.Background(), Deal{Name: "Regular Price", Type: "Retail"})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(context.Background(), Offering{ProductID: 2, DealID: 1, Active: true})
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+	admin := signIn(t, server, "admin@example.com", RoleAdmin)
+	customer := newBrowser(server)
+	laptop, mouse := Product{1, "laptop", "very fast", "1000.00", ""}, Product{2, "mouse", "much clicky", "10.00", ""}
+
+	serve := func(c *browser, request *http.Request) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		c.ServeHTTP(response, request)
+		return response
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		return serve(customer, request)
+	}
+	restore := func(id int) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("/products/%d/restore", id), nil)
+		return serve(merchandiser, request)
+	}
+	addToCart := func(id int) int {
+		body, _ := json.Marshal(Product{ID: id})
+		request, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+		request.Header.Set("Content-Type", jsonContentType)
+		return serve(customer, request).Code
+	}
+	cart := func() ShoppingCart {
+		var got ShoppingCart
+		_ = json.NewDecoder(get("/cart").Body).Decode(&got)
+		return got
+	}
+	products := func() []Product {
+		var got []Product
+		_ = json.NewDecoder(get("/products").Body).Decode(&got)
+		return got
+	}
+
+	t.Run("a deleted product is hidden from the catalog", func(t *testing.T) {
+		assertStatus(t, addToCart(1), http.StatusOK)
+		request := newProductRequest(http.MethodDelete, 1, "laptop", "", "")
+		request.Header.Set("If-Match", `"1"`)
+		assertStatus(t, serve(merchandiser, request).Code, http.StatusOK)
+
+		assertProducts(t, products(), []Product{mouse})
+		assertStatus(t, get("/products/1").Code, http.StatusNotFound)
+	})
+
+	t.Run("a deleted product can't be edited or deleted again", func(t *testing.T) {
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			request := newProductRequest(method, 1, "laptop", "very fast", "900.00")
+			request.Header.Set("If-Match", "*")
+			assertStatus(t, serve(merchandiser, request).Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("a deleted product can't be added to a cart", func(t *testing.T) {
+		assertStatus(t, addToCart(1), http.StatusNotFound)
+	})
+
+	t.Run("carts that already have it still show it", func(t *testing.T) {
+		assertShoppingCart(t, cart(), ShoppingCart{[]Item{{laptop, 1}}, "1000", nil})
+	})
+
+	t.Run("the row is still there for the foreign keys", func(t *testing.T) {
+		if _, err := productRepository.database.Exec(`DELETE FROM products WHERE id = 1;`); err == nil {
+			t.Errorf("expected deleting a product in a cart to break a foreign key")
+		}
+	})
+
+	t.Run("only a deleted product can be restored", func(t *testing.T) {
+		assertStatus(t, restore(2).Code, http.StatusConflict)
+		assertStatus(t, restore(7).Code, http.StatusNotFound)
+		request, _ := http.NewRequest(http.MethodPost, "/products/1/restore", nil)
+		assertStatus(t, serve(customer, request).Code, http.StatusUnauthorized)
+	})
+
+	t.Run("a restored product is back in the catalog", func(t *testing.T) {
+		response := restore(1)
+		assertStatus(t, response.Code, http.StatusOK)
+		// the delete and the restore were both changes
+		assertResponseBody(t, response.Header().Get("ETag"), `"3"`)
+		var got Product
+		_ = json.NewDecoder(response.Body).Decode(&got)
+		assertProducts(t, []Product{got}, []Product{laptop})
+
+		assertProducts(t, products(), []Product{laptop, mouse})
+		assertStatus(t, addToCart(1), http.StatusOK)
+		assertShoppingCart(t, cart(), ShoppingCart{[]Item{{laptop, 2}}, "2000", nil})
+	})
+
+	t.Run("deleting and restoring are audited", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/admin/audit?entity=product&id=1", nil)
+		var entries []AuditEntry
+		_ = json.NewDecoder(serve(admin, request).Body).Decode(&entries)
+		var actions []string
+		for _, entry := range entries {
+			actions = append(actions, entry.Action)
+		}
+		if !reflect.DeepEqual(actions, []string{AuditDelete, AuditRestore}) {
+			t.Errorf("got actions %v, want delete then restore", actions)
+		}
+	})
+}
+
+func TestImport(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	productService.repository.createAuditLogTable(context.Background())
+	productService.repository.createUsersTable(context.Background())
+	productService.repository.createCartsTable(context.Background())
+	productService.repository.createProductsTable(context.Background())
+	productService.repository.createDealsTable(context.Background())
+	productService.repository.createOfferingsTable(context.Background())
+	productService.repository.insertProduct(context.Background(), Product{1, "laptop", "very fast", "1000.00", ""})
+	admin := signIn(t, server, "admin@example.com", RoleAdmin)
+	merchandiser := signIn(t, server, "merch@example.com", RoleMerchandiser)
+
+	upload := func(c *browser, query string, contentType string, file string) (ImportReport, *httptest.ResponseRecorder) {
+		request, _ := http.NewRequest(http.MethodPost, "/admin/import"+query, strings.NewReader(file))
+		request.Header.Set("Content-Type", contentType)
+		response := httptest.NewRecorder()
+		c.ServeHTTP(response, request)
+		var report ImportReport
+		_ = json.Unmarshal(response.Body.Bytes(), &report)
+		return report, response
+	}
+	catalog := func() ([]*Product, []*Offering) {
+		products, _ := productRepository.listProducts(context.Background())
+		offerings, _ := productRepository.listOfferings(context.Background())
+		return products, offerings
+	}
+
+	csvFile := `kind,id,name,description,price,type,tiers,product_id,deal_id,active
+product,10,mouse,much clicky,10.00,,,,,
+deal,20,Regular Price,,,Retail,,,,
+offering,30,,,,,,10,20,true
+product,11,usb,"type see, fast",5.00,,,,,
+deal,21,Bulk,,,Tiered,"[{""min_quantity"": 10, ""price"": ""4.00""}]",,,
+offering,31,,,,,,11,21,
+offering,,,,,,,1,20,true
+`
+
+	t.Run("a dry run imports nothing", func(t *testing.T) {
+		report, response := upload(admin, "?dry_run=true", "text/csv", csvFile)
+		assertStatus(t, response.Code, http.StatusOK)
+		want := ImportReport{DryRun: true, Rows: 7, Products: 2, Deals: 2, Offerings: 3}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("got %+v want %+v", report, want)
+		}
+		products, offerings := catalog()
+		if len(products) != 1 || len(offerings) != 0 {
+			t.Errorf("expected the dry run to leave the catalog alone, got %d products and %d offerings", len(products), len(offerings))
+		}
+	})
+
+	t.Run("a CSV file is imported", func(t *testing.T) {
+		report, response := upload(admin, "", "text/csv; charset=utf-8", csvFile)
+		assertStatus(t, response.Code, http.StatusOK)
+		want := ImportReport{Rows: 7, Products: 2, Deals: 2, Offerings: 3}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("got %+v want %+v", report, want)
+		}
+
+		products, offerings := catalog()
+		var got []Product
+		for _, product := range products {
+			got = append(got, *product)
+		}
+		assertProducts(t, got, []Product{{1, "laptop", "very fast", "1000.00", ""}, {10, "mouse", "much clicky", "10.00", ""}, {11, "usb", "type see, fast", "5.00", ""}})
+		// rows keep their ids, an offering without one gets the next
+		var links [][3]int
+		for _, offering := range offerings {
+			links = append(links, [3]int{offering.ID, offering.ProductID, offering.DealID})
+		}
+		if !reflect.DeepEqual(links, [][3]int{{30, 10, 20}, {31, 11, 21}, {32, 1, 20}}) {
+			t.Errorf("got offerings of %v", links)
+		}
+		// flags left empty get the columns' defaults
+		deal, _, _ := productRepository.getDeal(context.Background(), 21)
+		assertDeals(t, []Deal{deal}, []Deal{{ID: 21, Name: "Bulk", Type: Tiered, Exclusive: true, Tiers: []Tier{{MinQuantity: 10, Price: "4.00"}}}})
+		if !offerings[1].Active {
+			t.Errorf("expected an offering without active to be active")
+		}
+
+		entries, _ := productRepository.listAuditEntries(context.Background(), AuditOffering, 0)
+		if len(entries) != 3 {
+			t.Errorf("expected every imported offering to be audited, got %d entries", len(entries))
+		}
+	})
+
+	t.Run("importing a file again updates the rows with ids", func(t *testing.T) {
+		file := strings.Replace(csvFile, "much clicky,10.00", "much clicky,8.00", 1)
+		report, response := upload(admin, "", "text/csv", file)
+		assertStatus(t, response.Code, http.StatusOK)
+		want := ImportReport{Rows: 7, Products: 2, Deals: 2, Offerings: 3}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("got %+v want %+v", report, want)
+		}
+
+		products, offerings := catalog()
+		if len(products) != 3 || len(offerings) != 4 {
+			t.Errorf("expected only the offering without an id to be added again, got %d products and %d offerings", len(products), len(offerings))
+		}
+		mouse, _, _ := productRepository.getVersionedProduct(context.Background(), 10)
+		if mouse.Price != "8.00" {
+			t.Errorf("expected the mouse to be updated, got %+v", mouse)
+		}
+		entries, _ := productRepository.listAuditEntries(context.Background(), AuditProduct, 10)
+		if len(entries) != 2 || entries[1].Action != AuditUpdate {
+			t.Errorf("expected the update to be audited, got %+v", entries)
+		}
+
+		// a product that's new to the catalog still gets an id the others won't clash with
+		id, _ := productRepository.insertProduct(context.Background(), Product{Name: "cable", Price: "4.00"})
+		if id != 12 {
+			t.Errorf("expected the next product to come after the imported ones, got %d", id)
+		}
+		productRepository.deleteProduct(context.Background(), Product{ID: id}, anyVersion, time.Now())
+		report, response = upload(admin, "", "application/x-ndjson", `{"kind": "product", "id": 12, "name": "cable", "price": "4.00"}`)
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		if len(report.Errors) != 1 || report.Errors[0].Error != "product 12 has been deleted" {
+			t.Errorf("expected a deleted product to stay deleted, got %+v", report.Errors)
+		}
+	})
+
+	t.Run("every row with a problem is reported and nothing is imported", func(t *testing.T) {
+		file := `{"kind": "product", "id": 1, "name": "keyboard", "price": "25.00"}
+{"kind": "product", "name": "cable", "price": "cheap"}
+{"kind": "deal", "id": 1, "name": "Half Off", "type": "Percent", "percent": "0.5"}
+
+{"kind": "offering", "product_id": 1, "deal_id": 9}
+{"kind": "coupon"}
+{"kind": "product", "name": "hub", "price": "1.00", "colour": "red"}
+{"kind": "offering", "product_id": 7, "deal_id": 1}
+`
+		report, response := upload(admin, "", "application/x-ndjson", file)
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		var lines []int
+		for _, problem := range report.Errors {
+			lines = append(lines, problem.Line)
+		}
+		if report.Rows != 7 || !reflect.DeepEqual(lines, []int{2, 6, 7}) {
+			t.Errorf("got %d rows with problems on lines %v, want 7 rows with problems on lines 2, 6 and 7", report.Rows, lines)
+		}
+
+		// the references are only checked once every row reads
+		file = strings.Join(strings.Split(file, "\n")[:5], "\n")
+		report, response = upload(admin, "", "application/x-ndjson", file)
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		if len(report.Errors) != 1 || report.Errors[0].Line != 2 {
+			t.Errorf("expected only the price on line 2, got %+v", report.Errors)
+		}
+		file = strings.Replace(file, `"cheap"`, `"2.00"`, 1)
+		report, response = upload(admin, "", "application/x-ndjson", file)
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		if len(report.Errors) != 1 || report.Errors[0].Line != 5 {
+			t.Errorf("expected the offering of a deal that doesn't exist on line 5, got %+v", report.Errors)
+		}
+
+		products, _ := catalog()
+		if len(products) != 3 {
+			t.Errorf("expected nothing to be imported, got %d products", len(products))
+		}
+	})
+
+	t.Run("files that can't be read are refused", func(t *testing.T) {
+		_, response := upload(admin, "", "text/csv", "kind,name,colour\nproduct,cable,red\n")
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		_, response = upload(admin, "", "application/json", "{}")
+		assertStatus(t, response.Code, http.StatusUnsupportedMediaType)
+		_, response = upload(admin, "?dry_run=maybe", "text/csv", csvFile)
+		assertStatus(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("only admins import", func(t *testing.T) {
+		_, response := upload(merchandiser, "", "text/csv", csvFile)
+		assertStatus(t, response.Code, http.StatusForbidden)
+	})
+
+	t.Run("the import command imports a file into the database", func(t *testing.T) {
+		// the command logs to stderr like the server does
+		defer func(previous *Logger) { logger = previous }(logger)
+		dir, err := ioutil.TempDir("", "store-import")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "catalog.csv")
+		// without the offering of the laptop, there's no catalog to refer to
+		ioutil.WriteFile(path, []byte(strings.TrimSuffix(csvFile, "offering,,,,,,,1,20,true\n")), 0600)
+		database := filepath.Join(dir, "store.db")
+
+		var out bytes.Buffer
+		if err := importCommand([]string{"-database", database, "-dry-run", path}, &out); err != nil {
+			t.Fatalf("unable to import, '%v'", err)
+		}
+		if err := importCommand([]string{"-database", database, path}, &out); err != nil {
+			t.Fatalf("unable to import, '%v'", err)
+		}
+		var dryRun, report ImportReport
+		decoder := json.NewDecoder(&out)
+		_ = decoder.Decode(&dryRun)
+		_ = decoder.Decode(&report)
+		if !dryRun.DryRun || report.DryRun || report.Products != 2 {
+			t.Errorf("got reports %+v and %+v", dryRun, report)
+		}
+
+		db, _ := ConnectDatabase(&Config{DatabasePath: database})
+		defer db.Close()
+		var products int
+		db.QueryRow(`SELECT count(*) FROM products;`).Scan(&products)
+		if products != 2 {
+			t.Errorf("expected 2 products imported, got %d", products)
+		}
+
+		if err := importCommand([]string{"-database", database, filepath.Join(dir, "catalog.xlsx")}, &out); err == nil {
+			t.Errorf("expected a file that isn't there to fail")
+		}
+	})
+}
+
+func TestExport(t *testing.T) {
+	// scaffolding
+	config := NewConfig()
+	productRepository := setupTestDatabase(config)
+	productService := NewProductService(config, productRepository)
+	server := NewServer(config, productService)
+	ctx := context.Background()
+	productService.repository.createUsersTable(ctx)
+	productService.repository.createCartTable(ctx)
+	productService.repository.createProductsTable(ctx)
+	productService.repository.createDealsTable(ctx)
+	productService.repository.createOfferingsTable(ctx)
+	productService.repository.insertProduct(ctx, Product{1, "laptop", "very fast", "1000.00", "computers"})
+	productService.repository.insertProduct(ctx, Product{2, "mouse", "much clicky", "10", "accessories"})
+	productService.repository.insertProduct(ctx, Product{3, "usb", "type see", "5.00", ""})
+	productService.repository.insertProduct(ctx, Product{4, "cable", "", "4.00", ""})
+	productService.repository.insertProduct(ctx, Product{5, "monitor", "four kay", "100.00", ""})
+	productService.repository.insertDeal(ctx, Deal{Name: "Regular Price", Type: Retail})
+	productService.repository.insertDeal(ctx, Deal{Name: "Half Off", Type: Percent, Percent: "0.5"})
+	productService.repository.insertDeal(ctx, Deal{Name: "Bulk", Type: Tiered, Tiers: []Tier{{MinQuantity: 1, Price: "3.00"}}})
+	productService.repository.insertDeal(ctx, Deal{Name: "Ten Off", Type: CartFlat, Coupon: "10.00", Threshold: "0"})
+	productService.repository.insertOffering(ctx, Offering{ProductID: 1, DealID: 1, Active: true})
+	productService.repository.insertOffering(ctx, Offering{ProductID: 2, DealID: 2, Active: true})
+	productService.repository.insertOffering(ctx, Offering{ProductID: 3, DealID: 1, Active: false})
+	productService.repository.insertOffering(ctx, Offering{ProductID: 4, DealID: 3, Active: true})
+	productService.repository.insertOffering(ctx, Offering{ProductID: 5, DealID: 1, Active: true})
+	productService.repository.deleteProduct(ctx, Product{ID: 5}, anyVersion, time.Now())
+
+	export := func(format string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(http.MethodGet, "/export/products?format="+format, nil)
+		response := httptest.NewRecorder()
+		server.Handler().ServeHTTP(response, request)
+		return response
+	}
+	want := []ExportedProduct{
+		{1, "laptop", "very fast", "computers", "1000.00", "1000.00", InStock},
+		{2, "mouse", "much clicky", "accessories", "10.00", "5.00", InStock},
+		{3, "usb", "type see", "", "5.00", "5.00", OutOfStock},
+		{4, "cable", "", "", "4.00", "3.00", InStock},
+	}
+
+	t.Run("CSV lists every product with its price after offerings", func(t *testing.T) {
+		response := export("csv")
+		assertStatus(t, response.Code, http.StatusOK)
+		assertResponseBody(t, response.Header().Get("Content-Type"), "text/csv; charset=utf-8")
+		assertResponseBody(t, response.Body.String(), `id,name,description,category,list_price,price,availability
+1,laptop,very fast,computers,1000.00,1000.00,in_stock
+2,mouse,much clicky,accessories,10.00,5.00,in_stock
+3,usb,type see,,5.00,5.00,out_of_stock
+4,cable,,,4.00,3.00,in_stock
+`)
+	})
+
+	t.Run("JSON Lines has one product a line", func(t *testing.T) {
+		response := export("jsonl")
+		assertStatus(t, response.Code, http.StatusOK)
+		var got []ExportedProduct
+		decoder := json.NewDecoder(response.Body)
+		for decoder.More() {
+			var product ExportedProduct
+			if err := decoder.Decode(&product); err != nil {
+				t.Fatalf("unable to parse the export, '%v'", err)
+			}
+			got = append(got, product)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("the XML feed has sale prices", func(t *testing.T) {
+		response := export("xml")
+		assertStatus(t, response.Code, http.StatusOK)
+		var feed struct {
+			Items []struct {
+				ID           int    `xml:"id"`
+				Title        string `xml:"title"`
+				Price        string `xml:"price"`
+				SalePrice    string `xml:"sale_price"`
+				Availability string `xml:"availability"`
+			} `xml:"channel>item"`
+		}
+		if err := xml.Unmarshal(response.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("unable to parse the feed, '%v'", err)
+		}
+		if len(feed.Items) != 4 {
+			t.Fatalf("expected 4 items, got %d", len(feed.Items))
+		}
+		mouse := feed.Items[1]
+		if mouse.Title != "mouse" || mouse.Price != "10.00 USD" || mouse.SalePrice != "5.00 USD" || mouse.Availability != InStock {
+			t.Errorf("got %+v", mouse)
+		}
+		if feed.Items[0].SalePrice != "" {
+			t.Errorf("expected the laptop to have no sale price, got %q", feed.Items[0].SalePrice)
+		}
+	})
+
+	t.Run("products are read a row at a time", func(t *testing.T) {
+		spans := tracetest.NewSpanRecorder()
+		defer func(previous trace.Tracer) { tracer = previous }(tracer)
+		tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("store")
+
+		assertStatus(t, export("csv").Code, http.StatusOK)
+		streamed := false
+		for _, span := range spans.Ended() {
+			if span.Name() == "listProducts" {
+				t.Errorf("expected the export not to list the products")
+			}
+			streamed = streamed || span.Name() == "eachProduct"
+		}
+		if !streamed {
+			t.Errorf("expected the export to stream the products")
+		}
+	})
+
+	t.Run("unknown formats are refused", func(t *testing.T) {
+		assertStatus(t, export("pdf").Code, http.StatusBadRequest)
+		assertStatus(t, export("").Code, http.StatusOK)
+	})
+
+	t.Run("exports run under the export timeout, not the request timeout", func(t *testing.T) {
+		config.RequestTimeout = Duration{time.Nanosecond}
+		defer func() { config.RequestTimeout = NewConfig().RequestTimeout }()
+
+		response := export("csv")
+		assertStatus(t, response.Code, http.StatusOK)
+		if lines := strings.Count(response.Body.String(), "\n"); lines != 5 {
+			t.Errorf("expected the header and 4 products, got %d lines", lines)
+		}
+	})
+
+	t.Run("the feed is written past the server's write timeout", func(t *testing.T) {
+		config.WriteTimeout = Duration{time.Nanosecond}
+		defer func() { config.WriteTimeout = NewConfig().WriteTimeout }()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.Serve(ctx, listener)
+
+		response, err := http.Get("http://" + listener.Addr().String() + "/export/products?format=xml")
+		if err != nil {
+			t.Fatalf("unable to reach the server, '%v'", err)
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("expected the whole feed, '%v'", err)
+		}
+		if !strings.HasSuffix(string(body), "</channel></rss>\n") {
+			t.Errorf("expected the feed to be finished, got %q", body)
+		}
+	})
+
+	t.Run("a feed cut short ends where it stopped", func(t *testing.T) {
+		for id := 10; id < 500; id++ {
+			productService.repository.insertProduct(ctx, Product{id, "cable", strings.Repeat("braided ", 10), "4.00", ""})
+		}
+
+		// the export runs out of time once the first of the feed has gone out
+		requestCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		request, _ := http.NewRequestWithContext(requestCtx, http.MethodGet, "/export/products?format=xml", nil)
+		response := &cancellingRecorder{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+		server.Handler().ServeHTTP(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		body := response.Body.String()
+		if !strings.Contains(body, "<g:id>1</g:id>") {
+			t.Errorf("expected the feed to have started")
+		}
+		if strings.Contains(body, "<g:id>499</g:id>") || strings.HasSuffix(body, "</channel></rss>\n") {
+			t.Errorf("expected the feed to end early, without closing the document")
+		}
+	})
+}
+
+// cancellingRecorder cancels the request once the handler first writes to it
+type cancellingRecorder struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (recorder *cancellingRecorder) Write(bytes []byte) (int, error) {
+	defer recorder.cancel()
+	return recorder.ResponseRecorder.Write(bytes)
+}
+
+func setupTestDatabase(config *Config) (repository *ProductRepository) {
+	// STORE_TEST_POSTGRES_DSN runs the tests against PostgreSQL instead, each test starts from an empty schema
+	if dsn := os.Getenv("STORE_TEST_POSTGRES_DSN"); dsn != "" {
+		config.Database.Driver = DriverPostgres
+		config.Database.DSN = dsn
+		db, err := ConnectDatabase(config)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, statement := range []string{`DROP SCHEMA public CASCADE;`, `CREATE SCHEMA public;`} {
+			if _, err := db.Exec(statement); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		return NewProductRepository(db, DriverPostgres)
+	}
+
+	// Helper method for resetting the database, kept out of the working tree
+	config.DatabasePath = filepath.Join(testDatabaseDir, "store.db")
+	os.Remove(config.DatabasePath)
+	file, err := os.Create(config.DatabasePath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	file.Close()
+
+	db, err := ConnectDatabase(config)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	repository = NewProductRepository(db)
+	repository = NewProductRepository(db, DriverSQLite)
 	return repository
 }
 
+// browser keeps the session cookie between requests, like a browser would
+type browser struct {
+	handler http.Handler
+	cookies []*http.Cookie
+}
+
+func newBrowser(server *Server) *browser {
+	return &browser{handler: server.Handler()}
+}
+
+func (c *browser) ServeHTTP(response *httptest.ResponseRecorder, request *http.Request) {
+	for _, cookie := range c.cookies {
+		request.AddCookie(cookie)
+	}
+	c.handler.ServeHTTP(response, request)
+	for _, cookie := range response.Result().Cookies() {
+		c.cookies = nil
+		if cookie.MaxAge >= 0 {
+			c.cookies = append(c.cookies, cookie)
+		}
+	}
+}
+
+func (c *browser) addToCart(id int) {
+	body, _ := json.Marshal(Product{ID: id})
+	req, _ := http.NewRequest(http.MethodPost, "/cart", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+// signIn creates an account with the role and logs a new browser in to it
+func signIn(t *testing.T, server *Server, email string, role Role) *browser {
+	t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	_, err := server.productService.repository.insertUser(context.Background(), User{Email: email, Role: role, PasswordHash: string(hash)})
+	if err != nil {
+		t.Fatalf("Unable to create account %q, '%v'", email, err)
+	}
+
+	b := newBrowser(server)
+	body, _ := json.Marshal(Credentials{email, "correct horse"})
+	req, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	response := httptest.NewRecorder()
+	b.ServeHTTP(response, req)
+	assertStatus(t, response.Code, http.StatusOK)
+	return b
+}
+
 func newProductRequest(method string, id int, name, description, price string) *http.Request {
 	product := Product{
 		id,
 		name,
 		description,
 		price,
+		"",
 	}
 	body, _ := json.Marshal(product)
 	req, _ := http.NewRequest(method, "/products", bytes.NewBuffer(body))
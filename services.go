@@ -1,107 +1,788 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidSimulation  = errors.New("invalid simulation")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailTaken         = errors.New("an account with that email already exists")
+	ErrUnknownUser        = errors.New("no such account")
+	ErrInvalidRole        = errors.New("invalid role")
+	ErrInvalidAPIKey      = errors.New("invalid api key")
+	ErrUnknownAPIKey      = errors.New("no such api key")
+	ErrNotReady           = errors.New("not ready")
+	ErrUnknownProduct     = errors.New("no such product")
+	ErrVersionMismatch    = errors.New("changed since it was read")
+	ErrInvalidQuantity    = errors.New("quantity can't be negative")
+	ErrUnknownEntity      = errors.New("entity must be product, deal or offering")
+	ErrNotDeleted         = errors.New("product isn't deleted")
+	ErrUnknownDeal        = errors.New("no such deal")
+	ErrUnknownOffering    = errors.New("no such offering")
+	ErrDealInUse          = errors.New("deal is still offered, delete its offerings first")
 )
 
+// anyVersion writes to a product, deal or offering whatever version it's at, for If-Match: *
+const anyVersion = 0
+
 type ProductService struct {
 	config     *Config
 	repository *ProductRepository
+	flags      *FeatureFlags
+	cache      *catalogCache
 }
 
 func NewProductService(config *Config, repository *ProductRepository) *ProductService {
-	return &ProductService{config: config, repository: repository}
+	return &ProductService{config: config, repository: repository, flags: NewFeatureFlags(config.Flags), cache: newCatalogCache()}
+}
+
+// enabled checks a feature flag for whoever is making the request
+func (service *ProductService) enabled(ctx context.Context, flag string) bool {
+	return service.flags.enabled(flag, rolloutKey(ctx))
 }
 
 /* Shopping Cart */
-func (service *ProductService) listCartItems() []Item {
-	return service.repository.listCart()
+func (service *ProductService) newCart(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "newCart")
+	defer span.End()
+	return service.repository.newCart(ctx, 0)
 }
 
-func (service *ProductService) addToCart(product Product) error {
-	return service.repository.addToCart(product)
+func (service *ProductService) listCartItems(ctx context.Context, cartID int) ([]Item, error) {
+	ctx, span := startSpan(ctx, "listCartItems")
+	defer span.End()
+	return service.repository.listCart(ctx, cartID)
 }
 
-func (service *ProductService) updateCart(item Item) error {
-	return service.repository.updateCart(item)
+func (service *ProductService) addToCart(ctx context.Context, cartID int, product Product) error {
+	ctx, span := startSpan(ctx, "addToCart")
+	defer span.End()
+	if !service.enabled(ctx, FlagCheckout) {
+		return ErrFeatureDisabled
+	}
+	if err := service.repository.addToCart(ctx, cartID, product); err != nil {
+		return unknownProduct(err)
+	}
+	cartOperations.WithLabelValues("add").Inc()
+	return nil
 }
 
-func (service *ProductService) removeFromCart(product Product) error {
-	return service.repository.removeFromCart(product)
+func (service *ProductService) updateCart(ctx context.Context, cartID int, item Item) error {
+	ctx, span := startSpan(ctx, "updateCart")
+	defer span.End()
+	if !service.enabled(ctx, FlagCheckout) {
+		return ErrFeatureDisabled
+	}
+	if item.Quantity < 0 {
+		return ErrInvalidQuantity
+	}
+	// setting a product's quantity to 0 takes it out of the cart
+	if item.Quantity == 0 {
+		return service.removeFromCart(ctx, cartID, item.Product)
+	}
+	if err := service.repository.updateCart(ctx, cartID, item); err != nil {
+		return err
+	}
+	cartOperations.WithLabelValues("update").Inc()
+	return nil
 }
 
-func (service *ProductService) calculateTotalPrice() (string, error) {
+func (service *ProductService) removeFromCart(ctx context.Context, cartID int, product Product) error {
+	ctx, span := startSpan(ctx, "removeFromCart")
+	defer span.End()
+	if !service.enabled(ctx, FlagCheckout) {
+		return ErrFeatureDisabled
+	}
+	if err := service.repository.removeFromCart(ctx, cartID, product); err != nil {
+		return err
+	}
+	cartOperations.WithLabelValues("remove").Inc()
+	return nil
+}
+
+// calculateTotalPrice prices the lines of a cart against the cached catalog
+func (service *ProductService) calculateTotalPrice(ctx context.Context, items []Item) (string, []Adjustment, error) {
+	ctx, span := startSpan(ctx, "calculateTotalPrice")
+	defer span.End()
 
-	productOfferings := service.repository.getProductOfferings()
-	total, err := service.totalPrice(productOfferings)
+	if !service.enabled(ctx, FlagCheckout) {
+		return "NAN", nil, ErrFeatureDisabled
+	}
+
+	pricing, err := service.cachedPricing(ctx)
+	if err != nil {
+		return "NAN", nil, err
+	}
+	snapshot := pricing.withItems(items)
+	productOfferings := snapshot.productOfferings(items)
+	if !service.enabled(ctx, FlagDealsBundles) {
+		productOfferings = withoutBundles(productOfferings)
+	}
+	total, breakdown, err := totalPrice(ctx, snapshot, productOfferings, snapshot.cartPromotions())
 	if err != nil {
-		return "NAN", err
+		logger.Error(ctx, "pricing cart", "lines", len(items), "error", err)
+		return "NAN", nil, err
 	}
-	return total, nil
+	return total, breakdown, nil
 }
 
-/* Products */
-func (service *ProductService) getProduct(product Product) Product {
-	if service.config.Enabled {
-		// check if the product exists, otherwise return empty
-		product, err := service.repository.getProduct(product)
-		if err != nil {
-			return Product{}
+// withoutBundles prices bundle lines at retail for sessions that don't have bundles turned on
+func withoutBundles(productOfferings []*ProductOffering) []*ProductOffering {
+	priced := make([]*ProductOffering, len(productOfferings))
+	for i, po := range productOfferings {
+		if po.Type == Bundle {
+			retail := *po
+			retail.Type = Retail
+			po = &retail
 		}
-		return product
+		priced[i] = po
 	}
-	return Product{}
+	return priced
+}
+
+/* Products */
+// getProduct returns an empty product when it doesn't exist
+func (service *ProductService) getProduct(ctx context.Context, product Product) (Product, error) {
+	ctx, span := startSpan(ctx, "getProduct")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogReads) {
+		return service.repository.getProduct(ctx, product)
+	}
+	return Product{}, nil
+}
+
+func (service *ProductService) listProducts(ctx context.Context) ([]*Product, error) {
+	ctx, span := startSpan(ctx, "listProducts")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogReads) {
+		return service.cachedProducts(ctx)
+	}
+	return []*Product{}, nil
+}
+
+func (service *ProductService) newProduct(ctx context.Context, product Product) error {
+	ctx, span := startSpan(ctx, "newProduct")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(service.audited(ctx, AuditProduct, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			var err error
+			product.ID, err = service.repository.insertProduct(ctx, product)
+			return product.ID, nil, product, err
+		}))
+	}
+	return ErrFeatureDisabled
 
 }
 
-func (service *ProductService) listProducts() []*Product {
-	if service.config.Enabled {
-		return service.repository.listProducts()
+// getVersionedProduct returns an empty product when it doesn't exist
+func (service *ProductService) getVersionedProduct(ctx context.Context, productID int) (Product, int, error) {
+	ctx, span := startSpan(ctx, "getVersionedProduct")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogReads) {
+		return service.repository.getVersionedProduct(ctx, productID)
 	}
-	return []*Product{}
+	return Product{}, 0, nil
 }
 
-func (service *ProductService) newProduct(product Product) error {
-	if service.config.Enabled {
-		return service.repository.insertProduct(product)
+// updateProduct only updates the product while it's at version, see anyVersion
+func (service *ProductService) updateProduct(ctx context.Context, product Product, version int) error {
+	ctx, span := startSpan(ctx, "updateProduct")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(unknownProduct(service.audited(ctx, AuditProduct, AuditUpdate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			before, _, err := service.repository.getVersionedProduct(ctx, product.ID)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return product.ID, before, product, service.repository.updateProduct(ctx, product, version)
+		})))
 	}
-	return errors.New("Operation Not Permitted")
+	return ErrFeatureDisabled
+}
 
+func (service *ProductService) deleteProduct(ctx context.Context, product Product, version int) error {
+	ctx, span := startSpan(ctx, "deleteProduct")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(unknownProduct(service.audited(ctx, AuditProduct, AuditDelete, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			before, _, err := service.repository.getVersionedProduct(ctx, product.ID)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return product.ID, before, nil, service.repository.deleteProduct(ctx, product, version, time.Now().UTC())
+		})))
+	}
+	return ErrFeatureDisabled
 }
 
-func (service *ProductService) updateProduct(product Product) error {
-	if service.config.Enabled {
-		return service.repository.updateProduct(product)
+// restoreProduct brings back a deleted product, ErrNotDeleted when it wasn't
+func (service *ProductService) restoreProduct(ctx context.Context, productID int) error {
+	ctx, span := startSpan(ctx, "restoreProduct")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(unknownProduct(service.audited(ctx, AuditProduct, AuditRestore, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			if err := service.repository.restoreProduct(ctx, productID); err != nil {
+				return 0, nil, nil, err
+			}
+			after, _, err := service.repository.getVersionedProduct(ctx, productID)
+			return productID, nil, after, err
+		})))
 	}
-	return errors.New("Operation Not Permitted")
+	return ErrFeatureDisabled
 }
 
-func (service *ProductService) deleteProduct(product Product) error {
-	if service.config.Enabled {
-		return service.repository.deleteProduct(product)
+func unknownProduct(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrUnknownProduct
 	}
-	return errors.New("Operation Not Permitted")
+	return err
 }
 
 /* Deals */
-func (service *ProductService) newDeal(deal Deal) error {
-	if service.config.Enabled {
-		return service.repository.insertDeal(deal)
+func (service *ProductService) newDeal(ctx context.Context, deal Deal) error {
+	ctx, span := startSpan(ctx, "newDeal")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		if err := validateDeal(deal); err != nil {
+			return err
+		}
+		if deal.Type == Bundle && !service.enabled(ctx, FlagDealsBundles) {
+			return ErrFeatureDisabled
+		}
+		return service.invalidate(service.audited(ctx, AuditDeal, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			var err error
+			deal.ID, err = service.repository.insertDeal(ctx, deal)
+			return deal.ID, nil, deal, err
+		}))
 	}
-	return errors.New("Operation Not Permitted")
+	return ErrFeatureDisabled
 }
 
-func (service *ProductService) listDeals() []*Deal {
-	if service.config.Enabled {
-		return service.repository.listDeals()
+// getDeal returns an empty deal when it doesn't exist
+func (service *ProductService) getDeal(ctx context.Context, dealID int) (Deal, int, error) {
+	ctx, span := startSpan(ctx, "getDeal")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogReads) {
+		return service.repository.getDeal(ctx, dealID)
 	}
-	return []*Deal{}
+	return Deal{}, 0, nil
+}
+
+// updateDeal only updates the deal while it's at version, see anyVersion
+func (service *ProductService) updateDeal(ctx context.Context, deal Deal, version int) error {
+	ctx, span := startSpan(ctx, "updateDeal")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		if err := validateDeal(deal); err != nil {
+			return err
+		}
+		if deal.Type == Bundle && !service.enabled(ctx, FlagDealsBundles) {
+			return ErrFeatureDisabled
+		}
+		return service.invalidate(unknownDeal(service.audited(ctx, AuditDeal, AuditUpdate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			before, _, err := service.repository.getDeal(ctx, deal.ID)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return deal.ID, before, deal, service.repository.updateDeal(ctx, deal, version)
+		})))
+	}
+	return ErrFeatureDisabled
+}
+
+// deleteDeal only deletes a deal that isn't offered anymore, see ErrDealInUse
+func (service *ProductService) deleteDeal(ctx context.Context, dealID int, version int) error {
+	ctx, span := startSpan(ctx, "deleteDeal")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(unknownDeal(service.audited(ctx, AuditDeal, AuditDelete, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			before, _, err := service.repository.getDeal(ctx, dealID)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return dealID, before, nil, service.repository.deleteDeal(ctx, dealID, version)
+		})))
+	}
+	return ErrFeatureDisabled
+}
+
+func unknownDeal(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrUnknownDeal
+	}
+	return err
+}
+
+func (service *ProductService) listDeals(ctx context.Context) ([]*Deal, error) {
+	ctx, span := startSpan(ctx, "listDeals")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogReads) {
+		return service.cachedDeals(ctx)
+	}
+	return []*Deal{}, nil
 }
 
 /* Offerings */
-func (service *ProductService) newOffering(offering Offering) error {
-	if service.config.Enabled {
-		return service.repository.insertOffering(offering)
+func (service *ProductService) newOffering(ctx context.Context, offering Offering) error {
+	ctx, span := startSpan(ctx, "newOffering")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(service.audited(ctx, AuditOffering, AuditCreate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			var err error
+			offering.ID, err = service.repository.insertOffering(ctx, offering)
+			return offering.ID, nil, offering, err
+		}))
+	}
+	return ErrFeatureDisabled
+}
+
+// getOffering returns an empty offering when it doesn't exist
+func (service *ProductService) getOffering(ctx context.Context, offeringID int) (Offering, int, error) {
+	ctx, span := startSpan(ctx, "getOffering")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogReads) {
+		return service.repository.getOffering(ctx, offeringID)
+	}
+	return Offering{}, 0, nil
+}
+
+// updateOffering only updates the offering while it's at version, see anyVersion
+func (service *ProductService) updateOffering(ctx context.Context, offering Offering, version int) error {
+	ctx, span := startSpan(ctx, "updateOffering")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(unknownOffering(service.audited(ctx, AuditOffering, AuditUpdate, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			before, _, err := service.repository.getOffering(ctx, offering.ID)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return offering.ID, before, offering, service.repository.updateOffering(ctx, offering, version)
+		})))
+	}
+	return ErrFeatureDisabled
+}
+
+func (service *ProductService) deleteOffering(ctx context.Context, offeringID int, version int) error {
+	ctx, span := startSpan(ctx, "deleteOffering")
+	defer span.End()
+	if service.enabled(ctx, FlagCatalogWrites) {
+		return service.invalidate(unknownOffering(service.audited(ctx, AuditOffering, AuditDelete, func(ctx context.Context) (int, interface{}, interface{}, error) {
+			before, _, err := service.repository.getOffering(ctx, offeringID)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			return offeringID, before, nil, service.repository.deleteOffering(ctx, offeringID, version)
+		})))
+	}
+	return ErrFeatureDisabled
+}
+
+func unknownOffering(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrUnknownOffering
+	}
+	return err
+}
+
+/* Audit Log */
+
+/*
+   Makes a change to an entity and records it in the audit log, both in one
+   transaction so there's never a change without its entry. change returns
+   the id of what it changed and its state before and after, nil when there
+   isn't one, like before a create or after a delete.
+*/
+func (service *ProductService) audited(ctx context.Context, entity string, action string, change func(ctx context.Context) (id int, before interface{}, after interface{}, err error)) error {
+	return service.repository.atomically(ctx, func(ctx context.Context) error {
+		id, before, after, err := change(ctx)
+		if err != nil {
+			return err
+		}
+
+		scope := requestScopeFromContext(ctx)
+		entry := AuditEntry{
+			Entity:    entity,
+			EntityID:  id,
+			Action:    action,
+			UserID:    scope.userID,
+			APIKeyID:  scope.apiKeyID,
+			RequestID: scope.id,
+			CreatedAt: time.Now().UTC(),
+		}
+		if before != nil {
+			if entry.Before, err = json.Marshal(before); err != nil {
+				return err
+			}
+		}
+		if after != nil {
+			if entry.After, err = json.Marshal(after); err != nil {
+				return err
+			}
+		}
+		return service.repository.insertAuditEntry(ctx, entry)
+	})
+}
+
+// listAuditEntries lists the changes to an entity, or to all of them of a kind when entityID is 0
+func (service *ProductService) listAuditEntries(ctx context.Context, entity string, entityID int) ([]*AuditEntry, error) {
+	ctx, span := startSpan(ctx, "listAuditEntries")
+	defer span.End()
+	switch entity {
+	case AuditProduct, AuditDeal, AuditOffering:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEntity, entity)
+	}
+	return service.repository.listAuditEntries(ctx, entity, entityID)
+}
+
+/* Pricing */
+
+// simulatePrice prices items against the saved catalog with the simulation's
+// deals and offerings laid over it, without saving anything or reading the cart
+func (service *ProductService) simulatePrice(ctx context.Context, simulation Simulation) (ShoppingCart, error) {
+	ctx, span := startSpan(ctx, "simulatePrice")
+	defer span.End()
+	if !service.enabled(ctx, FlagPricingSimulate) {
+		return ShoppingCart{}, ErrFeatureDisabled
+	}
+
+	for _, deal := range simulation.Deals {
+		if deal.ID < 1 {
+			return ShoppingCart{}, fmt.Errorf("%w: hypothetical deals need an id", ErrInvalidSimulation)
+		}
+		if err := validateDeal(deal); err != nil {
+			return ShoppingCart{}, err
+		}
+	}
+
+	products, err := service.cachedProducts(ctx)
+	if err != nil {
+		return ShoppingCart{}, err
+	}
+	deals, err := service.cachedDeals(ctx)
+	if err != nil {
+		return ShoppingCart{}, err
+	}
+	offerings, err := service.cachedOfferings(ctx)
+	if err != nil {
+		return ShoppingCart{}, err
+	}
+	// the snapshot copies what it's given, so the overlay doesn't touch the cache
+	snapshot := newCatalogSnapshot(products, deals, offerings)
+	snapshot.overlay(simulation.Deals, simulation.Offerings)
+
+	items := []Item{}
+	for _, item := range simulation.Items {
+		product, ok := snapshot.products[item.Product.ID]
+		if !ok {
+			return ShoppingCart{}, fmt.Errorf("%w: product %d does not exist", ErrInvalidSimulation, item.Product.ID)
+		}
+		if item.Quantity < 1 {
+			return ShoppingCart{}, fmt.Errorf("%w: product %d needs a quantity", ErrInvalidSimulation, item.Product.ID)
+		}
+		items = append(items, Item{product, item.Quantity})
+	}
+
+	if len(items) == 0 {
+		return ShoppingCart{}, nil
+	}
+
+	productOfferings := snapshot.productOfferings(items)
+	if !service.enabled(ctx, FlagDealsBundles) {
+		productOfferings = withoutBundles(productOfferings)
+	}
+	total, breakdown, err := totalPrice(ctx, snapshot, productOfferings, snapshot.cartPromotions())
+	if err != nil {
+		return ShoppingCart{}, err
+	}
+	return ShoppingCart{items, total, breakdown}, nil
+}
+
+/* Accounts */
+func (service *ProductService) register(ctx context.Context, credentials Credentials) (User, error) {
+	ctx, span := startSpan(ctx, "register")
+	defer span.End()
+	email := strings.ToLower(strings.TrimSpace(credentials.Email))
+	if !strings.Contains(email, "@") || len(credentials.Password) < 8 {
+		return User{}, fmt.Errorf("%w: an email and a password of at least 8 characters are required", ErrInvalidCredentials)
+	}
+
+	existing, err := service.repository.getUserByEmail(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+	if existing.ID != 0 {
+		return User{}, ErrEmailTaken
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{Email: email, Role: RoleCustomer, PasswordHash: string(hash)}
+	user.ID, err = service.repository.insertUser(ctx, user)
+	return user, err
+}
+
+func (service *ProductService) login(ctx context.Context, credentials Credentials) (User, error) {
+	ctx, span := startSpan(ctx, "login")
+	defer span.End()
+	email := strings.ToLower(strings.TrimSpace(credentials.Email))
+	user, err := service.repository.getUserByEmail(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+	if user.ID == 0 {
+		return User{}, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(credentials.Password)) != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// getUser returns the account behind a session, empty when it no longer exists
+func (service *ProductService) getUser(ctx context.Context, userID int) (User, error) {
+	ctx, span := startSpan(ctx, "getUser")
+	defer span.End()
+	return service.repository.getUser(ctx, userID)
+}
+
+func (service *ProductService) setRole(ctx context.Context, user User) error {
+	ctx, span := startSpan(ctx, "setRole")
+	defer span.End()
+	switch user.Role {
+	case RoleCustomer, RoleMerchandiser, RoleAdmin:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidRole, user.Role)
+	}
+	err := service.repository.updateUserRole(ctx, user)
+	if err == sql.ErrNoRows {
+		return ErrUnknownUser
+	}
+	if err == nil {
+		logger.Info(ctx, "role changed", "account_id", user.ID, "role", user.Role)
+	}
+	return err
+}
+
+/*
+   Makes the account with this email an admin, registering it first when
+   there isn't one yet, so a new deployment has someone to hand out roles.
+   The password is only needed for a new account.
+*/
+func (service *ProductService) createAdmin(ctx context.Context, credentials Credentials) (User, error) {
+	ctx, span := startSpan(ctx, "createAdmin")
+	defer span.End()
+	user, err := service.repository.getUserByEmail(ctx, strings.ToLower(strings.TrimSpace(credentials.Email)))
+	if err != nil {
+		return User{}, err
+	}
+	if user.ID == 0 {
+		if user, err = service.register(ctx, credentials); err != nil {
+			return User{}, err
+		}
+	}
+	user.Role = RoleAdmin
+	return user, service.setRole(ctx, user)
+}
+
+// accountCart returns the customer's cart, merging the anonymous cart they
+// were shopping with into it. anonymousCartID is 0 when there wasn't one.
+func (service *ProductService) accountCart(ctx context.Context, user User, anonymousCartID int) (int, error) {
+	ctx, span := startSpan(ctx, "accountCart")
+	defer span.End()
+	cartID, err := service.repository.getUserCart(ctx, user.ID)
+	if err != nil {
+		return 0, err
+	}
+	if cartID == 0 {
+		cartID, err = service.repository.newCart(ctx, user.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if anonymousCartID != 0 && anonymousCartID != cartID {
+		if err := service.repository.mergeCarts(ctx, anonymousCartID, cartID); err != nil {
+			return 0, err
+		}
+	}
+	return cartID, nil
+}
+
+/* Health */
+
+// ready is nil when the database is reachable and its schema is the one this server expects
+func (service *ProductService) ready(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "ready")
+	defer span.End()
+	if err := service.repository.ping(ctx); err != nil {
+		return fmt.Errorf("%w: database unreachable: %v", ErrNotReady, err)
+	}
+	version, err := service.repository.schemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: reading schema version: %v", ErrNotReady, err)
+	}
+	if version != service.repository.latestSchemaVersion() {
+		return fmt.Errorf("%w: database is at schema version %d, expected %d", ErrNotReady, version, service.repository.latestSchemaVersion())
+	}
+	return nil
+}
+
+func (service *ProductService) version(ctx context.Context) Version {
+	ctx, span := startSpan(ctx, "version")
+	defer span.End()
+	// a database we can't read reports schema version 0
+	schemaVersion, _ := service.repository.schemaVersion(ctx)
+	return Version{
+		Commit:        buildCommit,
+		BuildTime:     buildTime,
+		GoVersion:     runtime.Version(),
+		SchemaVersion: schemaVersion,
+	}
+}
+
+/* Feature Flags */
+func (service *ProductService) listFlags(ctx context.Context) []FeatureFlag {
+	return service.flags.list()
+}
+
+func (service *ProductService) setFlag(ctx context.Context, flag FeatureFlag) error {
+	if err := service.flags.set(flag); err != nil {
+		return err
+	}
+	logger.Info(ctx, "feature flag changed", "flag", flag.Name, "enabled", flag.Enabled, "rollout", flag.Rollout)
+	return nil
+}
+
+/* API Keys */
+
+// the resources an API key can be scoped to
+var apiKeyResources = []string{"products", "deals", "offerings"}
+
+const apiKeyPrefix = "esk_"
+
+/*
+   Issues a new key for the admin creating it. The key is only ever returned
+   from here, what's stored is its hash and enough of a prefix to recognise it.
+*/
+func (service *ProductService) issueAPIKey(ctx context.Context, admin User, key APIKey) (APIKey, error) {
+	ctx, span := startSpan(ctx, "issueAPIKey")
+	defer span.End()
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return APIKey{}, fmt.Errorf("%w: a name is required", ErrInvalidAPIKey)
+	}
+	if len(key.Scopes) == 0 {
+		return APIKey{}, fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKey)
+	}
+	for _, scope := range key.Scopes {
+		if !validScope(scope) {
+			return APIKey{}, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKey, scope)
+		}
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, err
+	}
+	key.Key = apiKeyPrefix + hex.EncodeToString(secret)
+	key.Prefix = key.Key[:len(apiKeyPrefix)+8]
+	key.KeyHash = hashAPIKey(key.Key)
+	key.CreatedBy = admin.ID
+	key.CreatedAt = time.Now().UTC()
+	key.LastUsedAt, key.RevokedAt = nil, nil
+
+	var err error
+	key.ID, err = service.repository.insertAPIKey(ctx, key)
+	if err == nil {
+		logger.Info(ctx, "api key issued", "api_key_id", key.ID, "prefix", key.Prefix, "scopes", key.Scopes)
+	}
+	return key, err
+}
+
+func (service *ProductService) listAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	ctx, span := startSpan(ctx, "listAPIKeys")
+	defer span.End()
+	return service.repository.listAPIKeys(ctx)
+}
+
+func (service *ProductService) revokeAPIKey(ctx context.Context, keyID int) error {
+	ctx, span := startSpan(ctx, "revokeAPIKey")
+	defer span.End()
+	err := service.repository.revokeAPIKey(ctx, keyID, time.Now().UTC())
+	if err == sql.ErrNoRows {
+		return ErrUnknownAPIKey
+	}
+	if err == nil {
+		logger.Info(ctx, "api key revoked", "api_key_id", keyID)
+	}
+	return err
+}
+
+// authenticateAPIKey finds the key a client sent and records that it was used
+func (service *ProductService) authenticateAPIKey(ctx context.Context, secret string) (APIKey, error) {
+	ctx, span := startSpan(ctx, "authenticateAPIKey")
+	defer span.End()
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	key, err := service.repository.getAPIKeyByHash(ctx, hashAPIKey(secret))
+	if err != nil {
+		return APIKey{}, err
+	}
+	if key.ID == 0 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	usedAt := time.Now().UTC()
+	if err := service.repository.touchAPIKey(ctx, key.ID, usedAt); err != nil {
+		return APIKey{}, err
+	}
+	key.LastUsedAt = &usedAt
+	return key, nil
+}
+
+// keys are long and random, so a plain SHA-256 is enough and lets us look them up by hash
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	parts := strings.Split(scope, ":")
+	if len(parts) != 2 || (parts[1] != "read" && parts[1] != "write") {
+		return false
+	}
+	for _, resource := range apiKeyResources {
+		if parts[0] == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the key may read, or with write set change, the resource
+func (key APIKey) allows(resource string, write bool) bool {
+	for _, scope := range key.Scopes {
+		if scope == resource+":write" || (!write && scope == resource+":read") {
+			return true
+		}
 	}
-	return errors.New("Operation Not Permitted")
+	return false
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+/* SQLite, the default. The schema version is kept in PRAGMA user_version. */
+type sqliteDialect struct{}
+
+// SQLite takes ? placeholders as they are
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) table(name string) string {
+	return sqliteTables[name]
+}
+
+func (sqliteDialect) migrations() []migration {
+	return sqliteMigrations
+}
+
+func (sqliteDialect) schemaVersion(ctx context.Context, database *sql.DB) (int, error) {
+	var version int
+	err := database.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&version)
+	return version, err
+}
+
+func (sqliteDialect) setSchemaVersion(ctx context.Context, database *sql.DB, version int) error {
+	// PRAGMA doesn't take placeholders
+	_, err := database.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d;`, version))
+	return err
+}
+
+func (sqliteDialect) hasColumn(ctx context.Context, database *sql.DB, table string, column string) (bool, error) {
+	var columns int
+	err := database.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info(?) WHERE name = ?;`, table, column).Scan(&columns)
+	return columns > 0, err
+}
+
+// writers take turns on SQLite, so there are no conflicts to retry
+func (sqliteDialect) retryable(err error) bool {
+	return false
+}
+
+// AUTOINCREMENT already carries on from the largest id inserted
+func (sqliteDialect) advanceSequence(ctx context.Context, database querier, table string) error {
+	return nil
+}
+
+var sqliteTables = map[string]string{
+	"cart": `CREATE TABLE cart (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"cart_id" INTEGER NOT NULL DEFAULT 0,
+		"product_id" INTEGER NOT NULL,
+		"quantity" INTEGER NOT NULL DEFAULT 1,
+		FOREIGN KEY (cart_id) REFERENCES carts (id),
+		FOREIGN KEY (product_id) REFERENCES products (id)
+	  );`,
+
+	// a product is on one line of a cart, adding it again adds to that line's quantity
+	"cart_lines": `CREATE UNIQUE INDEX IF NOT EXISTS cart_lines ON cart (cart_id, product_id);`,
+
+	"carts": `CREATE TABLE carts (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER UNIQUE,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	  );`,
+
+	"users": `CREATE TABLE users (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		email VARCHAR(254) NOT NULL UNIQUE,
+		password_hash VARCHAR(60) NOT NULL,
+		role VARCHAR(16) NOT NULL DEFAULT "customer"
+	  );`,
+
+	"api_keys": `CREATE TABLE api_keys (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(64) NOT NULL,
+		prefix VARCHAR(16) NOT NULL,
+		key_hash CHAR(64) NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_by INTEGER,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY (created_by) REFERENCES users (id)
+	  );`,
+
+	"products": `CREATE TABLE products (
+		id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		price VARCHAR(8) NOT NULL DEFAULT "NAN",
+		name VARCHAR(32) NOT NULL DEFAULT "EMPTY",
+		description TEXT,
+		category VARCHAR(32) NOT NULL DEFAULT "",
+		version INTEGER NOT NULL DEFAULT 1,
+		deleted_at DATETIME
+	  );`,
+
+	"deals": `CREATE TABLE deals (
+	    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	    name VARCHAR(32) NOT NULL DEFAULT "Regular Price",
+	    type VARCHAR(16) NOT NULL DEFAULT "Retail",
+	    coupon VARCHAR(8) NOT NULL DEFAULT "0.00",
+	    percent VARCHAR(8) NOT NULL DEFAULT "0.00",
+	    x INTEGER NOT NULL DEFAULT 0,
+	    y INTEGER NOT NULL DEFAULT 0,
+	    exclusive BOOLEAN NOT NULL DEFAULT 1,
+	    threshold VARCHAR(8) NOT NULL DEFAULT "0.00",
+	    min_quantity INTEGER NOT NULL DEFAULT 0,
+	    category VARCHAR(32) NOT NULL DEFAULT "",
+	    version INTEGER NOT NULL DEFAULT 1,
+	    active BOOLEAN NOT NULL DEFAULT 1
+	);`,
+
+	"deal_tiers": `CREATE TABLE deal_tiers (
+	    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	    deal_id INTEGER NOT NULL,
+	    min_quantity INTEGER NOT NULL DEFAULT 1,
+	    max_quantity INTEGER NOT NULL DEFAULT 0,
+	    price VARCHAR(8) NOT NULL DEFAULT "NAN",
+	    FOREIGN KEY (deal_id) REFERENCES deals (id)
+	);`,
+
+	"audit_log": `CREATE TABLE audit_log (
+	    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	    entity VARCHAR(16) NOT NULL,
+	    entity_id INTEGER NOT NULL,
+	    action VARCHAR(8) NOT NULL,
+	    user_id INTEGER,
+	    api_key_id INTEGER,
+	    request_id VARCHAR(128) NOT NULL DEFAULT "",
+	    before_state TEXT,
+	    after_state TEXT,
+	    created_at DATETIME NOT NULL
+	);`,
+
+	"audit_log_entities": `CREATE INDEX IF NOT EXISTS audit_log_entities ON audit_log (entity, entity_id);`,
+
+	"audit_log_no_updates": `CREATE TRIGGER audit_log_no_updates BEFORE UPDATE ON audit_log
+	    BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`,
+
+	"audit_log_no_deletes": `CREATE TRIGGER audit_log_no_deletes BEFORE DELETE ON audit_log
+	    BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END;`,
+
+	"offerings": `CREATE TABLE offerings (
+	    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	    product_id INTEGER NOT NULL,
+	    deal_id INTEGER NOT NULL,
+	    modified_price VARCHAR(8) NOT NULL DEFAULT "NAN",
+	    active BOOLEAN NOT NULL DEFAULT 1,
+	    version INTEGER NOT NULL DEFAULT 1,
+	    FOREIGN KEY (product_id) REFERENCES products (id),
+	    FOREIGN KEY (deal_id) REFERENCES deals (id) );`,
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+/*
+   Every deal type is priced by a strategy registered against its DealType.
+   Item-level deals register a DealStrategy and are priced one deal at a time
+   with all of the cart lines offered under that deal. Cart-level promotions
+   register a CartStrategy and are evaluated after every item has been priced.
+
+   A deal type without a registered strategy can't be created.
+*/
+
+var ErrInvalidDeal = errors.New("invalid deal")
+
+type DealStrategy interface {
+	// Validate rejects deals whose fields don't make sense for the type
+	Validate(deal Deal) error
+	// Price charges the engine for the cart lines offered under a single deal
+	Price(engine *pricingEngine, lines []*ProductOffering) error
+}
+
+type CartStrategy interface {
+	// Validate rejects deals whose fields don't make sense for the type
+	Validate(deal Deal) error
+	// Discount is what the promotion takes off a qualifying subtotal
+	Discount(promotion *CartPromotion, subtotal decimal.Decimal) (decimal.Decimal, error)
+}
+
+var (
+	dealStrategies = make(map[DealType]DealStrategy)
+	cartStrategies = make(map[DealType]CartStrategy)
+)
+
+func RegisterDealStrategy(dtype DealType, strategy DealStrategy) {
+	dealStrategies[dtype] = strategy
+}
+
+func RegisterCartStrategy(dtype DealType, strategy CartStrategy) {
+	cartStrategies[dtype] = strategy
+}
+
+func init() {
+	RegisterDealStrategy(Retail, retailStrategy{})
+	RegisterDealStrategy(Percent, percentStrategy{})
+	RegisterDealStrategy(Flat, flatStrategy{})
+	RegisterDealStrategy(Coupon, flatStrategy{})
+	RegisterDealStrategy(BuyXGetY, buyXGetYStrategy{})
+	RegisterDealStrategy(Bundle, bundleStrategy{})
+	RegisterDealStrategy(Tiered, tieredStrategy{})
+	RegisterCartStrategy(CartFlat, cartFlatStrategy{})
+	RegisterCartStrategy(CartPercent, cartPercentStrategy{})
+}
+
+// validateDeal looks up the strategy for the deal's type and lets it check the deal
+func validateDeal(deal Deal) error {
+	if deal.Category != "" && deal.Type != BuyXGetY {
+		return fmt.Errorf("%w: only BuyXGetY deals can be offered on a category", ErrInvalidDeal)
+	}
+	if strategy, ok := dealStrategies[deal.Type]; ok {
+		return strategy.Validate(deal)
+	}
+	if strategy, ok := cartStrategies[deal.Type]; ok {
+		return strategy.Validate(deal)
+	}
+	return fmt.Errorf("%w: unknown deal type %q", ErrInvalidDeal, deal.Type)
+}
+
+// parses a money field that has to be there and can't be negative
+func validateAmount(field string, value string) error {
+	amount, err := decimal.NewFromString(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s %q is not a number", ErrInvalidDeal, field, value)
+	}
+	if amount.IsNegative() {
+		return fmt.Errorf("%w: %s can't be negative", ErrInvalidDeal, field)
+	}
+	return nil
+}
+
+// percents are stored as fractions, so they have to be in the range (0, 1]
+func validateFraction(field string, value string) error {
+	fraction, err := decimal.NewFromString(value)
+	if err != nil {
+		return fmt.Errorf("%w: %s %q is not a number", ErrInvalidDeal, field, value)
+	}
+	if !fraction.IsPositive() || fraction.GreaterThan(decimal.NewFromInt(1)) {
+		return fmt.Errorf("%w: %s must be a fraction between 0 and 1", ErrInvalidDeal, field)
+	}
+	return nil
+}
+
+/* Regular price, no discount */
+type retailStrategy struct{}
+
+func (retailStrategy) Validate(deal Deal) error {
+	return nil
+}
+
+func (retailStrategy) Price(engine *pricingEngine, lines []*ProductOffering) error {
+	for _, po := range lines {
+		price, err := decimal.NewFromString(po.Price)
+		if err != nil {
+			return err
+		}
+		quantity := decimal.NewFromInt(int64(po.Quantity))
+		engine.charge(po, price.Mul(quantity))
+	}
+	return nil
+}
+
+/* Pay a fraction of the price, a Percent of "0.5" is half off */
+type percentStrategy struct{}
+
+func (percentStrategy) Validate(deal Deal) error {
+	return validateFraction("percent", deal.Percent)
+}
+
+func (percentStrategy) Price(engine *pricingEngine, lines []*ProductOffering) error {
+	for _, po := range lines {
+		price, err := decimal.NewFromString(po.Price)
+		if err != nil {
+			return err
+		}
+		percent, err := decimal.NewFromString(po.Percent)
+		if err != nil {
+			return err
+		}
+		quantity := decimal.NewFromInt(int64(po.Quantity))
+		engine.charge(po, price.Mul(quantity).Mul(percent))
+	}
+	return nil
+}
+
+/*
+   A flat reduction in price, the Coupon amount comes off every unit. A
+   coupon worth more than the product makes it free, never less than free.
+*/
+type flatStrategy struct{}
+
+func (flatStrategy) Validate(deal Deal) error {
+	return validateAmount("coupon", deal.Coupon)
+}
+
+func (flatStrategy) Price(engine *pricingEngine, lines []*ProductOffering) error {
+	for _, po := range lines {
+		price, err := decimal.NewFromString(po.Price)
+		if err != nil {
+			return err
+		}
+		coupon, err := decimal.NewFromString(po.Coupon)
+		if err != nil {
+			return err
+		}
+		quantity := decimal.NewFromInt(int64(po.Quantity))
+		discountedPrice := decimal.Max(price.Sub(coupon), decimal.Zero)
+		engine.charge(po, discountedPrice.Mul(quantity))
+	}
+	return nil
+}
+
+/*
+   Buy X get Y free. The quantities of every line offered under the deal are
+   pooled, so "buy any 2 cables get 1 free" works across products, and the
+   free units are always the cheapest ones in the pool. When the pool spans
+   more than one product the free units are listed in the breakdown.
+*/
+type buyXGetYStrategy struct{}
+
+func (buyXGetYStrategy) Validate(deal Deal) error {
+	if deal.X < 1 || deal.Y < 1 {
+		return fmt.Errorf("%w: x and y must both be at least 1", ErrInvalidDeal)
+	}
+	return nil
+}
+
+func (buyXGetYStrategy) Price(engine *pricingEngine, lines []*ProductOffering) error {
+	prices := make([]decimal.Decimal, len(lines))
+	pooled := 0
+	for i, po := range lines {
+		price, err := decimal.NewFromString(po.Price)
+		if err != nil {
+			return err
+		}
+		prices[i] = price
+		pooled += po.Quantity
+	}
+
+	// recurse over the number of items to calculate full price items
+	free := pooled - buyXGetYPrice(pooled, lines[0].X, lines[0].Y)
+
+	// hand the free units out cheapest first
+	cheapest := make([]int, len(lines))
+	for i := range cheapest {
+		cheapest[i] = i
+	}
+	sort.SliceStable(cheapest, func(a, b int) bool { return prices[cheapest[a]].LessThan(prices[cheapest[b]]) })
+
+	freeUnits := make([]int, len(lines))
+	for _, i := range cheapest {
+		if free == 0 {
+			break
+		}
+		freeUnits[i] = lines[i].Quantity
+		if freeUnits[i] > free {
+			freeUnits[i] = free
+		}
+		free -= freeUnits[i]
+	}
+
+	mixAndMatch := len(lines) > 1 || lines[0].Category != ""
+	for i, po := range lines {
+		quantity := decimal.NewFromInt(int64(po.Quantity - freeUnits[i]))
+		engine.charge(po, prices[i].Mul(quantity))
+
+		if mixAndMatch && freeUnits[i] > 0 {
+			engine.adjust(Adjustment{
+				DealID:    po.DealID,
+				DealName:  po.DealName,
+				Type:      po.Type,
+				ProductID: po.ProductID,
+				Quantity:  freeUnits[i],
+				Discount:  prices[i].Mul(decimal.NewFromInt(int64(freeUnits[i]))).String(),
+			})
+		}
+	}
+	return nil
+}
+
+/*
+   Bundles are sold at the offering's modified price once every component of
+   the bundle is in the cart, until then each item is charged at retail.
+*/
+type bundleStrategy struct{}
+
+func (bundleStrategy) Validate(deal Deal) error {
+	return nil
+}
+
+func (bundleStrategy) Price(engine *pricingEngine, lines []*ProductOffering) error {
+	components, err := engine.catalog.getBundleComponents(engine.ctx, lines[0].DealID)
+	if err != nil {
+		return err
+	}
+	for _, po := range lines {
+		if len(components) == len(lines) {
+			price, err := decimal.NewFromString(po.ModifiedPrice)
+			if err != nil {
+				return err
+			}
+			engine.charge(po, price)
+			break
+		}
+		/* add up the retail prices x quantity */
+		price, err := decimal.NewFromString(po.Price)
+		if err != nil {
+			return err
+		}
+		engine.charge(po, price)
+	}
+	return nil
+}
+
+/* Volume pricing, every unit on a line costs the price of the tier its quantity falls in */
+type tieredStrategy struct{}
+
+func (tieredStrategy) Validate(deal Deal) error {
+	if len(deal.Tiers) == 0 {
+		return fmt.Errorf("%w: a tiered deal needs at least one tier", ErrInvalidDeal)
+	}
+
+	tiers := make([]Tier, len(deal.Tiers))
+	copy(tiers, deal.Tiers)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinQuantity < tiers[j].MinQuantity })
+
+	for i, tier := range tiers {
+		if tier.MinQuantity < 1 {
+			return fmt.Errorf("%w: tier min_quantity must be at least 1", ErrInvalidDeal)
+		}
+		if tier.MaxQuantity != 0 && tier.MaxQuantity < tier.MinQuantity {
+			return fmt.Errorf("%w: tier %d-%d ends before it starts", ErrInvalidDeal, tier.MinQuantity, tier.MaxQuantity)
+		}
+		if err := validateAmount("tier price", tier.Price); err != nil {
+			return err
+		}
+		if i == 0 {
+			continue
+		}
+		previous := tiers[i-1]
+		if previous.MaxQuantity == 0 || previous.MaxQuantity >= tier.MinQuantity {
+			return fmt.Errorf("%w: tier starting at %d overlaps the tier starting at %d", ErrInvalidDeal, tier.MinQuantity, previous.MinQuantity)
+		}
+	}
+	return nil
+}
+
+func (tieredStrategy) Price(engine *pricingEngine, lines []*ProductOffering) error {
+	tiers, err := engine.catalog.getDealTiers(engine.ctx, lines[0].DealID)
+	if err != nil {
+		return err
+	}
+	for _, po := range lines {
+		unitPrice := po.Price
+		for _, tier := range tiers {
+			if po.Quantity >= tier.MinQuantity && (tier.MaxQuantity == 0 || po.Quantity <= tier.MaxQuantity) {
+				unitPrice = tier.Price
+				break
+			}
+		}
+		price, err := decimal.NewFromString(unitPrice)
+		if err != nil {
+			return err
+		}
+		quantity := decimal.NewFromInt(int64(po.Quantity))
+		engine.charge(po, price.Mul(quantity))
+	}
+	return nil
+}
+
+/* Cart promotions: a flat amount off the qualifying subtotal */
+type cartFlatStrategy struct{}
+
+func (cartFlatStrategy) Validate(deal Deal) error {
+	if err := validateAmount("coupon", deal.Coupon); err != nil {
+		return err
+	}
+	return validateThreshold(deal)
+}
+
+func (cartFlatStrategy) Discount(promotion *CartPromotion, subtotal decimal.Decimal) (decimal.Decimal, error) {
+	return decimalOrZero(promotion.Coupon)
+}
+
+/* Cart promotions: a fraction off the qualifying subtotal, "0.10" is 10% off */
+type cartPercentStrategy struct{}
+
+func (cartPercentStrategy) Validate(deal Deal) error {
+	if err := validateFraction("percent", deal.Percent); err != nil {
+		return err
+	}
+	return validateThreshold(deal)
+}
+
+func (cartPercentStrategy) Discount(promotion *CartPromotion, subtotal decimal.Decimal) (decimal.Decimal, error) {
+	percent, err := decimalOrZero(promotion.Percent)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return subtotal.Mul(percent), nil
+}
+
+// cart promotions may leave the threshold empty, but it has to be money when it's set
+func validateThreshold(deal Deal) error {
+	if deal.MinQuantity < 0 {
+		return fmt.Errorf("%w: min_quantity can't be negative", ErrInvalidDeal)
+	}
+	if deal.Threshold == "" {
+		return nil
+	}
+	return validateAmount("threshold", deal.Threshold)
+}
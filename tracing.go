@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+   OpenTelemetry tracing. Every request gets a span, the service methods it
+   calls get a span under it and every repository query gets a span under
+   those, so a slow request shows where its time went. Spans are exported
+   to stdout or an OTLP collector, or dropped when tracing is off.
+*/
+
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterOTLP   = "otlp"
+)
+
+// the server's tracer, startTracing replaces it with one that exports
+var tracer = otel.Tracer("store")
+
+/*
+   Sets up the exporter the config asks for. The returned func flushes the
+   spans that haven't been exported yet, call it before exiting.
+*/
+func startTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(config.Endpoint), otlptracehttp.WithInsecure())
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "store"),
+			attribute.String("service.version", buildCommit),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = provider.Tracer("store")
+	return provider.Shutdown, nil
+}
+
+// startSpan is how service methods trace themselves: ctx, span := startSpan(ctx, "listProducts"); defer span.End()
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "ProductService."+name)
+}
+
+// encodeResponse marshals a response body under a span of its own, a big response takes a while to encode
+func encodeResponse(ctx context.Context, body interface{}) ([]byte, error) {
+	_, span := tracer.Start(ctx, "encodeResponse")
+	defer span.End()
+	return json.Marshal(body)
+}
+
+// traceQuery records a finished repository query as a span, observeQuery calls it
+func traceQuery(ctx context.Context, query string, start time.Time) {
+	_, span := tracer.Start(ctx, query,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attribute.String("db.operation", query)),
+	)
+	span.End()
+}
+
+/*
+   Starts a span for every request, continuing the caller's trace when it
+   sends a traceparent header. The span is named after the route the
+   request was served by, like "GET /cart".
+*/
+func traceRequests(route func(request *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer.Start(ctx, request.Method, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+
+		pattern := route(request)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		span.SetName(request.Method + " " + pattern)
+		span.SetAttributes(
+			attribute.String("http.method", request.Method),
+			attribute.String("http.route", pattern),
+			attribute.String("http.target", request.URL.Path),
+			attribute.Int("http.status_code", recorder.status),
+			attribute.String("request.id", writer.Header().Get("X-Request-ID")),
+		)
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// traceIDFromContext is the id of the trace ctx is part of, empty when it isn't being traced
+func traceIDFromContext(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
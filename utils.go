@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
 	"github.com/shopspring/decimal"
 )
 
@@ -36,123 +41,415 @@ func buyXGetYPrice(quantity int, x int, y int) int {
 	return x + buyXGetYPrice(quantity-z, x, y)
 }
 
-// Takes a map [DealID] -> ProductOffering{} to determine
-func (service *ProductService) bundlePrice(bundledItems map[int][]*ProductOffering) (decimal.Decimal, error) {
-	bundleTotal, err := decimal.NewFromString("0")
+/*
+   Where strategies look up the parts of a deal that don't come back with the
+   cart lines. It answers from memory, see catalogSnapshot.
+*/
+type dealCatalog interface {
+	getBundleComponents(ctx context.Context, dID int) ([]*Offering, error)
+	getDealTiers(ctx context.Context, dID int) ([]Tier, error)
+}
+
+/*
+   The pricing engine keeps a running total while each deal's strategy
+   charges for the cart lines offered under it, along with what every
+   product came to so cart-level promotions can be evaluated afterwards.
+*/
+type pricingEngine struct {
+	ctx        context.Context
+	catalog    dealCatalog
+	total      decimal.Decimal
+	lineTotals map[int]decimal.Decimal
+	quantities map[int]int
+	breakdown  []Adjustment
+}
+
+func newPricingEngine(ctx context.Context, catalog dealCatalog) *pricingEngine {
+	return &pricingEngine{
+		ctx:        ctx,
+		catalog:    catalog,
+		total:      decimal.Zero,
+		lineTotals: make(map[int]decimal.Decimal),
+		quantities: make(map[int]int),
+	}
+}
+
+// charge adds the price of a cart line to the total
+func (engine *pricingEngine) charge(po *ProductOffering, amount decimal.Decimal) {
+	engine.total = engine.total.Add(amount)
+	engine.lineTotals[po.ProductID] = engine.lineTotals[po.ProductID].Add(amount)
+}
+
+// adjust records a deal's effect on a line in the breakdown
+func (engine *pricingEngine) adjust(adjustment Adjustment) {
+	engine.breakdown = append(engine.breakdown, adjustment)
+}
+
+func totalPrice(ctx context.Context, catalog dealCatalog, productOfferings []*ProductOffering, promotions []*CartPromotion) (string, []Adjustment, error) {
+	start := time.Now()
+	defer func() { pricingDuration.Observe(time.Since(start).Seconds()) }()
+
+	total, breakdown, applied, err := price(ctx, catalog, productOfferings, promotions)
 	if err != nil {
-		return decimal.Decimal{}, err
-	}
-	// for each unique bundle in the cart
-	for k, v := range bundledItems {
-		// get all the items in that bundle
-		offerings := service.repository.getBundleComponents(k)
-		// start a subtotal for that bundle
-		subtotal, err := decimal.NewFromString("0")
-		if err != nil {
-			return decimal.Decimal{}, err
-		}
-		for i := range v {
-			if len(offerings) == len(bundledItems[k]) {
-				price, err := decimal.NewFromString(v[i].ModifiedPrice)
-				if err != nil {
-					return decimal.Decimal{}, err
-				}
-				subtotal = subtotal.Add(price)
-				break
-
-			} else {
-				/* add up the retail prices x quantity */
-				price, err := decimal.NewFromString(v[i].Price)
-				if err != nil {
-					return decimal.Decimal{}, err
-				}
-				subtotal = subtotal.Add(price)
-			}
+		return "NAN", nil, err
+	}
+	for _, dtype := range applied {
+		dealApplications.WithLabelValues(string(dtype)).Inc()
+	}
+	return total, breakdown, nil
+}
+
+// price is totalPrice without the metrics, applied is the type of every deal and promotion that was applied
+func price(ctx context.Context, catalog dealCatalog, productOfferings []*ProductOffering, promotions []*CartPromotion) (string, []Adjustment, []DealType, error) {
+	engine := newPricingEngine(ctx, catalog)
+	var applied []DealType
+
+	/* a product in a category deal is only priced by that deal */
+	inCategoryDeal := make(map[int]bool)
+	for _, po := range productOfferings {
+		if po.Category != "" {
+			inCategoryDeal[po.ProductID] = true
+		}
+	}
+
+	/* group the cart lines by the deal they are offered under, in the order the deals first appear */
+	var dealIDs []int
+	offeredItems := make(map[int][]*ProductOffering)
+	offered := make(map[[2]int]bool)
+	exclusive := make(map[int]bool)
+	for i := range productOfferings {
+		po := *productOfferings[i]
+		if _, ok := cartStrategies[po.Type]; ok {
+			// cart-level promotions are applied once every item has been priced
+			continue
+		}
+		if inCategoryDeal[po.ProductID] && po.Category == "" {
+			continue
+		}
+		// a category deal can also have an offering for the same product
+		if offered[[2]int{po.DealID, po.ProductID}] {
+			continue
+		}
+		offered[[2]int{po.DealID, po.ProductID}] = true
+		if _, ok := offeredItems[po.DealID]; !ok {
+			dealIDs = append(dealIDs, po.DealID)
+		}
+		offeredItems[po.DealID] = append(offeredItems[po.DealID], &po)
+		engine.quantities[po.ProductID] = po.Quantity
+		if po.Exclusive {
+			exclusive[po.ProductID] = true
+		}
+	}
 
+	for _, dealID := range dealIDs {
+		lines := offeredItems[dealID]
+		strategy, ok := dealStrategies[lines[0].Type]
+		if !ok {
+			return "NAN", nil, nil, fmt.Errorf("no pricing strategy for deal type %q", lines[0].Type)
 		}
+		if err := strategy.Price(engine, lines); err != nil {
+			return "NAN", nil, nil, err
+		}
+		applied = append(applied, lines[0].Type)
+	}
 
-		bundleTotal = bundleTotal.Add(subtotal)
+	// cart-level promotions come off of what is left, lines under an exclusive deal don't stack with them
+	lineTotals := make(map[int]decimal.Decimal)
+	quantities := make(map[int]int)
+	for productID, lineTotal := range engine.lineTotals {
+		if !exclusive[productID] {
+			lineTotals[productID] = lineTotal
+			quantities[productID] = engine.quantities[productID]
+		}
 	}
+	discount, promotionBreakdown, err := cartDiscount(promotions, lineTotals, quantities)
+	if err != nil {
+		return "NAN", nil, nil, err
+	}
+	for _, adjustment := range promotionBreakdown {
+		applied = append(applied, adjustment.Type)
+	}
+	breakdown := append(engine.breakdown, promotionBreakdown...)
+	total := engine.total
+	if discount.GreaterThan(total) {
+		discount = total
+	}
+	total = total.Sub(discount)
 
-	return bundleTotal, nil
+	return total.String(), breakdown, applied, nil
+}
+
+// parses a money or percent field, treating an empty field as zero
+func decimalOrZero(value string) (decimal.Decimal, error) {
+	if value == "" {
+		return decimal.Zero, nil
+	}
+	return decimal.NewFromString(value)
 }
 
-func (service *ProductService) totalPrice(productOfferings []*ProductOffering) (string, error) {
-	total, err := decimal.NewFromString("0")
+// works out how much a single cart-level promotion takes off, ok is false when
+// the cart doesn't meet the promotion's threshold or minimum quantity
+func promotionDiscount(promotion *CartPromotion, lineTotals map[int]decimal.Decimal, quantities map[int]int) (discount decimal.Decimal, ok bool, err error) {
+	subtotal := decimal.Zero
+	count := 0
+	if len(promotion.ProductIDs) == 0 {
+		for productID, lineTotal := range lineTotals {
+			subtotal = subtotal.Add(lineTotal)
+			count += quantities[productID]
+		}
+	} else {
+		for _, productID := range promotion.ProductIDs {
+			subtotal = subtotal.Add(lineTotals[productID])
+			count += quantities[productID]
+		}
+	}
+
+	threshold, err := decimalOrZero(promotion.Threshold)
 	if err != nil {
-		return "NAN", err
+		return decimal.Zero, false, err
 	}
-	/* A map of deals to cart items that match those deals, used to calculate bundle prices */
-	bundledItems := make(map[int][]*ProductOffering)
-	/* a bit hacky, but this map tracks the count of each product in a bundle*/
-	for i := range productOfferings {
-		temp, err := decimal.NewFromString("0")
+	if count == 0 || subtotal.LessThan(threshold) || count < promotion.MinQuantity {
+		return decimal.Zero, false, nil
+	}
+
+	strategy, ok := cartStrategies[promotion.Type]
+	if !ok {
+		return decimal.Zero, false, fmt.Errorf("no pricing strategy for deal type %q", promotion.Type)
+	}
+	discount, err = strategy.Discount(promotion, subtotal)
+	if err != nil {
+		return decimal.Zero, false, err
+	}
+
+	// never take off more than the qualifying items cost
+	if discount.GreaterThan(subtotal) {
+		discount = subtotal
+	}
+	return discount, true, nil
+}
+
+// Evaluates cart-level promotions against the item-level line totals.
+// Non-exclusive promotions stack with each other, an exclusive promotion
+// can't be combined with anything so it is only used when it beats the stack.
+func cartDiscount(promotions []*CartPromotion, lineTotals map[int]decimal.Decimal, quantities map[int]int) (decimal.Decimal, []Adjustment, error) {
+	stacked := decimal.Zero
+	var stackedAdjustments []Adjustment
+
+	best := decimal.Zero
+	var bestAdjustment *Adjustment
+
+	for _, promotion := range promotions {
+		discount, ok, err := promotionDiscount(promotion, lineTotals, quantities)
 		if err != nil {
-			return "NAN", err
+			return decimal.Zero, nil, err
+		}
+		if !ok {
+			continue
 		}
-		po := *productOfferings[i]
 
-		switch po.Type {
-		case "Bundle":
-			// we don't decided on a final price until we finish looping over all the products
-			// so we add the each item in the cart to a list associated with the bundle it's in.
-			bundledItems[po.DealID] = append(bundledItems[po.DealID], &po)
-		case "BuyXGetY":
+		adjustment := Adjustment{
+			DealID:      promotion.ID,
+			DealName:    promotion.Name,
+			Type:        promotion.Type,
+			Threshold:   promotion.Threshold,
+			MinQuantity: promotion.MinQuantity,
+			Discount:    discount.String(),
+		}
 
-			price, err := decimal.NewFromString(po.Price)
-			if err != nil {
-				return "NAN", err
+		if promotion.Exclusive {
+			if bestAdjustment == nil || discount.GreaterThan(best) {
+				best = discount
+				bestAdjustment = &adjustment
 			}
-			// recurse over the number of items to calculate full price items
-			regularPriceItems := buyXGetYPrice(po.Quantity, po.X, po.Y)
-			quantity := decimal.NewFromInt(int64(regularPriceItems))
-			temp = price.Mul(quantity)
+			continue
+		}
+		stacked = stacked.Add(discount)
+		stackedAdjustments = append(stackedAdjustments, adjustment)
+	}
 
-		case "Percent":
+	if bestAdjustment != nil && best.GreaterThan(stacked) {
+		return best, []Adjustment{*bestAdjustment}, nil
+	}
+	return stacked, stackedAdjustments, nil
+}
 
-			price, err := decimal.NewFromString(po.Price)
-			if err != nil {
-				return "NAN", err
+/*
+   An in-memory copy of the catalog the pricing engine runs against without
+   touching the database. Carts are priced against the cached deals and
+   offerings with the cart's products in it, simulations against a copy with
+   the deals that haven't been saved laid over it.
+*/
+type catalogSnapshot struct {
+	products  map[int]Product
+	deals     map[int]Deal
+	offerings []Offering
+}
+
+func newCatalogSnapshot(products []*Product, deals []*Deal, offerings []*Offering) *catalogSnapshot {
+	snapshot := &catalogSnapshot{
+		products: make(map[int]Product),
+		deals:    make(map[int]Deal),
+	}
+	for _, product := range products {
+		snapshot.products[product.ID] = *product
+	}
+	for _, deal := range deals {
+		snapshot.deals[deal.ID] = *deal
+	}
+	for _, offering := range offerings {
+		snapshot.offerings = append(snapshot.offerings, *offering)
+	}
+	return snapshot
+}
+
+// withItems shares the snapshot's deals and offerings, with only the products of items in it
+func (snapshot *catalogSnapshot) withItems(items []Item) *catalogSnapshot {
+	priced := &catalogSnapshot{
+		products:  make(map[int]Product, len(items)),
+		deals:     snapshot.deals,
+		offerings: snapshot.offerings,
+	}
+	for _, item := range items {
+		priced.products[item.Product.ID] = item.Product
+	}
+	return priced
+}
+
+// overlay replaces deals with the same id, and offerings of the same product and deal
+func (snapshot *catalogSnapshot) overlay(deals []Deal, offerings []Offering) {
+	for _, deal := range deals {
+		snapshot.deals[deal.ID] = deal
+	}
+	for _, offering := range offerings {
+		replaced := false
+		for i := range snapshot.offerings {
+			if snapshot.offerings[i].ProductID == offering.ProductID && snapshot.offerings[i].DealID == offering.DealID {
+				snapshot.offerings[i] = offering
+				replaced = true
 			}
-			// should be in range (0,1)
-			percent, err := decimal.NewFromString(po.Percent)
-			if err != nil {
-				return "NAN", err
+		}
+		if !replaced {
+			snapshot.offerings = append(snapshot.offerings, offering)
+		}
+	}
+}
+
+func (snapshot *catalogSnapshot) getBundleComponents(ctx context.Context, dID int) ([]*Offering, error) {
+	offerings := []*Offering{}
+	for _, offering := range snapshot.offerings {
+		if offering.DealID == dID {
+			offerings = append(offerings, &Offering{ProductID: offering.ProductID, DealID: offering.DealID})
+		}
+	}
+	return offerings, nil
+}
+
+func (snapshot *catalogSnapshot) getDealTiers(ctx context.Context, dID int) ([]Tier, error) {
+	tiers := make([]Tier, len(snapshot.deals[dID].Tiers))
+	copy(tiers, snapshot.deals[dID].Tiers)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinQuantity < tiers[j].MinQuantity })
+	return tiers, nil
+}
+
+/*
+   The cart lines for items: a line for every active offering of a product in
+   the cart, and for every category deal of the product's category. Category
+   lines come with the deal's category set.
+*/
+func (snapshot *catalogSnapshot) productOfferings(items []Item) []*ProductOffering {
+	var productOfferings []*ProductOffering
+	line := func(product Product, quantity int, deal Deal) *ProductOffering {
+		return &ProductOffering{
+			ProductID:   product.ID,
+			DealID:      deal.ID,
+			ProductName: product.Name,
+			DealName:    deal.Name,
+			Type:        deal.Type,
+			Price:       product.Price,
+			Quantity:    quantity,
+			X:           deal.X,
+			Y:           deal.Y,
+			Coupon:      deal.Coupon,
+			Percent:     deal.Percent,
+			Exclusive:   deal.Exclusive,
+		}
+	}
+
+	for _, item := range items {
+		product, ok := snapshot.products[item.Product.ID]
+		if !ok || item.Quantity <= 0 {
+			continue
+		}
+		for _, offering := range snapshot.offerings {
+			deal, ok := snapshot.deals[offering.DealID]
+			if offering.ProductID != product.ID || !offering.Active || !ok || !deal.isActive() {
+				continue
 			}
-			quantity := decimal.NewFromInt(int64(po.Quantity))
-			temp = price.Mul(quantity).Mul(percent)
+			po := line(product, item.Quantity, deal)
+			po.ModifiedPrice = offering.ModifiedPrice
+			productOfferings = append(productOfferings, po)
+		}
+	}
 
-		case "Coupon":
-			price, err := decimal.NewFromString(po.Price)
-			if err != nil {
-				return "NAN", err
+	for _, item := range items {
+		product, ok := snapshot.products[item.Product.ID]
+		if !ok || item.Quantity <= 0 || product.Category == "" {
+			continue
+		}
+		for _, dealID := range snapshot.dealIDs() {
+			deal := snapshot.deals[dealID]
+			if deal.Category != product.Category || !deal.isActive() {
+				continue
 			}
-			coupon, err := decimal.NewFromString(po.Coupon)
-			if err != nil {
-				return "NAN", err
+			po := line(product, item.Quantity, deal)
+			po.ModifiedPrice = "NAN"
+			po.Category = deal.Category
+			productOfferings = append(productOfferings, po)
+		}
+	}
+
+	return productOfferings
+}
+
+/*
+   The cart-level promotions that currently apply. A promotion with no
+   offerings is store wide, otherwise only the products in its active
+   offerings count towards it and a promotion whose offerings are all
+   inactive is skipped.
+*/
+func (snapshot *catalogSnapshot) cartPromotions() []*CartPromotion {
+	promotions := []*CartPromotion{}
+	for _, dealID := range snapshot.dealIDs() {
+		deal := snapshot.deals[dealID]
+		if _, ok := cartStrategies[deal.Type]; !ok || !deal.isActive() {
+			continue
+		}
+
+		promotion := &CartPromotion{Deal: deal}
+		scoped := false
+		for _, offering := range snapshot.offerings {
+			if offering.DealID != deal.ID {
+				continue
 			}
-			quantity := decimal.NewFromInt(int64(po.Quantity))
-			discountedPrice := price.Sub(coupon)
-			temp = discountedPrice.Mul(quantity)
-
-		case "Retail":
-			price, err := decimal.NewFromString(po.Price)
-			if err != nil {
-				return "NAN", err
+			scoped = true
+			if offering.Active {
+				promotion.ProductIDs = append(promotion.ProductIDs, offering.ProductID)
 			}
-			quantity := decimal.NewFromInt(int64(po.Quantity))
-			temp = price.Mul(quantity)
-
 		}
-		total = total.Add(temp)
+		if scoped && len(promotion.ProductIDs) == 0 {
+			continue
+		}
+		promotions = append(promotions, promotion)
 	}
+	return promotions
+}
 
-	// calcualte the bundle price at the end and tac it on
-	bundledTotal, err := service.bundlePrice(bundledItems)
-	if err != nil {
-		return "NAN", err
+// deal ids in order, so snapshots price the same way every time
+func (snapshot *catalogSnapshot) dealIDs() []int {
+	ids := make([]int, 0, len(snapshot.deals))
+	for id := range snapshot.deals {
+		ids = append(ids, id)
 	}
-	total = total.Add(bundledTotal)
-
-	return total.String(), nil
+	sort.Ints(ids)
+	return ids
 }